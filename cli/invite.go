@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"whtester/protocol"
+)
+
+// InviteLink returns the invite to hand out for the invite code, the
+// url of the server with the code in the invite query parameter
+func InviteLink(serverURL string, code string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return code
+	}
+	u.RawQuery = url.Values{"invite": {code}}.Encode()
+	return u.String()
+}
+
+// ParseInvite returns the server url and the code of an invite, invites
+// which are a bare code are for the default server
+func ParseInvite(invite string, defaultServer string) (string, string, error) {
+	if !strings.Contains(invite, "://") {
+		if invite == "" {
+			return "", "", fmt.Errorf("empty invite")
+		}
+		return defaultServer, invite, nil
+	}
+	u, err := url.Parse(invite)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing invite: %w", err)
+	}
+	code := u.Query().Get("invite")
+	if code == "" {
+		return "", "", fmt.Errorf("invite %q has no code", invite)
+	}
+	u.RawQuery = ""
+	return u.String(), code, nil
+}
+
+// JoinInvite joins the group of the invite code, with the role of the
+// invite. Servers without the control protocol don't support invites.
+func JoinInvite(serverURL string, code string, opts ...Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.httpClient = &http.Client{}
+	c.serverURL = serverURL
+	c.invite = code
+	c.Conn = NewConn(serverURL, c.header())
+	if !c.speaksProtocol() {
+		log.Fatalf("server doesn't support invites")
+	}
+	if err := c.sayHello(); err != nil {
+		log.Fatalf("error joining group, %v", err)
+	}
+	return c
+}
+
+// observer reports if the client only gets a copy of the requests
+func (c *Client) observer() bool {
+	return c.Role == protocol.RoleObserver
+}
+
+// CreateInvite asks the server for an invite to the group, the server
+// sends back the invite which is printed by Stream. An empty role is the
+// role of the client, an empty expiresIn and zero maxUses are the
+// defaults of the server.
+func (c *Client) CreateInvite(role protocol.Role, expiresIn string, maxUses int) error {
+	msg := protocol.New(protocol.TypeInvite)
+	msg.Invite = &protocol.Invite{Role: role, ExpiresIn: expiresIn, MaxUses: maxUses}
+	return c.sendControl(msg)
+}
+
+// ListInvites asks the server for the outstanding invites of the group
+func (c *Client) ListInvites() error {
+	msg := protocol.New(protocol.TypeInvites)
+	msg.Invites = &protocol.InviteList{}
+	return c.sendControl(msg)
+}
+
+// RevokeInvite revokes the invite with the id
+func (c *Client) RevokeInvite(id string) error {
+	msg := protocol.New(protocol.TypeRevokeInvite)
+	msg.Revoke = &protocol.Revoke{ID: id}
+	return c.sendControl(msg)
+}
+
+// sendControl sends a message only servers speaking the control
+// protocol understand
+func (c *Client) sendControl(msg protocol.Message) error {
+	if !c.speaksProtocol() {
+		return fmt.Errorf("server doesn't support invites")
+	}
+	return c.sendMessage(msg)
+}
+
+// printInvite prints an invite sent by the server, along with the link
+// to hand out when the invite was just created
+func (c *Client) printInvite(w io.Writer, inv protocol.Invite) {
+	fmt.Fprintf(w, "\ninvite %s, %s, used %d of %d, expires %s",
+		inv.ID, inv.Role, inv.Uses, inv.MaxUses, inv.ExpiresAt.Local().Format(time.DateTime))
+	if inv.Code != "" {
+		fmt.Fprintf(w, "\njoin with: whclient join %s", InviteLink(c.serverURL, inv.Code))
+	}
+}
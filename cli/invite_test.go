@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInvite(t *testing.T) {
+	t.Run("invite links hold the server and the code", func(t *testing.T) {
+		link := InviteLink("wss://whlink.example.com/ws", "abcd1234.secret")
+		assert.Equal(t, "wss://whlink.example.com/ws?invite=abcd1234.secret", link)
+		server, code, err := ParseInvite(link, "ws://default/ws")
+		require.NoError(t, err)
+		assert.Equal(t, "wss://whlink.example.com/ws", server)
+		assert.Equal(t, "abcd1234.secret", code)
+	})
+
+	t.Run("bare codes are for the default server", func(t *testing.T) {
+		server, code, err := ParseInvite("abcd1234.secret", "ws://default/ws")
+		require.NoError(t, err)
+		assert.Equal(t, "ws://default/ws", server)
+		assert.Equal(t, "abcd1234.secret", code)
+	})
+
+	t.Run("invites without a code are refused", func(t *testing.T) {
+		for _, invite := range []string{"", "wss://whlink.example.com/ws"} {
+			_, _, err := ParseInvite(invite, "ws://default/ws")
+			assert.Error(t, err, invite)
+		}
+	})
+}
+
+func TestJoinInvite(t *testing.T) {
+	t.Run("observer prints requests without forwarding them", func(t *testing.T) {
+		replies := make(chan protocol.Message, 1)
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			assert.Equal(t, "abcd1234.secret", hello.Invite)
+			msg := protocol.New(protocol.TypeWelcome)
+			msg.Welcome = &protocol.Welcome{URL: "http://abc.localhost", Session: "token", Role: protocol.RoleObserver}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+
+			req, _ := http.NewRequest(http.MethodPost, "/tempurl", strings.NewReader("hello"))
+			data, _ := serialize.EncodeRequest(req)
+			msg = protocol.New(protocol.TypeRequest)
+			msg.Request = &protocol.Request{ID: "1234", Data: data}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+			// the next message is the invite, not an ack
+			_, data, _ = ws.ReadMessage()
+			reply, _ := protocol.Decode(data)
+			replies <- reply
+		})
+		defer srv.Close()
+
+		c := JoinInvite("ws"+strings.TrimPrefix(srv.URL, "http"), "abcd1234.secret")
+		defer c.Conn.Close()
+		assert.Equal(t, protocol.RoleObserver, c.Role)
+		assert.True(t, c.joined, "the client resumes its session in the group")
+		assert.Empty(t, c.invite)
+		out := new(bytes.Buffer)
+		require.NoError(t, c.Read(out, []string{"Method"}, nil))
+		assert.Contains(t, out.String(), "POST")
+
+		require.NoError(t, c.CreateInvite(protocol.RoleObserver, "1h", 2))
+		select {
+		case reply := <-replies:
+			require.Equal(t, protocol.TypeInvite, reply.Type)
+			assert.Equal(t, &protocol.Invite{Role: protocol.RoleObserver, ExpiresIn: "1h", MaxUses: 2}, reply.Invite)
+		case <-time.After(time.Second):
+			t.Fatal("client didn't send the invite")
+		}
+	})
+
+	t.Run("created invites are printed with their link", func(t *testing.T) {
+		c := &Client{serverURL: "wss://whlink.example.com/ws"}
+		msg := protocol.New(protocol.TypeInvite)
+		msg.Invite = &protocol.Invite{ID: "abcd1234", Code: "abcd1234.secret", Role: protocol.RoleForwarder, MaxUses: 1}
+		out := new(bytes.Buffer)
+		require.NoError(t, c.handleMessage(out, nil, nil, protocol.Encode(msg)))
+		assert.Contains(t, out.String(), "whclient join wss://whlink.example.com/ws?invite=abcd1234.secret")
+	})
+}
@@ -0,0 +1,237 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrUnauthorized is returned when the server refuses the api token
+var ErrUnauthorized = errors.New("server refused the api token")
+
+// ErrRemoved is returned when the server closes the connection of a
+// client which was kicked or whose group was deleted, the client doesn't
+// reconnect
+var ErrRemoved = errors.New("removed from the group by the server")
+
+// dial connects to the server, offering the control protocol, servers
+// which don't speak it fall back to the legacy format
+func dial(wsLink string, header http.Header) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = time.Minute
+	dialer.Subprotocols = []string{protocol.Subprotocol}
+	ws, resp, err := dialer.Dial(wsLink, header)
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, resp.Status)
+	}
+	return ws, err
+}
+
+// speaksProtocol reports if the server accepted the control protocol
+func (c *Client) speaksProtocol() bool {
+	return c.conn().Subprotocol() == protocol.Subprotocol
+}
+
+// conn returns the connection to the server. The commands of the user
+// send messages from their own goroutine while Reconnect replaces the
+// connection, so it is guarded by writeMu.
+func (c *Client) conn() *websocket.Conn {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn
+}
+
+// setConn replaces the connection to the server
+func (c *Client) setConn(ws *websocket.Conn) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn = ws
+}
+
+func (c *Client) sendMessage(msg protocol.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+}
+
+// sayHello sends the hello message and waits for the welcome of the
+// server, a *protocol.Error is returned if the server refuses the client
+func (c *Client) sayHello() error {
+	hello := protocol.New(protocol.TypeHello)
+	hello.Hello = &protocol.Hello{Session: c.Session, Key: c.Key, Relay: c.Relay, Name: c.Name, Token: c.NameToken, Invite: c.invite}
+	if c.joined {
+		hello.Hello.URL = c.URL
+	}
+	if err := c.sendMessage(hello); err != nil {
+		return fmt.Errorf("sending hello: %w", err)
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(HandshakeWaitTime))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	_, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("reading welcome: %w", err)
+	}
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return err
+	}
+	switch msg.Type {
+	case protocol.TypeWelcome:
+		c.URL = msg.Welcome.URL
+		c.Session = msg.Welcome.Session
+		// the server only sends back passwords it could check
+		if msg.Welcome.Key != "" {
+			c.Key = msg.Welcome.Key
+		}
+		if msg.Welcome.Token != "" {
+			c.NameToken = msg.Welcome.Token
+		}
+		c.Role = msg.Welcome.Role
+		if c.invite != "" {
+			// the invite is used, the client resumes its session
+			// in the group from now on
+			c.invite = ""
+			c.joined = true
+		}
+		if c.observer() {
+			return nil
+		}
+		return c.sendSettings()
+	case protocol.TypeError:
+		return msg.Error
+	default:
+		return fmt.Errorf("expected welcome from server, got %s", msg.Type)
+	}
+}
+
+// sendSettings sends the settings of the group asked for by the user
+func (c *Client) sendSettings() error {
+	if c.Methods == nil && !c.Challenges && c.Responses == nil {
+		return nil
+	}
+	msg := protocol.New(protocol.TypeSettings)
+	msg.Settings = &protocol.Settings{Methods: c.Methods, Responses: c.Responses}
+	if c.Challenges {
+		msg.Settings.Challenges = &c.Challenges
+		msg.Settings.VerifyToken = &c.VerifyToken
+	}
+	if err := c.sendMessage(msg); err != nil {
+		return fmt.Errorf("sending settings: %w", err)
+	}
+	return nil
+}
+
+// handleMessage handles a control message sent by the server
+func (c *Client) handleMessage(w io.Writer, fields []string, targets []Target, data []byte) error {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		fmt.Fprintf(w, "\ninvalid message from server, %v", err)
+		return nil
+	}
+	switch msg.Type {
+	case protocol.TypeRequest:
+		c.handleRequest(w, fields, targets, msg.Request.ID, msg.Request.Data)
+	case protocol.TypeMemberJoined:
+		fmt.Fprintf(w, "\nnew member joined, %d members", msg.Member.Members)
+	case protocol.TypeInvite:
+		c.printInvite(w, *msg.Invite)
+	case protocol.TypeInvites:
+		if len(msg.Invites.Invites) == 0 {
+			fmt.Fprint(w, "\nno outstanding invites")
+		}
+		for _, inv := range msg.Invites.Invites {
+			c.printInvite(w, inv)
+		}
+	case protocol.TypeSettings:
+		methods := "all"
+		if len(msg.Settings.Methods) > 0 {
+			methods = strings.Join(msg.Settings.Methods, ", ")
+		}
+		challenges := "off"
+		if msg.Settings.Challenges != nil && *msg.Settings.Challenges {
+			challenges = "on"
+		}
+		fmt.Fprintf(w, "\ngroup settings, methods: %s, challenges: %s, canned responses: %d",
+			methods, challenges, len(msg.Settings.Responses))
+	case protocol.TypeError:
+		fmt.Fprintf(w, "\nerror from server, %v", msg.Error)
+	case protocol.TypeGoodbye:
+		// the server going away tells where to reconnect, the close
+		// frame which follows tells if the client can reconnect
+		if msg.Goodbye.Reconnect != "" {
+			c.serverURL = msg.Goodbye.Reconnect
+		}
+		fmt.Fprintf(w, "\nserver said goodbye: %s", msg.Goodbye.Reason)
+	}
+	return nil
+}
+
+// handleRequest prints and forwards the request, then tells the server
+// the outcome
+func (c *Client) handleRequest(w io.Writer, fields []string, targets []Target, id string, data []byte) {
+	var resp *http.Response
+	req, err := serialize.DecodeRequest(data)
+	if err != nil {
+		fmt.Fprintf(w, "\ninvalid request from server, %v", err)
+		resp = &http.Response{StatusCode: http.StatusBadGateway}
+	} else {
+		if id == "" {
+			id = req.Header.Get(serialize.RequestIDHeader)
+		}
+		req.Header.Del(serialize.RequestIDHeader)
+
+		// print the specified fields
+		fmt.Fprint(w, ReadRequestFields(fields, *req))
+
+		// observers don't forward nor acknowledge the requests
+		if c.observer() {
+			return
+		}
+
+		// forward request to locally running program
+		resp, err = forwardRequestToTargets(c, data, targets)
+	}
+	if id == "" {
+		return
+	}
+	if c.speaksProtocol() {
+		ack := protocol.New(protocol.TypeAck)
+		ack.Ack = &protocol.Ack{ID: id}
+		if err != nil {
+			ack.Ack.Error = err.Error()
+		}
+		if c.Relay {
+			ack.Ack.Response = encodeResponse(id, resp, serialize.EncodeResponse)
+		}
+		c.sendMessage(ack)
+		return
+	}
+	if c.Relay {
+		// servers without the control protocol decode the legacy format
+		c.Conn.WriteMessage(websocket.BinaryMessage, encodeResponse(id, resp, serialize.EncodeLegacyResponse))
+	}
+	c.Conn.WriteMessage(websocket.TextMessage, serialize.EncodeAck(id, err))
+}
+
+// encodeResponse encodes the response of the local program, responses
+// which can't be encoded, e.g. because they are too large, are replaced
+// by a bad gateway response
+func encodeResponse(id string, resp *http.Response, encode func(string, *http.Response) ([]byte, error)) []byte {
+	data, err := encode(id, resp)
+	if err == nil {
+		return data
+	}
+	data, _ = encode(id, &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Body:       io.NopCloser(strings.NewReader(err.Error())),
+	})
+	return data
+}
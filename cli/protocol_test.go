@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProtocolServerFake starts a server speaking the control protocol,
+// handle is called with the connection after the hello of the client
+func newProtocolServerFake(t *testing.T, handle func(ws *websocket.Conn, hello *protocol.Hello)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{protocol.Subprotocol}}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrading connection: %v", err)
+			return
+		}
+		defer ws.Close()
+		_, data, _ := ws.ReadMessage()
+		msg, err := protocol.Decode(data)
+		if err != nil || msg.Type != protocol.TypeHello {
+			t.Errorf("expected hello from client, got %s", data)
+			return
+		}
+		handle(ws, msg.Hello)
+	}))
+}
+
+func TestProtocolClient(t *testing.T) {
+	welcome := func(ws *websocket.Conn) {
+		msg := protocol.New(protocol.TypeWelcome)
+		msg.Welcome = &protocol.Welcome{URL: "http://abc.localhost", Key: "secret", Session: "token"}
+		ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+	}
+
+	t.Run("client reads its group from the welcome", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			assert.True(t, hello.Relay)
+			welcome(ws)
+		})
+		defer srv.Close()
+
+		c := Newclient("ws"+strings.TrimPrefix(srv.URL, "http"), WithRelay())
+		defer c.Conn.Close()
+		assert.Equal(t, "http://abc.localhost", c.URL)
+		assert.Equal(t, "secret", c.Key)
+		assert.Equal(t, "token", c.Session)
+	})
+
+	t.Run("client asks for a name and keeps its token", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			assert.Equal(t, "team-payments", hello.Name)
+			assert.Empty(t, hello.Token)
+			msg := protocol.New(protocol.TypeWelcome)
+			msg.Welcome = &protocol.Welcome{URL: "http://team-payments.localhost", Key: "secret", Session: "token", Token: "owner"}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+		})
+		defer srv.Close()
+
+		c := Newclient("ws"+strings.TrimPrefix(srv.URL, "http"), WithName("team-payments", ""))
+		defer c.Conn.Close()
+		assert.Equal(t, "http://team-payments.localhost", c.URL)
+		assert.Equal(t, "owner", c.NameToken)
+	})
+
+	t.Run("client acknowledges requests", func(t *testing.T) {
+		acks := make(chan protocol.Message, 1)
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			welcome(ws)
+			req, _ := http.NewRequest(http.MethodPost, "/tempurl", strings.NewReader("hello"))
+			msg := protocol.New(protocol.TypeRequest)
+			data, _ := serialize.EncodeRequest(req)
+			msg.Request = &protocol.Request{ID: "1234", Data: data}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+			_, data, _ = ws.ReadMessage()
+			ack, _ := protocol.Decode(data)
+			acks <- ack
+		})
+		defer srv.Close()
+
+		c := Newclient("ws"+strings.TrimPrefix(srv.URL, "http"), WithRelay())
+		defer c.Conn.Close()
+		// no target is running, so forwarding fails
+		require.NoError(t, c.Read(new(bytes.Buffer), nil, nil))
+
+		select {
+		case ack := <-acks:
+			require.Equal(t, protocol.TypeAck, ack.Type)
+			assert.Equal(t, "1234", ack.Ack.ID)
+			assert.NotEmpty(t, ack.Ack.Error)
+			_, resp, err := serialize.DecodeResponse(ack.Ack.Response)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		case <-time.After(time.Second):
+			t.Fatal("client didn't acknowledge the request")
+		}
+	})
+
+	t.Run("client sends the settings of the group after the welcome", func(t *testing.T) {
+		settings := make(chan *protocol.Settings, 1)
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			welcome(ws)
+			_, data, _ := ws.ReadMessage()
+			msg, _ := protocol.Decode(data)
+			settings <- msg.Settings
+		})
+		defer srv.Close()
+
+		c := Newclient("ws"+strings.TrimPrefix(srv.URL, "http"), WithMethods("GET", "POST"), WithChallenges("secret"))
+		defer c.Conn.Close()
+		select {
+		case got := <-settings:
+			require.NotNil(t, got)
+			assert.Equal(t, []string{"GET", "POST"}, got.Methods)
+			require.NotNil(t, got.Challenges)
+			assert.True(t, *got.Challenges)
+			assert.Equal(t, "secret", *got.VerifyToken)
+		case <-time.After(time.Second):
+			t.Fatal("client didn't send its settings")
+		}
+	})
+
+	t.Run("goodbye is printed and the close frame ends the connection", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			welcome(ws)
+			msg := protocol.New(protocol.TypeGoodbye)
+			msg.Goodbye = &protocol.Goodbye{Reason: "shutting down"}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"))
+		})
+		defer srv.Close()
+
+		c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+		defer c.Conn.Close()
+		buf := new(bytes.Buffer)
+		require.NoError(t, c.Read(buf, nil, nil))
+		assert.Contains(t, buf.String(), "shutting down")
+		err := c.Read(buf, nil, nil)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrRemoved)
+	})
+
+	t.Run("kicked client stops instead of reconnecting", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			if hello.Session != "" {
+				t.Error("kicked client reconnected")
+				return
+			}
+			welcome(ws)
+			msg := protocol.New(protocol.TypeGoodbye)
+			msg.Goodbye = &protocol.Goodbye{Reason: "kicked by an admin"}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(protocol.CloseRemoved, "kicked by an admin"))
+		})
+		defer srv.Close()
+
+		c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+		buf := new(bytes.Buffer)
+		err := c.Stream(buf, nil, nil)
+		assert.ErrorIs(t, err, ErrRemoved)
+		assert.Contains(t, buf.String(), "kicked by an admin")
+	})
+
+	t.Run("server going away tells where to reconnect", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			welcome(ws)
+			msg := protocol.New(protocol.TypeGoodbye)
+			msg.Goodbye = &protocol.Goodbye{Reason: "server going away", Reconnect: "ws://hooks2.localhost/ws"}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+		})
+		defer srv.Close()
+
+		c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+		defer c.Conn.Close()
+		require.NoError(t, c.Read(new(bytes.Buffer), nil, nil))
+		assert.Equal(t, "ws://hooks2.localhost/ws", c.serverURL)
+	})
+
+	t.Run("refused client gets an error on reconnect", func(t *testing.T) {
+		srv := newProtocolServerFake(t, func(ws *websocket.Conn, hello *protocol.Hello) {
+			assert.Equal(t, "http://abc.localhost", hello.URL)
+			msg := protocol.New(protocol.TypeError)
+			msg.Error = &protocol.Error{Code: protocol.ErrInvalidKey, Message: "invalid group password"}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+		})
+		defer srv.Close()
+
+		c := &Client{serverURL: "ws" + strings.TrimPrefix(srv.URL, "http"), URL: "http://abc.localhost", Key: "wrong", joined: true}
+		err := c.Reconnect(new(bytes.Buffer))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), protocol.ErrInvalidKey)
+	})
+}
+
+func TestAPIToken(t *testing.T) {
+	t.Run("token is sent as bearer token", func(t *testing.T) {
+		c := &Client{APIToken: "secret"}
+		assert.Equal(t, "Bearer secret", c.header().Get("Authorization"))
+		c = &Client{}
+		assert.Empty(t, c.header().Get("Authorization"))
+	})
+
+	t.Run("refused token is not retried", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "missing or invalid api token", http.StatusUnauthorized)
+		}))
+		defer srv.Close()
+
+		c := &Client{serverURL: "ws" + strings.TrimPrefix(srv.URL, "http"), APIToken: "wrong"}
+		err := c.Reconnect(new(bytes.Buffer))
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	})
+}
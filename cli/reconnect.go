@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"whtester/protocol"
+)
+
+var (
+	// ReconnectMinWait is the wait after the first failed attempt to
+	// reconnect, the wait doubles after every failed attempt
+	ReconnectMinWait = 1 * time.Second
+	// ReconnectMaxWait caps the wait between attempts to reconnect
+	ReconnectMaxWait = 30 * time.Second
+	// HandshakeWaitTime is how long the client waits for the server
+	// to send the url and password after connecting
+	HandshakeWaitTime = 5 * time.Second
+)
+
+// parseHandshake reads the url, session and password sent by the server
+// in the form "<url>\nsession: <token>\npassword: <password>", where the
+// session line is optional
+func parseHandshake(msg string) (u string, session string, key string, ok bool) {
+	_, key, ok = strings.Cut(msg, "password: ")
+	if !ok {
+		return "", "", "", false
+	}
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		if s, found := strings.CutPrefix(line, "session: "); found {
+			session = s
+		}
+	}
+	return lines[0], session, key, true
+}
+
+// resumeHeader returns the headers sent to the server to reclaim the
+// url and password of the client
+func (c *Client) resumeHeader() http.Header {
+	header := c.header()
+	if c.Session != "" {
+		header.Set("session", c.Session)
+	}
+	// the server only keeps the hash of the password, it sends the
+	// password back once it checked it
+	if c.Key != "" {
+		header.Set("key", c.Key)
+	}
+	if c.joined {
+		header.Set("url", c.URL)
+	}
+	return header
+}
+
+// Reconnect connects to the server again and reclaims the url and
+// password of the client, it keeps trying with backoff while the server
+// is unreachable and returns an error if the server refuses the client
+func (c *Client) Reconnect(w io.Writer) error {
+	wait := ReconnectMinWait
+	for {
+		ws, err := dial(c.serverURL, c.resumeHeader())
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(w, "\ncould not reconnect to server, %v, retrying in %s", err, wait)
+			time.Sleep(wait)
+			wait = min(wait*2, ReconnectMaxWait)
+			continue
+		}
+
+		if ws.Subprotocol() == protocol.Subprotocol {
+			previous := c.URL
+			c.setConn(ws)
+			err := c.sayHello()
+			var refused *protocol.Error
+			if errors.As(err, &refused) {
+				ws.Close()
+				return fmt.Errorf("server refused to reconnect: %w", err)
+			}
+			if err != nil {
+				ws.Close()
+				fmt.Fprintf(w, "\ncould not reconnect to server, %v, retrying in %s", err, wait)
+				time.Sleep(wait)
+				wait = min(wait*2, ReconnectMaxWait)
+				continue
+			}
+			c.printReconnected(w, previous)
+			return nil
+		}
+
+		ws.SetReadDeadline(time.Now().Add(HandshakeWaitTime))
+		_, data, err := ws.ReadMessage()
+		ws.SetReadDeadline(time.Time{})
+		if err != nil {
+			ws.Close()
+			fmt.Fprintf(w, "\ncould not read url from server, %v, retrying in %s", err, wait)
+			time.Sleep(wait)
+			wait = min(wait*2, ReconnectMaxWait)
+			continue
+		}
+
+		u, session, key, ok := parseHandshake(string(data))
+		if !ok {
+			ws.Close()
+			return fmt.Errorf("server refused to reconnect: %s", string(data))
+		}
+		previous := c.URL
+		c.URL, c.Session = u, session
+		if key != "" {
+			c.Key = key
+		}
+		c.setConn(ws)
+		c.printReconnected(w, previous)
+		return nil
+	}
+}
+
+// printReconnected tells the user if the url changed on reconnect
+func (c *Client) printReconnected(w io.Writer, previous string) {
+	if c.URL != previous {
+		fmt.Fprintf(w, "\nsession expired, new link: %s\npassword: %s", c.URL, c.Key)
+		return
+	}
+	fmt.Fprint(w, "\nreconnected to server")
+}
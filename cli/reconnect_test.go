@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHandshake(t *testing.T) {
+	t.Run("reads url, session and password", func(t *testing.T) {
+		u, session, key, ok := parseHandshake("http://abc.localhost\nsession: token\npassword: secret")
+		assert.True(t, ok)
+		assert.Equal(t, "http://abc.localhost", u)
+		assert.Equal(t, "token", session)
+		assert.Equal(t, "secret", key)
+	})
+
+	t.Run("session is optional", func(t *testing.T) {
+		u, session, key, ok := parseHandshake("http://abc.localhost\npassword: secret")
+		assert.True(t, ok)
+		assert.Equal(t, "http://abc.localhost", u)
+		assert.Equal(t, "", session)
+		assert.Equal(t, "secret", key)
+	})
+
+	t.Run("rejects other messages", func(t *testing.T) {
+		_, _, _, ok := parseHandshake("invalid group, grop does not exisit")
+		assert.False(t, ok)
+	})
+}
+
+func TestReconnect(t *testing.T) {
+	ReconnectMinWait = 10 * time.Millisecond
+	defer func() { ReconnectMinWait = time.Second }()
+
+	t.Run("client resumes its session after losing the connection", func(t *testing.T) {
+		sessions := make(chan string, 2)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			ws, _ := upgrader.Upgrade(w, r, nil)
+			sessions <- r.Header.Get("session")
+			ws.WriteMessage(websocket.TextMessage, []byte("http://abc.localhost\nsession: token\npassword: secret"))
+			// drop the first connection
+			if r.Header.Get("session") == "" {
+				ws.Close()
+			}
+		}))
+		defer srv.Close()
+
+		buf := new(bytes.Buffer)
+		c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+		assert.Equal(t, "", <-sessions)
+		assert.Equal(t, "token", c.Session)
+
+		err := c.Read(buf, nil, nil)
+		require.Error(t, err, "connection is lost")
+
+		require.NoError(t, c.Reconnect(buf))
+		defer c.Conn.Close()
+		assert.Equal(t, "token", <-sessions)
+		assert.Equal(t, "http://abc.localhost", c.URL)
+		assert.Equal(t, "secret", c.Key)
+	})
+
+	t.Run("client retries until the server is reachable", func(t *testing.T) {
+		// reserve a free address for the server
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		l.Close()
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			ws, _ := upgrader.Upgrade(w, r, nil)
+			ws.WriteMessage(websocket.TextMessage, []byte("http://abc.localhost\nsession: token\npassword: secret"))
+		}))
+		c := &Client{serverURL: "ws://" + addr, URL: "http://abc.localhost"}
+
+		// server comes up after a few failed attempts
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			srv.Listener, _ = net.Listen("tcp", addr)
+			srv.Start()
+		}()
+		defer srv.Close()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, c.Reconnect(buf))
+		defer c.Conn.Close()
+		assert.Contains(t, buf.String(), "could not reconnect to server")
+		assert.Contains(t, buf.String(), "reconnected to server")
+	})
+
+	t.Run("commands are sent while the client reconnects", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			ws, _ := upgrader.Upgrade(w, r, nil)
+			defer ws.Close()
+			ws.WriteMessage(websocket.TextMessage, []byte("http://abc.localhost\nsession: token\npassword: secret"))
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+		defer srv.Close()
+
+		c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+		done := make(chan struct{})
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					c.ListInvites()
+					c.sendMessage(protocol.New(protocol.TypeInvites))
+				}
+			}
+		}()
+		c.Conn.Close()
+		require.NoError(t, c.Reconnect(new(bytes.Buffer)))
+		close(done)
+		<-sent
+		c.Conn.Close()
+	})
+
+	t.Run("refused client gets an error", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			ws, _ := upgrader.Upgrade(w, r, nil)
+			assert.Equal(t, "http://abc.localhost", r.Header.Get("url"))
+			ws.WriteMessage(websocket.TextMessage, []byte("invalid group, grop does not exisit"))
+			ws.Close()
+		}))
+		defer srv.Close()
+
+		c := &Client{serverURL: "ws" + strings.TrimPrefix(srv.URL, "http"), URL: "http://abc.localhost", Key: "secret", joined: true}
+		assert.Error(t, c.Reconnect(new(bytes.Buffer)))
+	})
+}
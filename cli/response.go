@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"whtester/protocol"
+)
+
+// LoadResponses reads the canned responses from a JSON file holding a
+// list of responses, see protocol.Response
+func LoadResponses(file string) ([]protocol.Response, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading responses file: %w", err)
+	}
+	responses := []protocol.Response{}
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return nil, fmt.Errorf("parsing responses file: %w", err)
+	}
+	for i, r := range responses {
+		if r.Status == 0 {
+			return nil, fmt.Errorf("response %d has no status", i)
+		}
+	}
+	return responses, nil
+}
+
+// WithResponses makes the server write the canned responses to the
+// webhook senders of the group instead of the default response, the
+// server still forwards the requests
+func WithResponses(responses ...protocol.Response) Option {
+	return func(c *Client) {
+		c.Responses = append([]protocol.Response{}, responses...)
+	}
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"whtester/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadResponses(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		file := filepath.Join(t.TempDir(), "responses.json")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+
+	t.Run("reads the responses", func(t *testing.T) {
+		file := write(t, `[{"method": "POST", "path": "/github/*", "status": 500, "headers": {"Retry-After": "1"}, "body": "{{.ID}}", "delay": "1s"}]`)
+		got, err := LoadResponses(file)
+		require.NoError(t, err)
+		want := []protocol.Response{{
+			Method:  "POST",
+			Path:    "/github/*",
+			Status:  500,
+			Headers: map[string]string{"Retry-After": "1"},
+			Body:    "{{.ID}}",
+			Delay:   "1s",
+		}}
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("empty list restores the default response", func(t *testing.T) {
+		got, err := LoadResponses(write(t, `[]`))
+		require.NoError(t, err)
+		assert.NotNil(t, got)
+		assert.Empty(t, got)
+	})
+
+	t.Run("rejects responses without status", func(t *testing.T) {
+		_, err := LoadResponses(write(t, `[{"path": "/"}]`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rewrite replaces the path prefix From with To before the request
+// is forwarded to the local program
+type Rewrite struct {
+	From string
+	To   string
+}
+
+// ParseRewrite parses a rewrite rule of the form "<from>=<to>",
+// a trailing "*" on either side is ignored, so "/github/*=/api/webhooks/*"
+// and "/github/=/api/webhooks/" are the same rule
+func ParseRewrite(rule string) (Rewrite, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	if !ok {
+		return Rewrite{}, fmt.Errorf("rewrite rule %q is not of the form <from>=<to>", rule)
+	}
+	from = strings.TrimSuffix(from, "*")
+	to = strings.TrimSuffix(to, "*")
+	if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+		return Rewrite{}, fmt.Errorf("rewrite rule %q must map a path to a path", rule)
+	}
+	return Rewrite{From: from, To: to}, nil
+}
+
+// WithRewrites rewrites the path of the requests before they are
+// forwarded to the local program
+func WithRewrites(rules ...Rewrite) Option {
+	return func(c *Client) {
+		c.Rewrites = append(c.Rewrites, rules...)
+	}
+}
+
+// rewritePath applies the first rule matching the escaped path
+func rewritePath(rules []Rewrite, path string) string {
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.From) {
+			return rule.To + strings.TrimPrefix(path, rule.From)
+		}
+	}
+	return path
+}
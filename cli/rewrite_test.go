@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRewrite(t *testing.T) {
+	t.Run("parses rule with and without wildcard", func(t *testing.T) {
+		want := Rewrite{From: "/github/", To: "/api/webhooks/"}
+		got, err := ParseRewrite("/github/*=/api/webhooks/*")
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		got, err = ParseRewrite("/github/=/api/webhooks/")
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		for _, rule := range []string{"/github/", "github=/api", "/github=api"} {
+			_, err := ParseRewrite(rule)
+			assert.Error(t, err, rule)
+		}
+	})
+}
+
+func TestRewritePath(t *testing.T) {
+	rules := []Rewrite{
+		{From: "/github/", To: "/api/webhooks/"},
+		{From: "/", To: "/hooks/"},
+	}
+	assert.Equal(t, "/api/webhooks/push", rewritePath(rules, "/github/push"))
+	assert.Equal(t, "/hooks/stripe", rewritePath(rules, "/stripe"))
+	assert.Equal(t, "/stripe", rewritePath(nil, "/stripe"))
+}
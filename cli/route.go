@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Route forwards the requests matching all of its conditions to
+// its ports and targets, empty conditions match every request
+type Route struct {
+	// Method of the request, case insensitive
+	Method string `json:"method,omitempty"`
+	// Path is a glob pattern matched against the request path one
+	// segment at a time, using the syntax of path.Match. A * doesn't
+	// match a /, a ** segment matches any number of segments e.g.
+	// "/github/**" matches "/github/a/b"
+	Path string `json:"path,omitempty"`
+	// Headers maps header names to glob patterns of their values, a *
+	// matches any characters, / included
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body maps fields of the JSON body to glob patterns of their
+	// values like Headers, nested fields are separated by dots e.g.
+	// "repository.name"
+	Body  map[string]string `json:"body,omitempty"`
+	Ports []int             `json:"ports,omitempty"`
+	// Targets holds ports or target specs, see ParseTarget
+	Targets []Target `json:"targets,omitempty"`
+}
+
+// LoadRoutes reads the routing table from a JSON file holding a list
+// of routes
+func LoadRoutes(file string) ([]Route, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading routes file: %w", err)
+	}
+	var routes []Route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("parsing routes file: %w", err)
+	}
+	for i, r := range routes {
+		if len(r.Ports) == 0 && len(r.Targets) == 0 {
+			return nil, fmt.Errorf("route %d has no ports or targets", i)
+		}
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return nil, fmt.Errorf("route %d has invalid path pattern: %w", i, err)
+		}
+		for _, patterns := range []map[string]string{r.Headers, r.Body} {
+			for name, pattern := range patterns {
+				if _, err := globRegexp(pattern); err != nil {
+					return nil, fmt.Errorf("route %d has invalid pattern for %s: %w", i, name, err)
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+// WithRoutes forwards requests to the targets of the first matching
+// route instead of every target, requests matching no route are not
+// forwarded
+func WithRoutes(routes ...Route) Option {
+	return func(c *Client) {
+		c.Routes = append(c.Routes, routes...)
+	}
+}
+
+// Match reports if the request satisfies all the conditions of the route
+func (r Route) Match(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.Path != "" {
+		p := "/"
+		if req.URL != nil && req.URL.Path != "" {
+			p = req.URL.Path
+		}
+		if !pathMatch(r.Path, p) {
+			return false
+		}
+	}
+	for name, pattern := range r.Headers {
+		if !globMatch(pattern, req.Header.Get(name)) {
+			return false
+		}
+	}
+	if len(r.Body) == 0 {
+		return true
+	}
+	body := readJSONBody(req)
+	for field, pattern := range r.Body {
+		value, ok := jsonField(body, field)
+		if !ok || !globMatch(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeTargets returns the targets of the first route matching the
+// request, false if no route matches
+func routeTargets(routes []Route, req *http.Request) ([]Target, bool) {
+	for _, r := range routes {
+		if r.Match(req) {
+			return append(PortTargets(r.Ports...), r.Targets...), true
+		}
+	}
+	return nil, false
+}
+
+// globMatch matches the value against the glob pattern, unlike
+// path.Match a * matches / too
+func globMatch(pattern string, value string) bool {
+	re, err := globRegexp(pattern)
+	return err == nil && re.MatchString(value)
+}
+
+// globRegexp converts the glob pattern to a regexp, the pattern has the
+// syntax of path.Match
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return nil, path.ErrBadPattern
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			b.WriteByte('[')
+			i++
+			if i < len(pattern) && pattern[i] == '^' {
+				b.WriteByte('^')
+				i++
+			}
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+					if i == len(pattern) {
+						return nil, path.ErrBadPattern
+					}
+				} else if pattern[i] == '-' {
+					b.WriteByte('-')
+					continue
+				}
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+			if i == len(pattern) {
+				return nil, path.ErrBadPattern
+			}
+			b.WriteByte(']')
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
+}
+
+// pathMatch matches the path against the pattern segment by segment, a
+// ** segment of the pattern matches zero or more segments
+func pathMatch(pattern string, p string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(segments) + 1 {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// readJSONBody decodes the body of the request, leaving the body
+// readable for forwarding
+func readJSONBody(req *http.Request) map[string]any {
+	if req.Body == nil {
+		return nil
+	}
+	data, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewBuffer(data))
+	var body map[string]any
+	json.Unmarshal(data, &body)
+	return body
+}
+
+// jsonField looks up the dot separated field and returns its value
+// formatted as a string
+func jsonField(body map[string]any, field string) (string, bool) {
+	var value any = body
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		value, ok = obj[key]
+		if !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case map[string]any, []any:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"whtester/serialize"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteMatch(t *testing.T) {
+	newRequest := func(method string, target string, body string) *http.Request {
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		return req
+	}
+
+	withHeader := func(req *http.Request, name string, value string) *http.Request {
+		req.Header.Set(name, value)
+		return req
+	}
+
+	cases := []struct {
+		name  string
+		route Route
+		req   *http.Request
+		want  bool
+	}{
+		{"empty route matches everything", Route{}, newRequest("POST", "http://x/any", ""), true},
+		{"method is case insensitive", Route{Method: "post"}, newRequest("POST", "http://x/", ""), true},
+		{"different method", Route{Method: "GET"}, newRequest("POST", "http://x/", ""), false},
+		{"path glob", Route{Path: "/github/*"}, newRequest("POST", "http://x/github/push", ""), true},
+		{"path glob does not match", Route{Path: "/github/*"}, newRequest("POST", "http://x/stripe", ""), false},
+		{"path glob matches a single segment", Route{Path: "/github/*"}, newRequest("POST", "http://x/github/a/b", ""), false},
+		{"double star matches nested paths", Route{Path: "/github/**"}, newRequest("POST", "http://x/github/a/b", ""), true},
+		{"double star in the middle", Route{Path: "/**/push"}, newRequest("POST", "http://x/github/org/push", ""), true},
+		{"double star needs the rest of the pattern", Route{Path: "/**/push"}, newRequest("POST", "http://x/github/pull", ""), false},
+		{"header value", Route{Headers: map[string]string{"X-GitHub-Event": "pu*"}}, newRequest("POST", "http://x/", ""), true},
+		{"missing header", Route{Headers: map[string]string{"Stripe-Signature": "*?"}}, newRequest("POST", "http://x/", ""), false},
+		{"header star matches slashes", Route{Headers: map[string]string{"Content-Type": "application/*"}}, withHeader(newRequest("POST", "http://x/", ""), "Content-Type", "application/vnd.api+json"), true},
+		{"header class", Route{Headers: map[string]string{"X-GitHub-Event": "[^a-o]ush"}}, newRequest("POST", "http://x/", ""), true},
+		{"body star matches slashes", Route{Body: map[string]string{"url": "https://*"}}, newRequest("POST", "http://x/", `{"url":"https://example.com/a"}`), true},
+		{"json body field", Route{Body: map[string]string{"event_type": "invoice.paid"}}, newRequest("POST", "http://x/", `{"event_type":"invoice.paid"}`), true},
+		{"nested json body field", Route{Body: map[string]string{"data.id": "42"}}, newRequest("POST", "http://x/", `{"data":{"id":42}}`), true},
+		{"json body field differs", Route{Body: map[string]string{"event_type": "invoice.paid"}}, newRequest("POST", "http://x/", `{"event_type":"charge"}`), false},
+		{"body is not json", Route{Body: map[string]string{"event_type": "*"}}, newRequest("POST", "http://x/", `event_type=charge`), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, c.route.Match(c.req))
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		file := filepath.Join(t.TempDir(), "routes.json")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+
+	t.Run("loads routes from file", func(t *testing.T) {
+		file := write(t, `[{"path": "/github/*", "ports": [5555]}, {"body": {"type": "event_callback"}, "targets": [5556, "unix:/tmp/slack.sock"]}]`)
+		routes, err := LoadRoutes(file)
+		require.NoError(t, err)
+		socket, _ := ParseTarget("unix:/tmp/slack.sock")
+		want := []Route{
+			{Path: "/github/*", Ports: []int{5555}},
+			{Body: map[string]string{"type": "event_callback"}, Targets: []Target{PortTarget(5556), socket}},
+		}
+		assert.Equal(t, want, routes)
+	})
+
+	t.Run("route without targets is invalid", func(t *testing.T) {
+		_, err := LoadRoutes(write(t, `[{"path": "/github/*"}]`))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid path pattern", func(t *testing.T) {
+		_, err := LoadRoutes(write(t, `[{"path": "/[", "ports": [5555]}]`))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid header pattern", func(t *testing.T) {
+		_, err := LoadRoutes(write(t, `[{"headers": {"X-GitHub-Event": "[pu"}, "ports": [5555]}]`))
+		assert.Error(t, err)
+	})
+}
+
+func TestForwardRoutes(t *testing.T) {
+	newLocal := func(t *testing.T) (int, *int) {
+		count := 0
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count++
+		}))
+		t.Cleanup(local.Close)
+		u, _ := url.Parse(local.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return port, &count
+	}
+	github, githubCount := newLocal(t)
+	stripe, stripeCount := newLocal(t)
+	fallback, fallbackCount := newLocal(t)
+
+	c := &Client{httpClient: &http.Client{}}
+	WithRoutes(
+		Route{Path: "/github/*", Ports: []int{github}},
+		Route{Body: map[string]string{"type": "invoice.*"}, Targets: PortTargets(stripe)},
+	)(c)
+
+	send := func(target string, body string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		reqblob, _ := serialize.EncodeRequest(req)
+		return forwardRequestToTargets(c, reqblob, PortTargets(fallback))
+	}
+	send("http://x/github/push", `{"type":"invoice.paid"}`)
+	send("http://x/stripe", `{"type":"invoice.paid"}`)
+	// requests matching no route are not forwarded
+	resp, err := send("http://x/other", `{}`)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	assert.Equal(t, 1, *githubCount, "github handler")
+	assert.Equal(t, 1, *stripeCount, "stripe handler")
+	assert.Equal(t, 0, *fallbackCount, "default port")
+
+	// a route without conditions catches the other requests
+	WithRoutes(Route{Ports: []int{fallback}})(c)
+	_, err = send("http://x/other", `{}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, *fallbackCount, "catch all route")
+	assert.Equal(t, 1, *githubCount, "github handler")
+}
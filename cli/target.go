@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target is a program the requests are forwarded to
+type Target struct {
+	// URL is the base url of the program, the path of the
+	// request is appended to the path of the URL
+	URL *url.URL
+	// Socket is the path of the unix domain socket the program
+	// listens on, URL is not used to dial when it is set
+	Socket string
+	// Insecure skips the verification of the TLS certificate
+	Insecure bool
+	// Timeout limits the time taken by the program to respond,
+	// zero means no timeout
+	Timeout time.Duration
+}
+
+// PortTarget returns the target for a program listening on the port
+// of localhost
+func PortTarget(port int) Target {
+	return Target{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)}}
+}
+
+// PortTargets returns the targets for the ports of localhost
+func PortTargets(ports ...int) []Target {
+	var targets []Target
+	for _, port := range ports {
+		targets = append(targets, PortTarget(port))
+	}
+	return targets
+}
+
+// ParseTarget parses a target spec, which is one of
+//
+//	5555                      port on localhost
+//	http(s)://host:port/base  url of the program
+//	unix:/path/to.sock        unix domain socket of the program
+//
+// followed by comma separated options, "insecure" to skip TLS
+// verification and "timeout=<duration>" to limit the response time
+// e.g. "https://api:8443/hooks,insecure,timeout=5s"
+func ParseTarget(spec string) (Target, error) {
+	parts := strings.Split(spec, ",")
+	var t Target
+	addr := parts[0]
+	if port, err := strconv.Atoi(addr); err == nil {
+		t = PortTarget(port)
+	} else if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if socket == "" {
+			return Target{}, fmt.Errorf("target %q has no socket path", spec)
+		}
+		t = Target{URL: &url.URL{Scheme: "http", Host: "unix"}, Socket: socket}
+	} else {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return Target{}, fmt.Errorf("parsing target url: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Target{}, fmt.Errorf("target %q is not a port, http(s) url or unix socket", spec)
+		}
+		t = Target{URL: u}
+	}
+
+	for _, opt := range parts[1:] {
+		name, value, _ := strings.Cut(opt, "=")
+		switch name {
+		case "insecure":
+			t.Insecure = true
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return Target{}, fmt.Errorf("parsing target timeout: %w", err)
+			}
+			t.Timeout = timeout
+		default:
+			return Target{}, fmt.Errorf("target %q has unknown option %q", spec, opt)
+		}
+	}
+	return t, nil
+}
+
+// UnmarshalJSON reads the target from a port number or a target spec
+func (t *Target) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		*t = PortTarget(port)
+		return nil
+	}
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("target must be a port or a target spec: %w", err)
+	}
+	parsed, err := ParseTarget(spec)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func (t Target) String() string {
+	addr := t.URL.String()
+	if t.Socket != "" {
+		addr = "unix:" + t.Socket
+	}
+	if t.Insecure {
+		addr += ",insecure"
+	}
+	if t.Timeout != 0 {
+		addr += ",timeout=" + t.Timeout.String()
+	}
+	return addr
+}
+
+// requestURL returns the url the request with the escaped path and
+// query is sent to, escaped segments like %2F are kept
+func (t Target) requestURL(escapedPath string, rawQuery string) *url.URL {
+	u := *t.URL
+	u.RawPath = strings.TrimSuffix(t.URL.EscapedPath(), "/") + escapedPath
+	path, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		path = u.RawPath
+	}
+	u.Path = path
+	u.RawQuery = rawQuery
+	return &u
+}
+
+// httpClient returns the client to reach the target, targets without
+// options share the default client
+func (t Target) httpClient(defaultClient *http.Client) *http.Client {
+	if t.Socket == "" && !t.Insecure && t.Timeout == 0 {
+		return defaultClient
+	}
+	transport := &http.Transport{DisableKeepAlives: true}
+	if t.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if t.Socket != "" {
+		socket := t.Socket
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: t.Timeout}
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"whtester/serialize"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	t.Run("parses port, url and unix socket targets", func(t *testing.T) {
+		cases := map[string]string{
+			"5555":                           "http://localhost:5555",
+			"https://api:8443/hooks":         "https://api:8443/hooks",
+			"unix:/tmp/app.sock":             "unix:/tmp/app.sock",
+			"http://api,insecure,timeout=5s": "http://api,insecure,timeout=5s",
+		}
+		for spec, want := range cases {
+			got, err := ParseTarget(spec)
+			require.NoError(t, err, spec)
+			assert.Equal(t, want, got.String())
+		}
+	})
+
+	t.Run("rejects invalid targets", func(t *testing.T) {
+		specs := []string{"ftp://api", "localhost", "unix:", "http://api,timeout=abc", "http://api,fast"}
+		for _, spec := range specs {
+			_, err := ParseTarget(spec)
+			assert.Error(t, err, spec)
+		}
+	})
+}
+
+func TestForwardToTargets(t *testing.T) {
+	received := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.RequestURI()
+	})
+	c := &Client{httpClient: &http.Client{}}
+	forward := func(target Target) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, "http://tempurl/github?x=1", strings.NewReader("hello"))
+		reqblob, _ := serialize.EncodeRequest(req)
+		resp, _ := forwardRequestToTargets(c, reqblob, []Target{target})
+		select {
+		case uri := <-received:
+			return resp, uri
+		default:
+			return resp, ""
+		}
+	}
+
+	t.Run("appends the path to the base url", func(t *testing.T) {
+		local := httptest.NewServer(handler)
+		defer local.Close()
+		target, err := ParseTarget(local.URL + "/base/")
+		require.NoError(t, err)
+		_, uri := forward(target)
+		assert.Equal(t, "/base/github?x=1", uri)
+	})
+
+	t.Run("https with self signed certificate needs insecure", func(t *testing.T) {
+		local := httptest.NewTLSServer(handler)
+		defer local.Close()
+
+		target, _ := ParseTarget(local.URL)
+		resp, _ := forward(target)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		target, _ = ParseTarget(local.URL + ",insecure")
+		resp, uri := forward(target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/github?x=1", uri)
+	})
+
+	t.Run("forwards to unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "app.sock")
+		l, err := net.Listen("unix", socket)
+		require.NoError(t, err)
+		local := httptest.NewUnstartedServer(handler)
+		local.Listener = l
+		local.Start()
+		defer local.Close()
+
+		target, _ := ParseTarget("unix:" + socket)
+		resp, uri := forward(target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/github?x=1", uri)
+	})
+
+	t.Run("slow target times out", func(t *testing.T) {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer local.Close()
+
+		target, _ := ParseTarget(local.URL + ",timeout=50ms")
+		resp, _ := forward(target)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
@@ -1,24 +1,131 @@
 package cli
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
+	"whtester/protocol"
 	"whtester/serialize"
 
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	URL        string
-	Key        string
-	Conn       *websocket.Conn
+	URL  string
+	Key  string
+	Conn *websocket.Conn
+	// Session lets the client reclaim its url and password when
+	// it reconnects after losing the connection
+	Session string
+	// Relay sends the response of the local program back to the
+	// server, which writes it to the webhook sender
+	Relay bool
+	// Rewrites are applied to the path of the request before it
+	// is forwarded to the local program
+	Rewrites []Rewrite
+	// Routes select the targets a request is forwarded to
+	Routes []Route
+	// Methods are the http methods the server forwards to the group,
+	// nil keeps the methods allowed by the server
+	Methods []string
+	// Challenges asks the server to answer the verification requests
+	// of the providers, VerifyToken is checked against the verify
+	// token of Meta
+	Challenges  bool
+	VerifyToken string
+	// Responses are canned responses the server writes to the webhook
+	// senders, nil keeps the responses of the group
+	Responses []protocol.Response
+	// Name asks the server for a url with the name, NameToken is the
+	// ownership token the server issued when the name was reserved
+	Name      string
+	NameToken string
+	// APIToken is sent to servers which require an api token
+	APIToken string
+	// Role of the client in the group, observers only print the
+	// requests
+	Role       protocol.Role
 	httpClient *http.Client
+	serverURL  string
+	// joined clients connected to an existing group
+	joined bool
+	// invite is the code of the invite the client joins with
+	invite string
+	// writeMu serializes the control messages, which are sent by the
+	// stream and by the commands of the user
+	writeMu sync.Mutex
+}
+
+// Option configures the client before it connects to the server
+type Option func(*Client)
+
+// WithRelay makes the server wait for the response of the local
+// program instead of accepting the webhook right away
+func WithRelay() Option {
+	return func(c *Client) {
+		c.Relay = true
+	}
+}
+
+// WithMethods asks the server to only forward requests with the
+// methods, the methods are a setting of the group so they apply to
+// every client of the group
+func WithMethods(methods ...string) Option {
+	return func(c *Client) {
+		c.Methods = methods
+	}
+}
+
+// WithChallenges makes the server answer the verification requests of
+// Slack, Meta, WebSub, Twitch and Microsoft Graph, the verify token is
+// checked against the token sent by Meta unless it is empty
+func WithChallenges(verifyToken string) Option {
+	return func(c *Client) {
+		c.Challenges = true
+		c.VerifyToken = verifyToken
+	}
+}
+
+// WithName asks the server for a url with the name instead of a random
+// one, token is the ownership token of a name reserved before and is
+// empty when reserving a new name
+func WithName(name string, token string) Option {
+	return func(c *Client) {
+		c.Name = name
+		c.NameToken = token
+	}
+}
+
+// TokenEnv is the environment variable holding the api token
+const TokenEnv = "WHTESTER_TOKEN"
+
+// WithToken sends the api token to the server, for servers which only
+// accept clients with a token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.APIToken = token
+	}
+}
+
+// header returns the headers sent to the server on websocket upgrade
+func (c *Client) header() http.Header {
+	header := make(http.Header)
+	// the client acknowledges every request it handles
+	header.Set("ack", "true")
+	if c.Relay {
+		header.Set("relay", "true")
+	}
+	if c.APIToken != "" {
+		header.Set("Authorization", "Bearer "+c.APIToken)
+	}
+	return header
 }
 
 var AvailabeFields = map[string]struct{}{
@@ -27,65 +134,180 @@ var AvailabeFields = map[string]struct{}{
 	"Host": {}, "RemoteAddr": {}, "RequestURI": {},
 }
 
-func (c *Client) Stream(w io.Writer, fields []string, ports []int) {
+// Stream reads the messages from the server, reconnecting whenever the
+// connection is lost. It returns ErrRemoved once the server removed the
+// client from its group.
+func (c *Client) Stream(w io.Writer, fields []string, targets []Target) error {
 	for {
-		c.Read(w, fields, ports)
+		err := c.Read(w, fields, targets)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrRemoved) {
+			c.Conn.Close()
+			return err
+		}
+		fmt.Fprintf(w, "\nlost connection to server, %v, reconnecting", err)
+		c.Conn.Close()
+		if err := c.Reconnect(w); err != nil {
+			log.Fatalf("\nerror reconnecting to server, %v\n", err)
+		}
 	}
 }
 
-func (c *Client) Read(w io.Writer, fields []string, ports []int) {
+// Read reads a message from the server, it returns an error if the
+// connection to the server is lost
+func (c *Client) Read(w io.Writer, fields []string, targets []Target) error {
 	msgType, data, err := c.Conn.ReadMessage()
+	if websocket.IsCloseError(err, protocol.CloseRemoved) {
+		return fmt.Errorf("%w: %w", ErrRemoved, err)
+	}
 	if err != nil {
-		log.Fatalf("\nerror reading message from server, %v\n", err)
-		return
+		return fmt.Errorf("reading message from server: %w", err)
+	}
+	if msgType == websocket.TextMessage && c.speaksProtocol() {
+		return c.handleMessage(w, fields, targets, data)
 	}
 	if msgType == websocket.TextMessage {
+		// joined clients receive their session after connecting
+		if u, session, key, ok := parseHandshake(string(data)); ok && session != "" {
+			c.URL, c.Session = u, session
+			if key != "" {
+				c.Key = key
+			}
+		}
 		fmt.Fprint(w, "\n"+string(data))
 	} else if msgType == websocket.BinaryMessage {
 		// client recevied encoded HTTP POST request
-		// decode binary  blob into HTTP request struct
-		req := serialize.DecodeRequest(data)
-
-		// print the specified fields
-		fmt.Fprint(w, ReadRequestFields(fields, *req))
-
-		// forward request to locally running program
-		forwardRequestToPorts(c, data, ports)
+		c.handleRequest(w, fields, targets, "", data)
 	}
+	return nil
 }
 
-func forwardRequestToPorts(c *Client, reqblob []byte, ports []int) {
-	for _, port := range ports {
-		req := serialize.DecodeRequest(reqblob)
-		forwardRequest(c, req, port)
+// forwardRequestToTargets forwards the request to the targets of the
+// first matching route, or to all the targets without routes, and
+// returns the response of the first target, if no target responds a
+// bad gateway response is returned along with the error
+func forwardRequestToTargets(c *Client, reqblob []byte, targets []Target) (*http.Response, error) {
+	if len(c.Routes) > 0 {
+		req, err := serialize.DecodeRequest(reqblob)
+		if err != nil {
+			return &http.Response{StatusCode: http.StatusBadGateway}, err
+		}
+		var ok bool
+		if targets, ok = routeTargets(c.Routes, req); !ok {
+			return &http.Response{StatusCode: http.StatusBadGateway}, errors.New("no route matches the request")
+		}
 	}
+	var first *http.Response
+	var lastErr error
+	for _, target := range targets {
+		req, err := serialize.DecodeRequest(reqblob)
+		if err != nil {
+			return &http.Response{StatusCode: http.StatusBadGateway}, err
+		}
+		req.Header.Del(serialize.RequestIDHeader)
+		resp, err := forwardRequest(c, req, target)
+		if err != nil {
+			log.Printf("\ncli could not forwards message to %s, %v", target, err)
+			lastErr = err
+			continue
+		}
+		if first == nil {
+			first = resp
+		}
+	}
+	if first == nil {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no target to forward the request to")
+		}
+		return &http.Response{StatusCode: http.StatusBadGateway}, lastErr
+	}
+	return first, nil
 }
 
-func forwardRequest(c *Client, req *http.Request, port int) {
-	req.URL, _ = url.Parse(fmt.Sprintf("http://localhost:%d", port))
+// forwardRequest forwards the request to the target, keeping the path
+// and query the webhook was sent to, and returns the response with
+// its body read into memory
+func forwardRequest(c *Client, req *http.Request, target Target) (*http.Response, error) {
+	path := "/"
+	rawQuery := ""
+	if req.URL != nil {
+		path = req.URL.EscapedPath()
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		rawQuery = req.URL.RawQuery
+	}
+	req.URL = target.requestURL(rewritePath(c.Rewrites, path), rawQuery)
+	req.Host = req.URL.Host
 	req.RequestURI = ""
-	_, err := c.httpClient.Do(req)
+	// the body is in memory, so it is sent with its length rather
+	// than chunked, and bodiless requests are sent without a body
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(body))
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+	resp, err := target.httpClient(c.httpClient).Do(req)
 	if err != nil {
-		log.Fatalf("\ncli could not forwards message to local server, %v", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewBuffer(respBody))
+	return resp, nil
 }
 
-func Newclient(serverURL string) *Client {
+func Newclient(serverURL string, opts ...Option) *Client {
 	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
 	httpClient := &http.Client{}
 	c.httpClient = httpClient
-	c.Conn = NewConn(serverURL)
+	c.serverURL = serverURL
+	c.Conn = NewConn(serverURL, c.header())
+	if c.speaksProtocol() {
+		if err := c.sayHello(); err != nil {
+			log.Fatalf("error connecting to server, %v", err)
+		}
+		return c
+	}
+	if c.Methods != nil || c.Challenges || c.Responses != nil || c.Name != "" {
+		log.Printf("server doesn't support names and group settings, they are ignored")
+	}
 	readURLAndKey(c)
 	return c
 }
 
-func ConnToGroup(serverURL string, groupURL string, key string) *Client {
+func ConnToGroup(serverURL string, groupURL string, key string, opts ...Option) *Client {
 	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
 	httpClient := &http.Client{}
 	c.httpClient = httpClient
 	c.URL = groupURL
 	c.Key = key
-	c.Conn = NewConnGroup(serverURL, groupURL, key)
+	c.serverURL = serverURL
+	c.joined = true
+	c.Conn = NewConnGroup(serverURL, groupURL, key, c.header())
+	if c.speaksProtocol() {
+		if err := c.sayHello(); err != nil {
+			log.Fatalf("error joining group, %v", err)
+		}
+	} else if c.Methods != nil || c.Challenges || c.Responses != nil || c.Name != "" {
+		log.Printf("server doesn't support names and group settings, they are ignored")
+	}
 	return c
 }
 
@@ -120,9 +342,12 @@ func readURLAndKey(c *Client) {
 		if msgType != websocket.TextMessage {
 			log.Fatalf("expected to received URL from server, go message of type %d", msgType)
 		}
-		url := strings.Split(string(data), "\n")[0]
-		key := strings.Split(string(data), "password: ")[1]
+		url, session, key, ok := parseHandshake(string(data))
+		if !ok {
+			log.Fatalf("expected to received URL from server, got %q", string(data))
+		}
 		c.URL = url
+		c.Session = session
 		c.Key = key
 		done <- true
 	}()
@@ -130,30 +355,24 @@ func readURLAndKey(c *Client) {
 	select {
 	case <-done:
 		return
-	case <-time.After(5 * time.Second):
+	case <-time.After(HandshakeWaitTime):
 		log.Fatalf("took too long to read message from server")
 	}
 
 }
 
-func NewConnGroup(wsLink string, url string, key string) *websocket.Conn {
-	header := make(http.Header)
+func NewConnGroup(wsLink string, url string, key string, header http.Header) *websocket.Conn {
 	header.Set("url", url)
 	header.Set("key", key)
-	dailer := websocket.DefaultDialer
-	dailer.HandshakeTimeout = time.Minute
-	ws, _, err := dailer.Dial(wsLink, header)
+	ws, err := dial(wsLink, header)
 	if err != nil {
 		log.Fatalf("error establishing websocket connection: %v", err.Error())
 	}
 	return ws
 }
 
-func NewConn(wsLink string) *websocket.Conn {
-	websocket.DefaultDialer.HandshakeTimeout = time.Minute
-	dailer := websocket.DefaultDialer
-	dailer.HandshakeTimeout = time.Minute
-	ws, _, err := dailer.Dial(wsLink, nil)
+func NewConn(wsLink string, header http.Header) *websocket.Conn {
+	ws, err := dial(wsLink, header)
 	if err != nil {
 		log.Fatalf("error establishing websocket connection: %v", err.Error())
 	}
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 	"whtester/serialize"
 
 	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
 )
 
 const fakeServerBaseURL = ":8080"
@@ -70,7 +74,7 @@ func (s serverTestFake) WriteMessage(msg string) {
 func (s serverTestFake) WriteEncodedRequest(body string) {
 	b := bytes.NewBuffer([]byte(body))
 	req, _ := http.NewRequest(http.MethodPost, "tempurl", b)
-	msg := serialize.EncodeRequest(req)
+	msg, _ := serialize.EncodeLegacyRequest(req)
 	s.ws.WriteMessage(websocket.BinaryMessage, msg)
 }
 
@@ -131,7 +135,7 @@ func TestWhCLI(t *testing.T) {
 		defer c.Conn.Close()
 		want := "this is a temp message"
 		s.WriteMessage(want)
-		c.Read(buf, nil, []int{5555})
+		c.Read(buf, nil, PortTargets(5555))
 		if buf.String() == "" {
 			t.Error("expected a message to be writtem")
 		}
@@ -146,7 +150,7 @@ func TestWhCLI(t *testing.T) {
 
 		msg := "message sent"
 		s.WriteMessage(msg)
-		c.Read(buf, nil, []int{5555})
+		c.Read(buf, nil, PortTargets(5555))
 		want := "\n" + msg
 		if buf.String() != want {
 			t.Errorf("got %q, want %q", buf.String(), want)
@@ -168,7 +172,7 @@ func TestWhCLI(t *testing.T) {
 		s.WriteEncodedRequest("this is a test")
 		fields := []string{"Body", "Method", "URL", "Header"}
 
-		c.Read(buf, fields, []int{5555})
+		c.Read(buf, fields, PortTargets(5555))
 		got := buf.String()
 		for _, field := range fields {
 			if !strings.Contains(got, field) {
@@ -191,7 +195,7 @@ func TestWhCLI(t *testing.T) {
 		s.WriteEncodedRequest("this is a test")
 
 		buf := new(bytes.Buffer)
-		c.Read(buf, []string{"Body"}, []int{5555})
+		c.Read(buf, []string{"Body"}, PortTargets(5555))
 
 		// check if the local server received the message
 		if lsrv.received == false {
@@ -232,9 +236,9 @@ func TestForwardMultiplePorts(t *testing.T) {
 	// wait for some time to get the server started
 	time.Sleep(time.Millisecond)
 
-	ports := []int{5556, 5557}
-	reqblob := serialize.EncodeRequest(req)
-	forwardRequestToPorts(c, reqblob, ports)
+	targets := PortTargets(5556, 5557)
+	reqblob, _ := serialize.EncodeRequest(req)
+	forwardRequestToTargets(c, reqblob, targets)
 	if !lsrv1.received {
 		t.Errorf("local server 1 didn't receive message")
 	}
@@ -243,6 +247,162 @@ func TestForwardMultiplePorts(t *testing.T) {
 	}
 }
 
+func TestRelayResponse(t *testing.T) {
+	// local program which answers every request
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(serialize.RequestIDHeader) != "" {
+			t.Errorf("request id header is forwarded to local program")
+		}
+		w.Header().Set("X-Local", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer local.Close()
+	localURL, _ := url.Parse(local.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	// server which sends a request and waits for the response
+	relayed := make(chan []byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, _ := upgrader.Upgrade(w, r, nil)
+		defer ws.Close()
+		if r.Header.Get("relay") != "true" {
+			t.Errorf("client didn't ask for relay")
+		}
+		ws.WriteMessage(websocket.TextMessage, []byte("tempURL\npassword: tempPassword"))
+		req, _ := http.NewRequest(http.MethodPost, "tempurl", strings.NewReader("hello"))
+		req.Header.Set(serialize.RequestIDHeader, "1234")
+		msg, _ := serialize.EncodeLegacyRequest(req)
+		ws.WriteMessage(websocket.BinaryMessage, msg)
+		_, data, _ := ws.ReadMessage()
+		relayed <- data
+	}))
+	defer srv.Close()
+
+	c := Newclient("ws"+strings.TrimPrefix(srv.URL, "http"), WithRelay())
+	defer c.Conn.Close()
+	c.Read(new(bytes.Buffer), nil, PortTargets(port))
+
+	select {
+	case data := <-relayed:
+		id, resp, err := serialize.DecodeResponse(data)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "1234", id)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "yes", resp.Header.Get("X-Local"))
+		assert.Equal(t, "created", string(body))
+	case <-time.After(time.Second):
+		t.Fatal("client didn't relay the response")
+	}
+}
+
+func TestAcknowledgeRequest(t *testing.T) {
+	acks := make(chan []byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, _ := upgrader.Upgrade(w, r, nil)
+		defer ws.Close()
+		if r.Header.Get("ack") != "true" {
+			t.Errorf("client didn't ask to acknowledge requests")
+		}
+		ws.WriteMessage(websocket.TextMessage, []byte("tempURL\npassword: tempPassword"))
+		req, _ := http.NewRequest(http.MethodPost, "tempurl", strings.NewReader("hello"))
+		req.Header.Set(serialize.RequestIDHeader, "1234")
+		msg, _ := serialize.EncodeLegacyRequest(req)
+		ws.WriteMessage(websocket.BinaryMessage, msg)
+		_, data, _ := ws.ReadMessage()
+		acks <- data
+	}))
+	defer srv.Close()
+
+	c := Newclient("ws" + strings.TrimPrefix(srv.URL, "http"))
+	defer c.Conn.Close()
+	// no target is running, so forwarding fails
+	c.Read(new(bytes.Buffer), nil, nil)
+
+	select {
+	case data := <-acks:
+		id, errMsg, ok := serialize.DecodeAck(data)
+		assert.True(t, ok)
+		assert.Equal(t, "1234", id)
+		assert.NotEmpty(t, errMsg)
+	case <-time.After(time.Second):
+		t.Fatal("client didn't acknowledge the request")
+	}
+}
+
+func TestForwardRequestPath(t *testing.T) {
+	received := make(chan string, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.RequestURI()
+	}))
+	defer local.Close()
+	localURL, _ := url.Parse(local.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	forward := func(c *Client, target string) string {
+		req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader("hello"))
+		reqblob, _ := serialize.EncodeRequest(req)
+		forwardRequestToTargets(c, reqblob, PortTargets(port))
+		return <-received
+	}
+
+	t.Run("keeps the path and query of the webhook", func(t *testing.T) {
+		c := &Client{httpClient: &http.Client{}}
+		assert.Equal(t, "/hooks/github?x=1", forward(c, "http://tempurl/hooks/github?x=1"))
+	})
+
+	t.Run("keeps the escaped segments of the path", func(t *testing.T) {
+		c := &Client{httpClient: &http.Client{}}
+		assert.Equal(t, "/files/a%2Fb", forward(c, "http://tempurl/files/a%2Fb"))
+		WithRewrites(Rewrite{From: "/files/", To: "/api/files/"})(c)
+		assert.Equal(t, "/api/files/a%2Fb", forward(c, "http://tempurl/files/a%2Fb"))
+	})
+
+	t.Run("rewrites the path prefix", func(t *testing.T) {
+		c := &Client{httpClient: &http.Client{}}
+		WithRewrites(Rewrite{From: "/github/", To: "/api/webhooks/"})(c)
+		assert.Equal(t, "/api/webhooks/push?x=1", forward(c, "http://tempurl/github/push?x=1"))
+	})
+}
+
+func TestForwardRequestMethods(t *testing.T) {
+	type received struct {
+		method        string
+		contentLength int64
+		chunked       bool
+	}
+	requests := make(chan received, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- received{r.Method, r.ContentLength, len(r.TransferEncoding) > 0}
+	}))
+	defer local.Close()
+	localURL, _ := url.Parse(local.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	c := &Client{httpClient: &http.Client{}}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodPut} {
+		req, _ := http.NewRequest(method, "http://tempurl/hook", nil)
+		reqblob, _ := serialize.EncodeRequest(req)
+		resp, err := forwardRequestToTargets(c, reqblob, PortTargets(port))
+		if !assert.NoError(t, err, method) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, method)
+		assert.Equal(t, received{method, 0, false}, <-requests)
+	}
+
+	// chunked webhooks are sent with their length
+	req, _ := http.NewRequest(http.MethodPatch, "http://tempurl/hook", strings.NewReader("hello"))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	reqblob, _ := serialize.EncodeRequest(req)
+	forwardRequestToTargets(c, reqblob, PortTargets(port))
+	assert.Equal(t, received{http.MethodPatch, 5, false}, <-requests)
+}
+
 func BenchmarkReadRequest(b *testing.B) {
 	// create a new http request
 	body := bytes.NewBuffer([]byte("arbitary body for http request"))
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"whtester/server"
+)
+
+const (
+	// serverEnv and tokenEnv hold the defaults of the -server and
+	// -token flags
+	serverEnv = "WHTESTER_ADMIN_URL"
+	tokenEnv  = "WHTESTER_ADMIN_TOKEN"
+)
+
+// tailInterval is how often tail asks the server for new requests
+var tailInterval = time.Second
+
+const usage = `usage: whadmin [-server url] [-token token] [-json] <command> [args]
+
+commands:
+  stats                       totals of the server
+  groups                      list the links
+  group <id>                  show a link and its clients
+  delete-group <id>           delete a link and disconnect its clients
+  rotate-password <id>        give a link a new password
+  tail [-method m] <id>       print the requests of a link as they arrive
+  clients                     list the connected clients
+  kick <client id>            disconnect a client and revoke its session
+  tokens                      list the api tokens
+  create-token [-scopes create,join] [-max-groups n] [-max-clients n] <name>
+                              create an api token, it is printed once
+  delete-token <name>         delete an api token
+  reservations                list the reserved names
+  release <name>              release a reserved name
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// adminClient calls the admin api of a server
+type adminClient struct {
+	server     string
+	token      string
+	httpClient *http.Client
+}
+
+// call sends the request to the admin api and decodes the JSON response
+// into v, unless v is nil. Responses which are not a success are errors.
+func (a adminClient) call(ctx context.Context, method string, path string, body any, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encoding request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.server, "/")+"/admin/api"+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling admin api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s, %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// printer writes the results as tables, or as JSON for scripts
+type printer struct {
+	out  io.Writer
+	json bool
+}
+
+// print writes v as JSON, or calls table with a tab separated writer
+func (p printer) print(v any, table func(w io.Writer)) error {
+	if p.json {
+		enc := json.NewEncoder(p.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// run runs the command of the arguments
+func run(ctx context.Context, cmdArgs []string, out io.Writer) error {
+	args := flag.NewFlagSet("whadmin", flag.ContinueOnError)
+	args.SetOutput(out)
+	args.Usage = func() { fmt.Fprint(out, usage) }
+	serverURL := os.Getenv(serverEnv)
+	if serverURL == "" {
+		serverURL = "http://127.0.0.1:9090"
+	}
+	a := adminClient{httpClient: &http.Client{Timeout: 30 * time.Second}}
+	var p printer
+	args.StringVar(&a.server, "server", serverURL, "url of the admin api listener, read from "+serverEnv+" by default")
+	args.StringVar(&a.token, "token", os.Getenv(tokenEnv), "api token with the admin scope, read from "+tokenEnv+" by default")
+	args.BoolVar(&p.json, "json", false, "print JSON instead of tables")
+	if err := args.Parse(cmdArgs); err != nil {
+		return err
+	}
+	p.out = out
+	if args.NArg() == 0 {
+		args.Usage()
+		return fmt.Errorf("expected a command")
+	}
+	command, rest := args.Arg(0), args.Args()[1:]
+	if a.token == "" {
+		return fmt.Errorf("expected an admin token, with -token or %s", tokenEnv)
+	}
+
+	// arg returns the only argument of the command
+	arg := func(name string) (string, error) {
+		if len(rest) != 1 {
+			return "", fmt.Errorf("%s expects the %s", command, name)
+		}
+		return url.PathEscape(rest[0]), nil
+	}
+
+	switch command {
+	case "stats":
+		var stats server.AdminStats
+		if err := a.call(ctx, http.MethodGet, "/stats", nil, &stats); err != nil {
+			return err
+		}
+		return p.print(stats, func(w io.Writer) {
+			fmt.Fprintf(w, "started\t%s\n", formatTime(stats.StartedAt))
+			fmt.Fprintf(w, "links\t%d\n", stats.Groups)
+			fmt.Fprintf(w, "clients\t%d\n", stats.Clients)
+			fmt.Fprintf(w, "queued requests\t%d\n", stats.Queued)
+			fmt.Fprintf(w, "reserved names\t%d\n", stats.Reservations)
+			fmt.Fprintf(w, "requests since start\t%d\n", stats.Requests)
+			fmt.Fprintf(w, "clients since start\t%d\n", stats.ClientsTotal)
+			fmt.Fprintf(w, "links since start\t%d\n", stats.GroupsTotal)
+		})
+
+	case "groups":
+		var groups []server.AdminGroup
+		if err := a.call(ctx, http.MethodGet, "/groups", nil, &groups); err != nil {
+			return err
+		}
+		return p.print(groups, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tURL\tCLIENTS\tQUEUED\tREQUESTS\tOWNER\tCREATED")
+			for _, g := range groups {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", g.ID, g.URL, g.Clients, g.Queued, g.Requests, g.Owner, formatTime(g.CreatedAt))
+			}
+		})
+
+	case "group":
+		id, err := arg("id of the link")
+		if err != nil {
+			return err
+		}
+		var group server.AdminGroup
+		if err := a.call(ctx, http.MethodGet, "/groups/"+id, nil, &group); err != nil {
+			return err
+		}
+		return p.print(group, func(w io.Writer) {
+			fmt.Fprintf(w, "url\t%s\n", group.URL)
+			fmt.Fprintf(w, "created\t%s\n", formatTime(group.CreatedAt))
+			fmt.Fprintf(w, "owner\t%s\n", group.Owner)
+			fmt.Fprintf(w, "queued requests\t%d\n", group.Queued)
+			fmt.Fprintf(w, "requests\t%d\n\n", group.Requests)
+			printClients(w, group.Members)
+		})
+
+	case "delete-group":
+		id, err := arg("id of the link")
+		if err != nil {
+			return err
+		}
+		if err := a.call(ctx, http.MethodDelete, "/groups/"+id, nil, nil); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"deleted": rest[0]}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted link %s\n", rest[0])
+		})
+
+	case "rotate-password":
+		id, err := arg("id of the link")
+		if err != nil {
+			return err
+		}
+		var rotated map[string]string
+		if err := a.call(ctx, http.MethodPost, "/groups/"+id+"/password", nil, &rotated); err != nil {
+			return err
+		}
+		return p.print(rotated, func(w io.Writer) {
+			fmt.Fprintf(w, "link\t%s\npassword\t%s\n", rotated["url"], rotated["password"])
+		})
+
+	case "tail":
+		return tail(ctx, a, p, rest)
+
+	case "clients":
+		var clients []server.AdminClient
+		if err := a.call(ctx, http.MethodGet, "/clients", nil, &clients); err != nil {
+			return err
+		}
+		return p.print(clients, func(w io.Writer) {
+			printClients(w, clients)
+		})
+
+	case "kick":
+		id, err := arg("id of the client")
+		if err != nil {
+			return err
+		}
+		if err := a.call(ctx, http.MethodDelete, "/clients/"+id, nil, nil); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"kicked": rest[0]}, func(w io.Writer) {
+			fmt.Fprintf(w, "kicked client %s\n", rest[0])
+		})
+
+	case "tokens":
+		var tokens []server.AdminToken
+		if err := a.call(ctx, http.MethodGet, "/tokens", nil, &tokens); err != nil {
+			return err
+		}
+		return p.print(tokens, func(w io.Writer) {
+			fmt.Fprintln(w, "NAME\tSCOPES\tLINKS\tMAX LINKS\tCLIENTS\tMAX CLIENTS")
+			for _, t := range tokens {
+				var scopes []string
+				for _, scope := range t.Scopes {
+					scopes = append(scopes, string(scope))
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n", t.Name, strings.Join(scopes, ","), t.Groups, limit(t.MaxGroups), t.Clients, limit(t.MaxClients))
+			}
+		})
+
+	case "create-token":
+		return createToken(ctx, a, p, rest)
+
+	case "delete-token":
+		name, err := arg("name of the token")
+		if err != nil {
+			return err
+		}
+		if err := a.call(ctx, http.MethodDelete, "/tokens/"+name, nil, nil); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"deleted": rest[0]}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted token %s\n", rest[0])
+		})
+
+	case "reservations":
+		var reservations []server.AdminReservation
+		if err := a.call(ctx, http.MethodGet, "/reservations", nil, &reservations); err != nil {
+			return err
+		}
+		return p.print(reservations, func(w io.Writer) {
+			fmt.Fprintln(w, "NAME\tLIVE\tCREATED")
+			for _, r := range reservations {
+				fmt.Fprintf(w, "%s\t%t\t%s\n", r.Name, r.Live, formatTime(r.CreatedAt))
+			}
+		})
+
+	case "release":
+		name, err := arg("reserved name")
+		if err != nil {
+			return err
+		}
+		if err := a.call(ctx, http.MethodDelete, "/reservations/"+name, nil, nil); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"released": rest[0]}, func(w io.Writer) {
+			fmt.Fprintf(w, "released name %s\n", rest[0])
+		})
+
+	default:
+		args.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// limit formats the limit of a token, zero is no limit
+func limit(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func printClients(w io.Writer, clients []server.AdminClient) {
+	fmt.Fprintln(w, "ID\tLINK\tROLE\tREMOTE\tCONNECTED\tDELIVERED\tACKED\tFAILED")
+	for _, c := range clients {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", c.ID, c.Group, c.Role, c.RemoteAddr, formatTime(c.ConnectedAt), c.Delivered, c.Acked, c.Failed)
+	}
+}
+
+// createToken creates an api token, the server generates the token
+func createToken(ctx context.Context, a adminClient, p printer, cmdArgs []string) error {
+	args := flag.NewFlagSet("create-token", flag.ContinueOnError)
+	args.SetOutput(p.out)
+	scopes := args.String("scopes", "create,join", "comma separated scopes of the token, create, join or admin")
+	maxGroups := args.Int("max-groups", 0, "links created with the token at the same time, no limit when zero")
+	maxClients := args.Int("max-clients", 0, "clients connected with the token at the same time, no limit when zero")
+	if err := args.Parse(cmdArgs); err != nil {
+		return err
+	}
+	if args.NArg() != 1 {
+		return fmt.Errorf("create-token expects the name of the token")
+	}
+	token := server.APIToken{Name: args.Arg(0), MaxGroups: *maxGroups, MaxClients: *maxClients}
+	for _, scope := range strings.Split(*scopes, ",") {
+		token.Scopes = append(token.Scopes, server.Scope(strings.TrimSpace(scope)))
+	}
+	var created map[string]string
+	if err := a.call(ctx, http.MethodPost, "/tokens", token, &created); err != nil {
+		return err
+	}
+	return p.print(created, func(w io.Writer) {
+		fmt.Fprintf(w, "token %s: %s\nit is only shown once\n", created["name"], created["token"])
+	})
+}
+
+// tail prints the requests of a link as they arrive, until the context
+// is done. JSON output is one request per line.
+func tail(ctx context.Context, a adminClient, p printer, cmdArgs []string) error {
+	args := flag.NewFlagSet("tail", flag.ContinueOnError)
+	args.SetOutput(p.out)
+	method := args.String("method", "", "only print the requests with the method")
+	if err := args.Parse(cmdArgs); err != nil {
+		return err
+	}
+	if args.NArg() != 1 {
+		return fmt.Errorf("tail expects the id of the link")
+	}
+	id := url.PathEscape(args.Arg(0))
+	query := func(after uint64, limit int) ([]server.HistoryEntry, error) {
+		q := url.Values{"after": {strconv.FormatUint(after, 10)}}
+		if limit > 0 {
+			q.Set("limit", strconv.Itoa(limit))
+		}
+		var entries []server.HistoryEntry
+		err := a.call(ctx, http.MethodGet, "/groups/"+id+"/requests?"+q.Encode(), nil, &entries)
+		return entries, err
+	}
+	// the requests received before tail started are skipped, the
+	// history is paged by the sequence number of the requests as their
+	// receive time may not be in the order they were added
+	var after uint64
+	latest, err := query(after, 1)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(latest) > 0 {
+		after = latest[0].Seq
+	}
+	for {
+		// the method is filtered here, so that the gaps left by the
+		// requests dropped from the history are seen
+		entries, err := query(after, 0)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 && entries[0].Seq > after+1 {
+			log.Printf("%d requests were dropped from the history before tail read them", entries[0].Seq-after-1)
+		}
+		for _, e := range entries {
+			after = e.Seq
+			if *method != "" && !strings.EqualFold(e.Method, *method) {
+				continue
+			}
+			if p.json {
+				data, _ := json.Marshal(e)
+				fmt.Fprintln(p.out, string(data))
+				continue
+			}
+			fmt.Fprintf(p.out, "%s %s %s %d bytes from %s\n", e.ReceivedAt.Local().Format(time.TimeOnly), e.Method, e.Path, e.Size, e.RemoteAddr)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailInterval):
+		}
+	}
+}
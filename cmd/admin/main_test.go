@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"whtester/server"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer starts a server along with its admin api, the admin
+// token is "admin"
+func newTestServer(t *testing.T) (*server.Manager, *httptest.Server, *httptest.Server) {
+	manager := server.NewManager()
+	manager.AddTokens(server.APIToken{Name: "admin", Token: "admin", Scopes: []server.Scope{server.ScopeAdmin}})
+	srv := httptest.NewServer(server.NewWebHookHandler(manager, "localhost"))
+	t.Cleanup(srv.Close)
+	admin := httptest.NewServer(server.NewAdminHandler(manager))
+	t.Cleanup(admin.Close)
+	return manager, srv, admin
+}
+
+// connectClient connects a legacy client and returns the url of its link
+func connectClient(t *testing.T, srv *httptest.Server) string {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+	_, msg, err := ws.ReadMessage()
+	require.NoError(t, err)
+	return strings.Split(string(msg), "\n")[0]
+}
+
+// whadmin runs the command against the admin api and returns its output
+func whadmin(t *testing.T, admin *httptest.Server, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(context.Background(), append([]string{"-server", admin.URL, "-token", "admin"}, args...), &out)
+	return out.String(), err
+}
+
+func TestWhadmin(t *testing.T) {
+	t.Run("admin token is required", func(t *testing.T) {
+		_, _, admin := newTestServer(t)
+		t.Setenv(tokenEnv, "")
+		err := run(context.Background(), []string{"-server", admin.URL, "stats"}, &bytes.Buffer{})
+		assert.ErrorContains(t, err, "admin token")
+
+		err = run(context.Background(), []string{"-server", admin.URL, "-token", "wrong", "stats"}, &bytes.Buffer{})
+		assert.ErrorContains(t, err, "401")
+	})
+
+	t.Run("groups and clients are printed as tables or JSON", func(t *testing.T) {
+		_, srv, admin := newTestServer(t)
+		u := connectClient(t, srv)
+
+		out, err := whadmin(t, admin, "stats")
+		require.NoError(t, err)
+		assert.Contains(t, out, "links                 1")
+
+		out, err = whadmin(t, admin, "-json", "groups")
+		require.NoError(t, err)
+		var groups []server.AdminGroup
+		require.NoError(t, json.Unmarshal([]byte(out), &groups))
+		require.Len(t, groups, 1)
+		assert.Equal(t, u, groups[0].URL)
+
+		out, err = whadmin(t, admin, "group", groups[0].ID)
+		require.NoError(t, err)
+		assert.Contains(t, out, u)
+		assert.Contains(t, out, "DELIVERED")
+
+		out, err = whadmin(t, admin, "-json", "clients")
+		require.NoError(t, err)
+		var clients []server.AdminClient
+		require.NoError(t, json.Unmarshal([]byte(out), &clients))
+		require.Len(t, clients, 1)
+
+		out, err = whadmin(t, admin, "kick", clients[0].ID)
+		require.NoError(t, err)
+		assert.Contains(t, out, "kicked client")
+		_, err = whadmin(t, admin, "group", "unknown")
+		assert.ErrorContains(t, err, "404")
+	})
+
+	t.Run("tail prints the requests of a link", func(t *testing.T) {
+		tailInterval = 10 * time.Millisecond
+		t.Cleanup(func() { tailInterval = time.Second })
+		_, srv, admin := newTestServer(t)
+		u := connectClient(t, srv)
+		out, err := whadmin(t, admin, "-json", "groups")
+		require.NoError(t, err)
+		var groups []server.AdminGroup
+		require.NoError(t, json.Unmarshal([]byte(out), &groups))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var buf syncBuffer
+		done := make(chan error)
+		go func() {
+			done <- run(ctx, []string{"-server", admin.URL, "-token", "admin", "tail", groups[0].ID}, &buf)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, srv.URL+parsed.RequestURI()+"orders", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Host = parsed.Host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Eventually(t, func() bool {
+			return strings.Contains(buf.String(), "POST /orders ")
+		}, 2*time.Second, 10*time.Millisecond)
+		cancel()
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("tail follows the order of the history", func(t *testing.T) {
+		tailInterval = 10 * time.Millisecond
+		t.Cleanup(func() { tailInterval = time.Second })
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		t.Cleanup(func() { log.SetOutput(os.Stderr) })
+		start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		var mu sync.Mutex
+		entries := []server.HistoryEntry{{Seq: 1, Method: http.MethodPost, Path: "/old", ReceivedAt: start}}
+		admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			res := []server.HistoryEntry{}
+			after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+			for _, e := range entries {
+				if e.Seq > after {
+					res = append(res, e)
+				}
+			}
+			if r.URL.Query().Get("limit") == "1" {
+				res = res[len(res)-1:]
+			}
+			json.NewEncoder(w).Encode(res)
+		}))
+		defer admin.Close()
+		add := func(e server.HistoryEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, e)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var buf syncBuffer
+		done := make(chan error)
+		go func() {
+			done <- run(ctx, []string{"-server", admin.URL, "-token", "admin", "tail", "group"}, &buf)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		add(server.HistoryEntry{Seq: 2, Method: http.MethodPost, Path: "/late", ReceivedAt: start.Add(2 * time.Second)})
+		assert.Eventually(t, func() bool {
+			return strings.Contains(buf.String(), "POST /late ")
+		}, 2*time.Second, 10*time.Millisecond)
+		// the request received first is added to the history last
+		add(server.HistoryEntry{Seq: 3, Method: http.MethodPost, Path: "/early", ReceivedAt: start.Add(time.Second)})
+		assert.Eventually(t, func() bool {
+			return strings.Contains(buf.String(), "POST /early ")
+		}, 2*time.Second, 10*time.Millisecond)
+		// the fourth request was dropped from the history
+		add(server.HistoryEntry{Seq: 5, Method: http.MethodPost, Path: "/new", ReceivedAt: start.Add(3 * time.Second)})
+		assert.Eventually(t, func() bool {
+			return strings.Contains(buf.String(), "POST /new ")
+		}, 2*time.Second, 10*time.Millisecond)
+		cancel()
+		assert.NoError(t, <-done)
+		assert.NotContains(t, buf.String(), "/old")
+		assert.Contains(t, logs.String(), "1 requests were dropped from the history")
+	})
+
+	t.Run("tokens are created, listed and deleted", func(t *testing.T) {
+		_, _, admin := newTestServer(t)
+		out, err := whadmin(t, admin, "-json", "create-token", "-scopes", "create", "-max-groups", "2", "ci")
+		require.NoError(t, err)
+		var created map[string]string
+		require.NoError(t, json.Unmarshal([]byte(out), &created))
+		assert.Equal(t, "ci", created["name"])
+		assert.NotEmpty(t, created["token"])
+
+		out, err = whadmin(t, admin, "tokens")
+		require.NoError(t, err)
+		assert.Regexp(t, `ci\s+create\s+0\s+2\s+0\s+-`, out)
+		assert.NotContains(t, out, created["token"])
+
+		_, err = whadmin(t, admin, "delete-token", "ci")
+		require.NoError(t, err)
+		out, err = whadmin(t, admin, "tokens")
+		require.NoError(t, err)
+		assert.NotContains(t, out, "ci ")
+		_, err = whadmin(t, admin, "delete-token", "ci")
+		assert.ErrorContains(t, err, "404")
+	})
+
+	t.Run("reserved names are listed and released", func(t *testing.T) {
+		_, _, admin := newTestServer(t)
+		out, err := whadmin(t, admin, "reservations")
+		require.NoError(t, err)
+		assert.Equal(t, "NAME  LIVE  CREATED\n", out)
+		_, err = whadmin(t, admin, "release", "billing")
+		assert.ErrorContains(t, err, "404")
+	})
+
+	t.Run("unknown commands are refused", func(t *testing.T) {
+		_, _, admin := newTestServer(t)
+		_, err := whadmin(t, admin, "frobnicate")
+		assert.ErrorContains(t, err, "unknown command")
+		_, err = whadmin(t, admin, "group")
+		assert.ErrorContains(t, err, "expects the id")
+	})
+}
+
+// syncBuffer is a buffer tail can write to while the test reads it
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
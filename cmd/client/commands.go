@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"whtester/protocol"
+)
+
+// inviter manages the invites of the group of the client
+type inviter interface {
+	CreateInvite(role protocol.Role, expiresIn string, maxUses int) error
+	ListInvites() error
+	RevokeInvite(id string) error
+}
+
+const commandsHelp = `commands:
+  invite [-role forwarder|observer] [-expires 24h] [-uses 1]  create an invite to the link
+  invites                                                    list the outstanding invites
+  revoke <id>                                                revoke an invite`
+
+// readCommands runs the commands typed by the user until the input ends
+func readCommands(r io.Reader, w io.Writer, c inviter) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := runCommand(c, scanner.Text()); err != nil {
+			fmt.Fprintf(w, "\n%v", err)
+		}
+	}
+}
+
+// runCommand runs a command typed by the user, the server answers are
+// printed by the stream of the client
+func runCommand(c inviter, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "invite":
+		args := flag.NewFlagSet("invite", flag.ContinueOnError)
+		args.SetOutput(io.Discard)
+		role := args.String("role", "", "role of the members joining with the invite, forwarder or observer")
+		expires := args.String("expires", "", "how long the invite lasts, e.g. 1h")
+		uses := args.Int("uses", 0, "how many clients can join with the invite")
+		if err := args.Parse(fields[1:]); err != nil {
+			return fmt.Errorf("%w\n%s", err, commandsHelp)
+		}
+		return c.CreateInvite(protocol.Role(*role), *expires, *uses)
+	case "invites":
+		return c.ListInvites()
+	case "revoke":
+		if len(fields) != 2 {
+			return fmt.Errorf("expected the id of the invite to revoke\n%s", commandsHelp)
+		}
+		return c.RevokeInvite(fields[1])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", fields[0], commandsHelp)
+	}
+}
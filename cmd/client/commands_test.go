@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"whtester/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type inviterFake struct {
+	calls []string
+}
+
+func (f *inviterFake) CreateInvite(role protocol.Role, expiresIn string, maxUses int) error {
+	f.calls = append(f.calls, fmt.Sprintf("invite %s %s %d", role, expiresIn, maxUses))
+	return nil
+}
+
+func (f *inviterFake) ListInvites() error {
+	f.calls = append(f.calls, "invites")
+	return nil
+}
+
+func (f *inviterFake) RevokeInvite(id string) error {
+	f.calls = append(f.calls, "revoke "+id)
+	return nil
+}
+
+func TestRunCommand(t *testing.T) {
+	t.Run("commands manage the invites", func(t *testing.T) {
+		c := &inviterFake{}
+		for _, line := range []string{"invite -role observer -expires 1h -uses 3", "invites", "  ", "revoke abcd1234"} {
+			assert.NoError(t, runCommand(c, line), line)
+		}
+		assert.Equal(t, []string{"invite observer 1h 3", "invites", "revoke abcd1234"}, c.calls)
+	})
+
+	t.Run("invalid commands are refused", func(t *testing.T) {
+		c := &inviterFake{}
+		for _, line := range []string{"delete", "revoke", "invite -uses many"} {
+			assert.Error(t, runCommand(c, line), line)
+		}
+		assert.Empty(t, c.calls)
+	})
+}
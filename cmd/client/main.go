@@ -7,8 +7,10 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"whtester/cli"
+	"whtester/protocol"
 )
 
 // ports to handle slice of ports as input
@@ -28,6 +30,40 @@ func (p *ports) Set(value string) error {
 	return nil
 }
 
+// targets to handle slice of target specs as input
+type targets []cli.Target
+
+func (t *targets) String() string {
+	return fmt.Sprintf("%v", *t)
+}
+
+func (t *targets) Set(value string) error {
+	target, err := cli.ParseTarget(value)
+	if err != nil {
+		return fmt.Errorf("parsing target: %w", err)
+	}
+
+	*t = append(*t, target)
+	return nil
+}
+
+// rewrites to handle slice of path rewrite rules as input
+type rewrites []cli.Rewrite
+
+func (r *rewrites) String() string {
+	return fmt.Sprintf("%v", *r)
+}
+
+func (r *rewrites) Set(value string) error {
+	rule, err := cli.ParseRewrite(value)
+	if err != nil {
+		return fmt.Errorf("parsing rewrite rule: %w", err)
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
 var (
 	defaultFields = []string{"Method", "Header", "Body"}
 	serverLink    = "wss://new.whlink.webhooktester.tech/ws"
@@ -40,29 +76,76 @@ func main() {
 	if err != nil {
 		log.Fatalf("handling cmd args : %s", err)
 	}
-	var ports []int
-	for _, port := range config.ports {
-		ports = append(ports, int(port))
+	targets := cli.PortTargets(config.ports...)
+	targets = append(targets, config.targets...)
+
+	var opts []cli.Option
+	if config.relay {
+		opts = append(opts, cli.WithRelay())
+	}
+	if len(config.rewrites) > 0 {
+		opts = append(opts, cli.WithRewrites(config.rewrites...))
+	}
+	if len(config.routes) > 0 {
+		opts = append(opts, cli.WithRoutes(config.routes...))
+	}
+	if config.methods != nil {
+		opts = append(opts, cli.WithMethods(config.methods...))
+	}
+	if config.challenges {
+		opts = append(opts, cli.WithChallenges(config.verifyToken))
+	}
+	if config.responses != nil {
+		opts = append(opts, cli.WithResponses(config.responses...))
+	}
+	if config.name != "" {
+		opts = append(opts, cli.WithName(config.name, config.nameToken))
+	}
+	if config.token != "" {
+		opts = append(opts, cli.WithToken(config.token))
 	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	var c *cli.Client
-	if config.connect {
+	if config.invite != "" {
+		server, code, err := cli.ParseInvite(config.invite, serverLink)
+		if err != nil {
+			log.Fatalf("joining with invite : %s", err)
+		}
+		c = cli.JoinInvite(server, code, opts...)
+	} else if config.connect {
 		var url string
 		var key string
 		fmt.Print("\nenter webhook link:")
 		fmt.Scan(&url)
 		fmt.Println("enter webhook password:")
 		fmt.Scan(&key)
-		c = cli.ConnToGroup(joinGroupLink, url, key)
+		c = cli.ConnToGroup(joinGroupLink, url, key, opts...)
 	} else {
-		c = cli.Newclient(serverLink)
+		c = cli.Newclient(serverLink, opts...)
 	}
 	fmt.Printf("\nlink: %s", c.URL)
-	fmt.Printf("\npassword: %s", c.Key)
+	if c.Key != "" {
+		fmt.Printf("\npassword: %s", c.Key)
+	} else if config.invite == "" {
+		fmt.Printf("\npassword: unknown, the server only keeps its hash, ask a member of the link")
+	}
+	if c.Role == protocol.RoleObserver {
+		fmt.Printf("\nrole: observer, requests are printed but not forwarded")
+	}
+	if c.NameToken != "" && c.NameToken != config.nameToken {
+		fmt.Printf("\nname token: %s\nrun with -name %s -name-token %s to get this link again", c.NameToken, config.name, c.NameToken)
+	}
 	defer c.Conn.Close()
-	go c.Stream(os.Stdout, config.fields, ports)
+	// the client stops once it is kicked or its link is deleted
+	go func() {
+		defer wg.Done()
+		if err := c.Stream(os.Stdout, config.fields, targets); err != nil {
+			fmt.Printf("\n%v\n", err)
+		}
+	}()
+	go readCommands(os.Stdin, os.Stdout, c)
 
 	wg.Wait()
 }
@@ -97,26 +180,87 @@ func handleFieldArgs(fields []string) ([]string, error) {
 }
 
 type Config struct {
-	ports   ports
-	fields  []string
-	connect bool
+	ports    ports
+	targets  targets
+	fields   []string
+	connect  bool
+	relay    bool
+	rewrites rewrites
+	routes   []cli.Route
+	// methods forwarded to the group, nil keeps the methods
+	// allowed by the server
+	methods []string
+	// challenges makes the server answer the verification requests
+	// of the providers
+	challenges  bool
+	verifyToken string
+	// responses are written by the server to the webhook senders
+	responses []protocol.Response
+	// name of the url asked for, nameToken is the ownership token
+	// of the name
+	name      string
+	nameToken string
+	// token is the api token sent to servers which require one
+	token string
+	// invite joins the group of the invite, given as "join <invite>"
+	invite string
 }
 
 func handleCmdArgs(cmdArgs []string) (*Config, error) {
 	var conf Config
+	if len(cmdArgs) > 0 && cmdArgs[0] == "join" {
+		if len(cmdArgs) < 2 {
+			return nil, fmt.Errorf("expected invite after join")
+		}
+		conf.invite = cmdArgs[1]
+		cmdArgs = cmdArgs[2:]
+	}
 	args := flag.NewFlagSet("args", flag.ExitOnError)
 	args.Var(&conf.ports, "p", "the port on which your webhook program is running")
+	args.Var(&conf.targets, "t", "url or unix socket of your webhook program, of the form http(s)://host:port/base or unix:/path/to.sock, followed by ,insecure or ,timeout=<duration> options")
 	args.BoolVar(&conf.connect, "c", false, "connect to client group")
+	args.BoolVar(&conf.relay, "relay", false, "send the response of your webhook program back to the webhook sender")
+	args.Var(&conf.rewrites, "rewrite", "rewrite the path prefix of forwarded requests, of the form /from/*=/to/*")
+	routesFile := args.String("routes", "", "JSON file with the routes selecting the targets a request is forwarded to")
+	responsesFile := args.String("responses", "", "JSON file with the canned responses the server writes to the webhook senders")
+	args.Func("methods", "comma separated http methods the server forwards to the group, * forwards every method", func(value string) error {
+		conf.methods = []string{}
+		if value == "*" {
+			return nil
+		}
+		for _, method := range strings.Split(value, ",") {
+			conf.methods = append(conf.methods, strings.ToUpper(strings.TrimSpace(method)))
+		}
+		return nil
+	})
+	args.BoolVar(&conf.challenges, "challenges", false, "let the server answer the url verification requests of Slack, Meta, WebSub, Twitch and Microsoft Graph")
+	args.StringVar(&conf.verifyToken, "verify-token", "", "verify token of Meta subscriptions, checked when answering challenges")
+	args.StringVar(&conf.name, "name", "", "ask for a link with this name instead of a random one, e.g. team-payments")
+	args.StringVar(&conf.nameToken, "name-token", "", "ownership token printed when the name was reserved, needed to get the name again")
+	args.StringVar(&conf.token, "token", os.Getenv(cli.TokenEnv), "api token for servers which require one, read from "+cli.TokenEnv+" by default")
 	err := args.Parse(cmdArgs)
 	if err != nil {
 		return nil, fmt.Errorf("parsing args : %w", err)
 	}
+	if *routesFile != "" {
+		conf.routes, err = cli.LoadRoutes(*routesFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading routes : %w", err)
+		}
+	}
+	if *responsesFile != "" {
+		conf.responses, err = cli.LoadResponses(*responsesFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading responses : %w", err)
+		}
+	}
 	conf.fields, err = handleFieldArgs(args.Args())
 	if err != nil {
 		return nil, fmt.Errorf("handling fields : %w", err)
 	}
-	if len(conf.ports) == 0 {
-		return nil, fmt.Errorf("expected port number")
+	// invites can be for observers, which don't forward requests
+	if len(conf.ports) == 0 && len(conf.targets) == 0 && len(conf.routes) == 0 && conf.invite == "" {
+		return nil, fmt.Errorf("expected port number or target")
 	}
 
 	return &conf, nil
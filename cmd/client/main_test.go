@@ -1,7 +1,11 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"whtester/cli"
+	"whtester/protocol"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -18,15 +22,111 @@ func TestHandleCmdArgs(t *testing.T) {
 		assert.Equal(t, gotPorts, want, "invalid port config")
 	})
 
+	t.Run("targets are configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-t", "https://api:8443/hooks,insecure", "-t", "unix:/tmp/app.sock"})
+		require.NoError(t, err, "handling cmd args")
+		var specs []string
+		for _, target := range got.targets {
+			specs = append(specs, target.String())
+		}
+		assert.Equal(t, []string{"https://api:8443/hooks,insecure", "unix:/tmp/app.sock"}, specs)
+	})
+
 	t.Run("fields are configurable", func(t *testing.T) {
 		got, err := handleCmdArgs([]string{"-p", "8080", "Method", "Body"})
 		require.NoError(t, err, "handling cmd args")
 		want := []string{"Method", "Body"}
 		assert.ElementsMatch(t, got.fields, want)
 	})
+
+	t.Run("relay is configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8080", "-relay"})
+		require.NoError(t, err, "handling cmd args")
+		assert.True(t, got.relay)
+	})
+
+	t.Run("rewrite rules are configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8080", "-rewrite", "/github/*=/api/webhooks/*", "-rewrite", "/stripe/=/pay/"})
+		require.NoError(t, err, "handling cmd args")
+		want := rewrites{
+			{From: "/github/", To: "/api/webhooks/"},
+			{From: "/stripe/", To: "/pay/"},
+		}
+		assert.Equal(t, want, got.rewrites)
+	})
+
+	t.Run("routes are read from file, ports are optional with routes", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "routes.json")
+		err := os.WriteFile(file, []byte(`[{"method": "POST", "path": "/github/*", "ports": [5555]}]`), 0o600)
+		require.NoError(t, err)
+
+		got, err := handleCmdArgs([]string{"-routes", file})
+		require.NoError(t, err, "handling cmd args")
+		want := []cli.Route{{Method: "POST", Path: "/github/*", Ports: []int{5555}}}
+		assert.Equal(t, want, got.routes)
+	})
+
+	t.Run("forwarded methods are configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8080", "-methods", "get,post"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, []string{"GET", "POST"}, got.methods)
+
+		got, err = handleCmdArgs([]string{"-p", "8080", "-methods", "*"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, []string{}, got.methods)
+
+		got, err = handleCmdArgs([]string{"-p", "8080"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Nil(t, got.methods)
+	})
+
+	t.Run("canned responses are read from file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "responses.json")
+		err := os.WriteFile(file, []byte(`[{"path": "/github/*", "status": 500, "delay": "2s"}]`), 0o600)
+		require.NoError(t, err)
+
+		got, err := handleCmdArgs([]string{"-p", "8080", "-responses", file})
+		require.NoError(t, err, "handling cmd args")
+		want := []protocol.Response{{Path: "/github/*", Status: 500, Delay: "2s"}}
+		assert.Equal(t, want, got.responses)
+	})
+
+	t.Run("api token is read from the flag or the environment", func(t *testing.T) {
+		t.Setenv(cli.TokenEnv, "from-env")
+		got, err := handleCmdArgs([]string{"-p", "8080"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, "from-env", got.token)
+
+		got, err = handleCmdArgs([]string{"-p", "8080", "-token", "from-flag"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, "from-flag", got.token)
+	})
+
+	t.Run("join takes an invite, ports are optional", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"join", "wss://whlink.example.com/ws?invite=abcd1234.secret", "Method"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, "wss://whlink.example.com/ws?invite=abcd1234.secret", got.invite)
+		assert.Equal(t, []string{"Method"}, got.fields)
+		_, err = handleCmdArgs([]string{"join"})
+		assert.Error(t, err)
+	})
+
+	t.Run("name and its token are configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8080", "-name", "team-payments", "-name-token", "secret"})
+		require.NoError(t, err, "handling cmd args")
+		assert.Equal(t, "team-payments", got.name)
+		assert.Equal(t, "secret", got.nameToken)
+	})
+
+	t.Run("challenges are answered by the server", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8080", "-challenges", "-verify-token", "secret"})
+		require.NoError(t, err, "handling cmd args")
+		assert.True(t, got.challenges)
+		assert.Equal(t, "secret", got.verifyToken)
+	})
 }
 
-func ExampleFields() {
+func Example_handleFieldArgs() {
 	handleFieldArgs([]string{"test"})
 	// output:
 	// does not contain filed  test
@@ -8,19 +8,69 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 	"whtester/server"
 )
 
+// adminTokenEnv is the environment variable holding the admin token
+const adminTokenEnv = "WHTESTER_ADMIN_TOKEN"
+
 type serverConfig struct {
 	port   int
 	domain string
+	grace  time.Duration
+	// noClientStatus is written to webhook senders when the
+	// url has no clients
+	noClientStatus int
+	queueSize      int
+	queueAge       time.Duration
+	// methods forwarded to new groups, every method when empty
+	methods []string
+	// challenges makes new groups answer the verification
+	// requests of the providers
+	challenges bool
+	// pathURLs generates urls of the form <scheme>://<domain>/h/<id>
+	// for deployments without wildcard DNS
+	pathURLs bool
+	scheme   string
+	// blocklist holds names clients can't ask for
+	blocklist []string
+	// store is the directory keeping the groups and reservations
+	// across restarts, storeHistory keeps the request history too
+	store        string
+	storeHistory bool
+	// tokens is the file with the api tokens, requireToken refuses
+	// clients without a valid token
+	tokens       string
+	requireToken bool
+	// ids generates the ids of new urls
+	ids server.IDGenerator
+	// adminAddr is the address of the listener of the admin api, the
+	// admin api is off when empty, adminToken is an api token with the
+	// admin scope in addition to the ones of the tokens file
+	adminAddr  string
+	adminToken string
+	// metricsAddr is the address of the listener of /metrics, metrics
+	// are off when empty, they share the listener of the admin api
+	// when both have the same address
+	metricsAddr string
+	// drainTimeout is how long the webhook requests in flight get to
+	// be delivered on shutdown, reconnectURL is where the clients are
+	// told to reconnect
+	drainTimeout time.Duration
+	reconnectURL string
+	// writeQueueSize bounds the messages waiting for a client,
+	// writeQueueOverflow is what happens when they don't fit
+	writeQueueSize     int
+	writeQueueOverflow server.OverflowPolicy
 }
 
 func main() {
 	conf, err := handleCmdArgs(os.Args[1:])
 	if err != nil {
-		log.Fatalf("invalid parameter count")
+		log.Fatalf("invalid parameters, %v", err)
 	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -30,6 +80,42 @@ func main() {
 	port := conf.port
 
 	clientsManager := server.NewManager()
+	clientsManager.GracePeriod = conf.grace
+	clientsManager.NoClientStatus = conf.noClientStatus
+	clientsManager.QueueSize = conf.queueSize
+	clientsManager.QueueMaxAge = conf.queueAge
+	clientsManager.AllowedMethods = conf.methods
+	clientsManager.Challenges = conf.challenges
+	clientsManager.PathMode = conf.pathURLs
+	clientsManager.Scheme = conf.scheme
+	clientsManager.ReconnectURL = conf.reconnectURL
+	clientsManager.WriteQueueSize = conf.writeQueueSize
+	clientsManager.WriteQueueOverflow = conf.writeQueueOverflow
+	clientsManager.IDs = conf.ids
+	log.Printf("new urls get ids with %.0f bits of entropy", conf.ids.Entropy())
+	clientsManager.Blocklist = append(clientsManager.Blocklist, conf.blocklist...)
+	clientsManager.StoreHistory = conf.storeHistory
+	var store server.Store = server.NewMemoryStore()
+	if conf.store != "" {
+		store, err = server.OpenFileStore(conf.store)
+		if err != nil {
+			log.Fatalf("opening store: %v", err)
+		}
+	}
+	if err := clientsManager.Restore(store); err != nil {
+		log.Fatalf("restoring state: %v", err)
+	}
+	clientsManager.RequireToken = conf.requireToken || conf.tokens != ""
+	if conf.tokens != "" {
+		tokens, err := server.LoadTokens(conf.tokens)
+		if err != nil {
+			log.Fatalf("loading tokens: %v", err)
+		}
+		clientsManager.AddTokens(tokens...)
+	}
+	if conf.adminToken != "" {
+		clientsManager.AddTokens(server.APIToken{Name: "admin", Token: conf.adminToken, Scopes: []server.Scope{server.ScopeAdmin}})
+	}
 	mux := server.NewWebHookHandler(clientsManager, domain)
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -41,13 +127,60 @@ func main() {
 		srv.ListenAndServe()
 	}()
 
+	// the admin api has its own listener, so that it can be kept
+	// off the public network
+	var adminSrv, metricsSrv *http.Server
+	if conf.adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/", server.NewAdminHandler(clientsManager))
+		if conf.metricsAddr == conf.adminAddr {
+			adminMux.Handle("/metrics", server.NewMetricsHandler(clientsManager))
+		}
+		adminSrv = &http.Server{
+			Addr:    conf.adminAddr,
+			Handler: adminMux,
+		}
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("admin api stopped: %v", err)
+			}
+		}()
+	}
+	if conf.metricsAddr != "" && conf.metricsAddr != conf.adminAddr {
+		metricsSrv = &http.Server{
+			Addr:    conf.metricsAddr,
+			Handler: server.NewMetricsHandler(clientsManager),
+		}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("metrics stopped: %v", err)
+			}
+		}()
+	}
+
 	// gracefull shutdown server
 	go func() {
 		sig := <-sigs
 		fmt.Println()
 		fmt.Println("Shutting Down Server")
 		fmt.Println(sig)
-		srv.Shutdown(context.Background())
+		// readiness fails and the clients are sent away before the
+		// listeners close, the http server doesn't wait for websockets
+		ctx, cancel := context.WithTimeout(context.Background(), conf.drainTimeout)
+		defer cancel()
+		if err := clientsManager.Drain(ctx); err != nil {
+			log.Printf("draining: %v", err)
+		}
+		srv.Shutdown(ctx)
+		if adminSrv != nil {
+			adminSrv.Shutdown(context.Background())
+		}
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(context.Background())
+		}
+		if err := store.Close(); err != nil {
+			log.Printf("closing store: %v", err)
+		}
 		done <- true
 	}()
 
@@ -64,6 +197,51 @@ func handleCmdArgs(cmdArgs []string) (*serverConfig, error) {
 	args := flag.NewFlagSet("args", flag.ContinueOnError)
 	args.IntVar(&conf.port, "p", 8080, "port on which the server should run")
 	args.StringVar(&conf.domain, "d", "localhost:8080", "domain which the server should use to generate client Urls")
+	args.DurationVar(&conf.grace, "grace", 2*time.Minute, "how long the url of disconnected clients is kept for them to reconnect")
+	args.IntVar(&conf.noClientStatus, "no-client-status", http.StatusServiceUnavailable, "status sent to webhook senders when the url has no clients")
+	args.IntVar(&conf.queueSize, "queue-size", 100, "number of requests queued for an url while its clients are away")
+	args.DurationVar(&conf.queueAge, "queue-age", 10*time.Minute, "how long queued requests are kept for the clients of an url")
+	methods := args.String("methods", "*", "comma separated http methods forwarded to new urls, * forwards every method")
+	args.BoolVar(&conf.challenges, "challenges", false, "answer the url verification requests of Slack, Meta, WebSub, Twitch and Microsoft Graph for every url")
+	args.BoolVar(&conf.pathURLs, "path-urls", false, "generate urls of the form <scheme>://<domain>/h/<id> instead of <scheme>://<id>.<domain>, for deployments without wildcard DNS")
+	args.StringVar(&conf.scheme, "scheme", "http", "scheme of the generated urls, https when the server is behind a TLS proxy")
+	args.StringVar(&conf.store, "store", "", "directory keeping the urls, passwords and reserved names across restarts, everything is kept in memory when empty")
+	args.BoolVar(&conf.storeHistory, "store-history", false, "keep the request history in the store too")
+	args.StringVar(&conf.tokens, "tokens", "", "JSON file with the api tokens clients need to connect, clients need no token when empty")
+	args.BoolVar(&conf.requireToken, "require-token", false, "refuse clients without an api token, the tokens are taken from the store and -tokens")
+	args.Func("blocklist", "comma separated names clients can't ask for, in addition to the built in ones", func(value string) error {
+		for _, name := range strings.Split(value, ",") {
+			conf.blocklist = append(conf.blocklist, strings.ToLower(strings.TrimSpace(name)))
+		}
+		return nil
+	})
+	args.StringVar(&conf.adminAddr, "admin-addr", "", "address of the admin api listener, e.g. 127.0.0.1:9090, the admin api is off when empty")
+	args.StringVar(&conf.adminToken, "admin-token", os.Getenv(adminTokenEnv), "api token with the admin scope, read from "+adminTokenEnv+" by default")
+	args.DurationVar(&conf.drainTimeout, "drain-timeout", 30*time.Second, "how long the webhook requests in flight get to be delivered on shutdown")
+	args.StringVar(&conf.reconnectURL, "reconnect-url", "", "websocket url clients are told to reconnect to on shutdown, e.g. wss://hooks2.example.com/ws, the same server when empty")
+	args.StringVar(&conf.metricsAddr, "metrics-addr", "", "address of the listener of /metrics, e.g. 127.0.0.1:9100, metrics are off when empty, it can be the address of the admin api")
+	args.IntVar(&conf.writeQueueSize, "write-queue-size", server.WriteQueueSize, "messages waiting to be written to a client before the overflow policy applies")
+	overflow := args.String("write-queue-overflow", string(server.OverflowDisconnect), "what happens to the messages for a client with a full write queue, drop-oldest, disconnect the client or reject the webhook with 503")
+	idKind := args.String("id-kind", "random", "kind of the ids of new urls, random, uuid, ulid or words")
+	idLength := args.Int("id-length", 0, "characters of random ids or words of words ids, 8 characters or 4 words by default")
 	args.Parse(cmdArgs)
+	// WriteHeader panics on statuses outside of 100-999
+	if conf.noClientStatus < 100 || conf.noClientStatus > 999 {
+		return nil, fmt.Errorf("invalid no client status %d, expected a status between 100 and 999", conf.noClientStatus)
+	}
+	var err error
+	conf.methods, err = server.ParseMethods(*methods)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := server.NewIDGenerator(*idKind, *idLength)
+	if err != nil {
+		return nil, err
+	}
+	conf.ids = ids
+	conf.writeQueueOverflow, err = server.ParseOverflowPolicy(*overflow)
+	if err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
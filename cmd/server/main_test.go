@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"testing"
 	"time"
+	"whtester/server"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -19,6 +20,131 @@ func TestServerCmdArgs(t *testing.T) {
 		assert.Equal(t, 8888, got.port)
 		assert.Equal(t, "test", got.domain)
 	})
+
+	t.Run("grace period is configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-grace", "5m"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, 5*time.Minute, got.grace)
+	})
+
+	t.Run("queue and no client status are configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-no-client-status", "404", "-queue-size", "5", "-queue-age", "1m"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, 404, got.noClientStatus)
+		assert.Equal(t, 5, got.queueSize)
+		assert.Equal(t, time.Minute, got.queueAge)
+
+		for _, status := range []string{"0", "99", "1000", "-1"} {
+			_, err := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-no-client-status", status})
+			assert.ErrorContains(t, err, "invalid no client status", status)
+		}
+	})
+
+	t.Run("forwarded methods are configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-methods", "post, get"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, []string{"POST", "GET"}, got.methods)
+
+		got, err := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-methods", "*"})
+		require.NoError(t, err)
+		assert.Empty(t, got.methods)
+
+		_, err = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-methods", "POST,,GET"})
+		assert.ErrorContains(t, err, "invalid method")
+	})
+
+	t.Run("path urls and scheme are configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "hooks.example.com", "-path-urls", "-scheme", "https"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.True(t, got.pathURLs)
+		assert.Equal(t, "https", got.scheme)
+
+		got, _ = handleCmdArgs([]string{"-p", "8888", "-d", "test"})
+		assert.False(t, got.pathURLs)
+		assert.Equal(t, "http", got.scheme)
+	})
+
+	t.Run("blocklist is configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-blocklist", "billing, Payments"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, []string{"billing", "payments"}, got.blocklist)
+	})
+
+	t.Run("api tokens are configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-tokens", "tokens.json", "-require-token"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, "tokens.json", got.tokens)
+		assert.True(t, got.requireToken)
+	})
+
+	t.Run("admin api is configurable", func(t *testing.T) {
+		t.Setenv(adminTokenEnv, "from-env")
+		got, _ := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-admin-addr", "127.0.0.1:9090"})
+		assert.Equal(t, "127.0.0.1:9090", got.adminAddr)
+		assert.Equal(t, "from-env", got.adminToken)
+
+		got, _ = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-admin-token", "secret"})
+		assert.Empty(t, got.adminAddr)
+		assert.Equal(t, "secret", got.adminToken)
+	})
+
+	t.Run("draining is configurable", func(t *testing.T) {
+		got, _ := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-drain-timeout", "5s", "-reconnect-url", "wss://hooks2.example.com/ws"})
+		assert.Equal(t, 5*time.Second, got.drainTimeout)
+		assert.Equal(t, "wss://hooks2.example.com/ws", got.reconnectURL)
+		got, _ = handleCmdArgs([]string{"-p", "8888", "-d", "test"})
+		assert.Equal(t, 30*time.Second, got.drainTimeout)
+		assert.Empty(t, got.reconnectURL)
+	})
+
+	t.Run("write queue is configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-write-queue-size", "16", "-write-queue-overflow", "reject"})
+		require.NoError(t, err)
+		assert.Equal(t, 16, got.writeQueueSize)
+		assert.Equal(t, server.OverflowReject, got.writeQueueOverflow)
+
+		got, _ = handleCmdArgs([]string{"-p", "8888", "-d", "test"})
+		assert.Equal(t, server.WriteQueueSize, got.writeQueueSize)
+		assert.Equal(t, server.OverflowDisconnect, got.writeQueueOverflow)
+
+		_, err = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-write-queue-overflow", "block"})
+		assert.Error(t, err)
+	})
+
+	t.Run("metrics listener is configurable", func(t *testing.T) {
+		got, _ := handleCmdArgs([]string{"-p", "8888", "-d", "test", "-metrics-addr", "127.0.0.1:9100"})
+		assert.Equal(t, "127.0.0.1:9100", got.metricsAddr)
+		got, _ = handleCmdArgs([]string{"-p", "8888", "-d", "test"})
+		assert.Empty(t, got.metricsAddr)
+	})
+
+	t.Run("store is configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-store", "/var/lib/whtester", "-store-history"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.Equal(t, "/var/lib/whtester", got.store)
+		assert.True(t, got.storeHistory)
+	})
+
+	t.Run("id generator is configurable", func(t *testing.T) {
+		got, err := handleCmdArgs([]string{"-p", "8888", "-d", "test"})
+		require.NoError(t, err)
+		assert.Equal(t, server.RandomIDs{Length: 8}, got.ids)
+
+		got, err = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-id-kind", "words", "-id-length", "3"})
+		require.NoError(t, err)
+		assert.Equal(t, server.WordIDs{Words: 3}, got.ids)
+
+		_, err = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-id-kind", "random", "-id-length", "2"})
+		assert.Error(t, err)
+		_, err = handleCmdArgs([]string{"-p", "8888", "-d", "test", "-id-kind", "serial"})
+		assert.Error(t, err)
+	})
+
+	t.Run("challenges are configurable", func(t *testing.T) {
+		argsStub := []string{"-p", "8888", "-d", "test", "-challenges"}
+		got, _ := handleCmdArgs(argsStub)
+		assert.True(t, got.challenges)
+	})
 }
 
 func TestServer(t *testing.T) {
@@ -0,0 +1,294 @@
+// Package protocol defines the control messages exchanged between the
+// server and the clients over the websocket connection.
+//
+// Clients which negotiate the Subprotocol during the websocket upgrade
+// exchange JSON encoded Messages in text frames. The first message of
+// the client is a hello, which the server answers with a welcome or an
+// error. Clients which don't negotiate the Subprotocol use the legacy
+// format, where the url and password are sent as a text frame and the
+// requests as binary frames.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Version is the version of the protocol
+	Version = 1
+	// Subprotocol is negotiated with the Sec-WebSocket-Protocol header
+	Subprotocol = "whtester.v1"
+	// CloseRemoved is the close code of the connection of a client
+	// which was kicked or whose group was deleted, the client must not
+	// reconnect
+	CloseRemoved = 4000
+)
+
+// Type identifies the kind of a message
+type Type string
+
+const (
+	// TypeHello is sent by the client to create, join or resume a group
+	TypeHello Type = "hello"
+	// TypeWelcome is sent by the server once the client is in a group
+	TypeWelcome Type = "welcome"
+	// TypeRequest carries a webhook request to the client
+	TypeRequest Type = "request"
+	// TypeAck is sent by the client once it handled a request
+	TypeAck Type = "ack"
+	// TypeError is sent by the server when it refuses a message
+	TypeError Type = "error"
+	// TypeMemberJoined tells the clients of a group that a new
+	// client joined the group
+	TypeMemberJoined Type = "member-joined"
+	// TypeSettings carries the settings of the group
+	TypeSettings Type = "settings"
+	// TypeGoodbye is sent before closing the connection
+	TypeGoodbye Type = "goodbye"
+	// TypeInvite is sent by a client to create an invite to its group,
+	// the server answers with the invite and its code
+	TypeInvite Type = "invite"
+	// TypeInvites is sent by a client to list the outstanding invites
+	// of its group, the server answers with the list
+	TypeInvites Type = "invites"
+	// TypeRevokeInvite is sent by a client to revoke an invite, the
+	// server answers with the outstanding invites
+	TypeRevokeInvite Type = "revoke-invite"
+)
+
+// Role is what a member of a group does with the requests
+type Role string
+
+const (
+	// RoleForwarder members forward the requests to their local
+	// program, acknowledge them and change the settings of the group
+	RoleForwarder Role = "forwarder"
+	// RoleObserver members only receive a copy of the requests
+	RoleObserver Role = "observer"
+)
+
+// Message is the envelope of every control message, only the field
+// matching the type of the message is set
+type Message struct {
+	Version  int         `json:"version"`
+	Type     Type        `json:"type"`
+	Hello    *Hello      `json:"hello,omitempty"`
+	Welcome  *Welcome    `json:"welcome,omitempty"`
+	Request  *Request    `json:"request,omitempty"`
+	Ack      *Ack        `json:"ack,omitempty"`
+	Error    *Error      `json:"error,omitempty"`
+	Member   *Member     `json:"member,omitempty"`
+	Settings *Settings   `json:"settings,omitempty"`
+	Goodbye  *Goodbye    `json:"goodbye,omitempty"`
+	Invite   *Invite     `json:"invite,omitempty"`
+	Invites  *InviteList `json:"invites,omitempty"`
+	Revoke   *Revoke     `json:"revoke,omitempty"`
+}
+
+// Hello creates a new group, or joins the group of URL when URL and
+// Key are set, or resumes the session of a client which lost its
+// connection when Session is set
+type Hello struct {
+	URL     string `json:"url,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Session string `json:"session,omitempty"`
+	// Relay asks the server to wait for the response of the
+	// local program and write it to the webhook sender
+	Relay bool `json:"relay,omitempty"`
+	// Name asks for a url with the name instead of a random one, Token
+	// is the ownership token of a name reserved by the client before
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Invite is the code of an invite, it joins the group of the
+	// invite without URL and Key
+	Invite string `json:"invite,omitempty"`
+}
+
+// Welcome tells the client the url of its group, the password to join
+// the group and the session to resume after losing the connection
+type Welcome struct {
+	URL     string `json:"url"`
+	Key     string `json:"key"`
+	Session string `json:"session"`
+	// Token is the ownership token of the name asked for in the hello,
+	// the client needs it to get the name again later
+	Token string `json:"token,omitempty"`
+	// Role of the client in the group, forwarder when empty
+	Role Role `json:"role,omitempty"`
+}
+
+// Request is a webhook request encoded by serialize.EncodeRequest
+type Request struct {
+	ID   string `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// Ack reports the outcome of forwarding a request to the local program
+type Ack struct {
+	ID string `json:"id"`
+	// Error is empty when the request was delivered
+	Error string `json:"error,omitempty"`
+	// Response is the response of the local program encoded by
+	// serialize.EncodeResponse, set by relay clients
+	Response []byte `json:"response,omitempty"`
+}
+
+// Error codes sent by the server
+const (
+	ErrInvalidMessage  = "invalid_message"
+	ErrUnsupported     = "unsupported_version"
+	ErrGroupNotFound   = "group_not_found"
+	ErrInvalidKey      = "invalid_key"
+	ErrInvalidSettings = "invalid_settings"
+	ErrInvalidName     = "invalid_name"
+	ErrNameUnavailable = "name_unavailable"
+	ErrUnavailable     = "unavailable"
+	ErrForbidden       = "forbidden"
+	ErrLimitReached    = "limit_reached"
+	ErrTooManyAttempts = "too_many_attempts"
+	ErrInvalidInvite   = "invalid_invite"
+)
+
+// Error is sent by the server when it refuses a message
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Member describes the client which joined the group
+type Member struct {
+	ID string `json:"id"`
+	// Members is the number of clients in the group
+	Members int  `json:"members"`
+	Role    Role `json:"role,omitempty"`
+}
+
+// Settings are the settings of a group, clients send them to change
+// the settings and the server sends them to announce the settings.
+// Fields left nil by the client are not changed.
+type Settings struct {
+	// Methods are the http methods forwarded to the group, an empty
+	// list forwards every method
+	Methods []string `json:"methods"`
+	// Challenges makes the server answer the verification requests
+	// of Slack, Meta, WebSub, Twitch and Microsoft Graph, the clients
+	// still receive the requests
+	Challenges *bool `json:"challenges,omitempty"`
+	// VerifyToken is checked against the verify token sent by Meta
+	VerifyToken *string `json:"verify_token,omitempty"`
+	// Responses are written to the webhook senders instead of the
+	// default response, the first matching response is used, an
+	// empty list restores the default response
+	Responses []Response `json:"responses"`
+}
+
+// Response is a canned response for the requests matching Method and
+// Path, empty conditions match every request
+type Response struct {
+	Method string `json:"method,omitempty"`
+	// Path is a glob pattern using the syntax of path.Match
+	Path    string            `json:"path,omitempty"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is a text/template executed with the ID, Method, Path,
+	// Query, Header and Body of the request
+	Body string `json:"body,omitempty"`
+	// Delay before the response is written, e.g. "2s"
+	Delay string `json:"delay,omitempty"`
+}
+
+// Goodbye is sent before the connection is closed
+type Goodbye struct {
+	Reason string `json:"reason,omitempty"`
+	// Reconnect is the websocket url of the server to reconnect to,
+	// set when the server goes away
+	Reconnect string `json:"reconnect,omitempty"`
+}
+
+// Invite lets a client join a group without its password. Clients
+// creating an invite set Role, ExpiresIn and MaxUses, the server answers
+// with the whole invite, Code is only sent when the invite is created.
+type Invite struct {
+	ID   string `json:"id,omitempty"`
+	Code string `json:"code,omitempty"`
+	// Role of the clients joining with the invite, the role of the
+	// client creating the invite by default
+	Role Role `json:"role,omitempty"`
+	// ExpiresIn is how long the invite lasts, e.g. "24h"
+	ExpiresIn string    `json:"expires_in,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// MaxUses is how many clients can join with the invite, one by
+	// default
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses,omitempty"`
+}
+
+// InviteList holds the outstanding invites of a group
+type InviteList struct {
+	Invites []Invite `json:"invites"`
+}
+
+// Revoke revokes the invite with the id
+type Revoke struct {
+	ID string `json:"id"`
+}
+
+// New returns a message of the current version
+func New(t Type) Message {
+	return Message{Version: Version, Type: t}
+}
+
+// Encode encodes the message for a text frame
+func Encode(msg Message) []byte {
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// Decode decodes a message and checks that its version and payload
+// are supported
+func Decode(data []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Message{}, fmt.Errorf("decoding message: %w", err)
+	}
+	if msg.Version < 1 || msg.Version > Version {
+		return Message{}, fmt.Errorf("unsupported protocol version %d", msg.Version)
+	}
+	missing := false
+	switch msg.Type {
+	case TypeHello:
+		missing = msg.Hello == nil
+	case TypeWelcome:
+		missing = msg.Welcome == nil
+	case TypeRequest:
+		missing = msg.Request == nil
+	case TypeAck:
+		missing = msg.Ack == nil
+	case TypeError:
+		missing = msg.Error == nil
+	case TypeMemberJoined:
+		missing = msg.Member == nil
+	case TypeSettings:
+		missing = msg.Settings == nil
+	case TypeGoodbye:
+		missing = msg.Goodbye == nil
+	case TypeInvite:
+		missing = msg.Invite == nil
+	case TypeInvites:
+		missing = msg.Invites == nil
+	case TypeRevokeInvite:
+		missing = msg.Revoke == nil
+	default:
+		return Message{}, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if missing {
+		return Message{}, fmt.Errorf("message of type %q has no payload", msg.Type)
+	}
+	return msg, nil
+}
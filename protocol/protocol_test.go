@@ -0,0 +1,40 @@
+package protocol_test
+
+import (
+	"testing"
+	"whtester/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeAndDecode(t *testing.T) {
+	t.Run("encodes and decodes message", func(t *testing.T) {
+		msg := protocol.New(protocol.TypeRequest)
+		msg.Request = &protocol.Request{ID: "1234", Data: []byte{0, 1, 2}}
+
+		got, err := protocol.Decode(protocol.Encode(msg))
+		require.NoError(t, err)
+		assert.Equal(t, msg, got)
+	})
+
+	t.Run("rejects unsupported version", func(t *testing.T) {
+		_, err := protocol.Decode([]byte(`{"version": 2, "type": "goodbye", "goodbye": {}}`))
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects unknown type", func(t *testing.T) {
+		_, err := protocol.Decode([]byte(`{"version": 1, "type": "unknown"}`))
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects message without payload", func(t *testing.T) {
+		_, err := protocol.Decode([]byte(`{"version": 1, "type": "hello"}`))
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects invalid json", func(t *testing.T) {
+		_, err := protocol.Decode([]byte(`hello`))
+		assert.Error(t, err)
+	})
+}
@@ -1,56 +1,410 @@
+// Package serialize encodes the webhook requests sent to the clients and
+// the responses relayed back by the clients.
+//
+// Requests and responses are encoded in a self-describing format: a magic
+// header, a version byte, a kind byte and a list of fields, each made of
+// a tag byte, a uvarint length and the content. Decoders skip the fields
+// they don't know, so fields can be added without bumping the version.
+// Frames without the magic header are decoded with the legacy gob format
+// so that old clients and servers keep working.
 package serialize
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
-func EncodeRequest(req *http.Request) []byte {
-	buf := bytes.NewBuffer([]byte{})
+const (
+	// Magic starts every encoded frame
+	Magic = "WHT"
+	// Version is the version of the format written by the encoders
+	Version = 1
+)
+
+const (
+	kindRequest  byte = 'q'
+	kindResponse byte = 's'
+)
+
+// limits enforced by the encoders and the decoders
+var (
+	// MaxBodySize is the largest body of a request or a response
+	MaxBodySize int64 = 10 << 20
+	// MaxFieldSize is the largest field other than the body, e.g.
+	// a header value or the url
+	MaxFieldSize = 64 << 10
+	// MaxFields is the largest number of fields in a frame
+	MaxFields = 10000
+)
+
+var (
+	// ErrTooLarge is returned when a body, a field or a frame is
+	// larger than the limits
+	ErrTooLarge = errors.New("serialize: too large")
+	// ErrInvalidFrame is returned for frames which are truncated or
+	// malformed
+	ErrInvalidFrame = errors.New("serialize: invalid frame")
+	// ErrUnsupportedVersion is returned for frames written by a newer
+	// version of the format
+	ErrUnsupportedVersion = errors.New("serialize: unsupported version")
+)
+
+// field tags of a request
+const (
+	tagMethod byte = iota + 1
+	tagURL
+	tagProto
+	tagProtoMajor
+	tagProtoMinor
+	tagHeader
+	tagBody
+	tagContentLength
+	tagTransferEncoding
+	tagHost
+	tagForm
+	tagPostForm
+	tagTrailer
+	tagRemoteAddr
+	tagRequestURI
+)
+
+// field tags of a response
+const (
+	tagID byte = iota + 1
+	tagStatusCode
+	tagResponseHeader
+	tagResponseBody
+)
+
+// RequestIDHeader is set by the server on every forwarded request so
+// that the client can tell the server which request a relayed response
+// belongs to. The client removes it before forwarding the request.
+const RequestIDHeader = "X-Whtester-Request-Id"
+
+// encoder writes the fields of a frame, the first error is kept
+// and returned by finish
+type encoder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func newEncoder(kind byte) *encoder {
+	e := &encoder{}
+	e.buf.WriteString(Magic)
+	e.buf.WriteByte(Version)
+	e.buf.WriteByte(kind)
+	return e
+}
+
+func (e *encoder) bytes(tag byte, data []byte) {
+	e.buf.WriteByte(tag)
+	e.buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	e.buf.Write(data)
+}
+
+func (e *encoder) string(tag byte, s string) {
+	if len(s) > MaxFieldSize {
+		if e.err == nil {
+			e.err = fmt.Errorf("%w: field %d of %d bytes", ErrTooLarge, tag, len(s))
+		}
+		return
+	}
+	e.bytes(tag, []byte(s))
+}
+
+func (e *encoder) int(tag byte, i int64) {
+	e.bytes(tag, []byte(strconv.FormatInt(i, 10)))
+}
+
+// values writes a field for every value of the map, the key and the
+// value separated by a zero byte
+func (e *encoder) values(tag byte, values map[string][]string) {
+	for key, vs := range values {
+		for _, v := range vs {
+			e.string(tag, key+"\x00"+v)
+		}
+	}
+}
+
+func (e *encoder) finish() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// readBody reads the body and replaces it so that it can be read again
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return []byte{}, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(*body, MaxBodySize+1))
+	*body = io.NopCloser(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if int64(len(data)) > MaxBodySize {
+		return nil, fmt.Errorf("%w: body larger than %d bytes", ErrTooLarge, MaxBodySize)
+	}
+	return data, nil
+}
+
+// newBody returns the decoded body, bodiless requests like GET and
+// HEAD get http.NoBody
+func newBody(body []byte) io.ReadCloser {
+	if len(body) == 0 {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewBuffer(body))
+}
+
+// EncodeRequest encodes the request, the body of the request is
+// replaced so that it can be read again
+func EncodeRequest(req *http.Request) ([]byte, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
 	req.ParseForm()
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	e := newEncoder(kindRequest)
+	e.string(tagMethod, req.Method)
+	if req.URL != nil {
+		e.string(tagURL, req.URL.String())
+	}
+	e.string(tagProto, req.Proto)
+	e.int(tagProtoMajor, int64(req.ProtoMajor))
+	e.int(tagProtoMinor, int64(req.ProtoMinor))
+	e.values(tagHeader, req.Header)
+	e.bytes(tagBody, body)
+	e.int(tagContentLength, req.ContentLength)
+	for _, te := range req.TransferEncoding {
+		e.string(tagTransferEncoding, te)
+	}
+	e.string(tagHost, req.Host)
+	e.values(tagForm, req.Form)
+	e.values(tagPostForm, req.PostForm)
+	e.values(tagTrailer, req.Trailer)
+	e.string(tagRemoteAddr, req.RemoteAddr)
+	e.string(tagRequestURI, req.RequestURI)
+	return e.finish()
+}
+
+// EncodeResponse encodes the response of the local program along with
+// the id of the request it answers, the body of the response is replaced
+// so that it can be read again
+func EncodeResponse(id string, resp *http.Response) ([]byte, error) {
+	body, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	e := newEncoder(kindResponse)
+	e.string(tagID, id)
+	e.int(tagStatusCode, int64(resp.StatusCode))
+	e.values(tagResponseHeader, resp.Header)
+	e.bytes(tagResponseBody, body)
+	return e.finish()
+}
+
+type field struct {
+	tag  byte
+	data []byte
+}
+
+// decodeFields checks the header of the frame and splits it into fields
+func decodeFields(buf []byte, kind byte) ([]field, error) {
+	if len(buf) < len(Magic)+2 {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidFrame)
+	}
+	if buf[len(Magic)] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, buf[len(Magic)])
+	}
+	if buf[len(Magic)+1] != kind {
+		return nil, fmt.Errorf("%w: unexpected kind %q", ErrInvalidFrame, buf[len(Magic)+1])
+	}
+	buf = buf[len(Magic)+2:]
+
+	fields := []field{}
+	for len(buf) > 0 {
+		if len(fields) >= MaxFields {
+			return nil, fmt.Errorf("%w: more than %d fields", ErrTooLarge, MaxFields)
+		}
+		tag := buf[0]
+		size, n := binary.Uvarint(buf[1:])
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: invalid length of field %d", ErrInvalidFrame, tag)
+		}
+		buf = buf[1+n:]
+		limit := uint64(MaxFieldSize)
+		if (kind == kindRequest && tag == tagBody) || (kind == kindResponse && tag == tagResponseBody) {
+			limit = uint64(MaxBodySize)
+		}
+		if size > limit {
+			return nil, fmt.Errorf("%w: field %d of %d bytes", ErrTooLarge, tag, size)
+		}
+		if size > uint64(len(buf)) {
+			return nil, fmt.Errorf("%w: truncated field %d", ErrInvalidFrame, tag)
+		}
+		fields = append(fields, field{tag: tag, data: buf[:size]})
+		buf = buf[size:]
+	}
+	return fields, nil
+}
+
+func decodeInt(f field) (int64, error) {
+	i, err := strconv.ParseInt(string(f.data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: field %d is not a number", ErrInvalidFrame, f.tag)
+	}
+	return i, nil
+}
 
-	encoder := gob.NewEncoder(buf)
-	encoder.Encode(req.Method)
-	encoder.Encode(req.URL)
-	encoder.Encode(req.Proto)
-	encoder.Encode(req.ProtoMajor)
-	encoder.Encode(req.ProtoMinor)
-	encoder.Encode(req.Header)
-	data, _ := io.ReadAll(req.Body)
-	req.Body = io.NopCloser(bytes.NewBuffer(data))
-	encoder.Encode(data)
-	encoder.Encode(req.ContentLength)
-	encoder.Encode(req.TransferEncoding)
-	encoder.Encode(req.Host)
-	encoder.Encode(req.Form)
-	encoder.Encode(req.PostForm)
-	encoder.Encode(req.Trailer)
-	encoder.Encode(req.RemoteAddr)
-	encoder.Encode(req.RequestURI)
-	return buf.Bytes()
-}
-
-func DecodeRequest(buf []byte) *http.Request {
-	req := http.Request{}
-	decoder := gob.NewDecoder(bytes.NewBuffer(buf))
-	decoder.Decode(&req.Method)
-	decoder.Decode(&req.URL)
-	decoder.Decode(&req.Proto)
-	decoder.Decode(&req.ProtoMajor)
-	decoder.Decode(&req.ProtoMinor)
-	decoder.Decode(&req.Header)
+func decodeValue(values map[string][]string, f field) error {
+	key, value, ok := strings.Cut(string(f.data), "\x00")
+	if !ok {
+		return fmt.Errorf("%w: field %d has no key", ErrInvalidFrame, f.tag)
+	}
+	values[key] = append(values[key], value)
+	return nil
+}
+
+// DecodeRequest decodes the request encoded by EncodeRequest or by the
+// legacy encoder
+func DecodeRequest(buf []byte) (*http.Request, error) {
+	if !bytes.HasPrefix(buf, []byte(Magic)) {
+		return decodeLegacyRequest(buf)
+	}
+	fields, err := decodeFields(buf, kindRequest)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Header:   make(http.Header),
+		Form:     make(url.Values),
+		PostForm: make(url.Values),
+	}
 	body := []byte{}
-	decoder.Decode(&body)
-	req.Body = io.NopCloser(bytes.NewBuffer(body))
-	decoder.Decode(&req.ContentLength)
-	decoder.Decode(&req.TransferEncoding)
-	decoder.Decode(&req.Host)
-	decoder.Decode(&req.Form)
-	decoder.Decode(&req.PostForm)
-	decoder.Decode(&req.Trailer)
-	decoder.Decode(&req.RemoteAddr)
-	decoder.Decode(&req.RequestURI)
-	return &req
+	for _, f := range fields {
+		var i int64
+		switch f.tag {
+		case tagMethod:
+			req.Method = string(f.data)
+		case tagURL:
+			req.URL, err = url.Parse(string(f.data))
+		case tagProto:
+			req.Proto = string(f.data)
+		case tagProtoMajor:
+			i, err = decodeInt(f)
+			req.ProtoMajor = int(i)
+		case tagProtoMinor:
+			i, err = decodeInt(f)
+			req.ProtoMinor = int(i)
+		case tagHeader:
+			err = decodeValue(req.Header, f)
+		case tagBody:
+			body = f.data
+		case tagContentLength:
+			req.ContentLength, err = decodeInt(f)
+		case tagTransferEncoding:
+			req.TransferEncoding = append(req.TransferEncoding, string(f.data))
+		case tagHost:
+			req.Host = string(f.data)
+		case tagForm:
+			err = decodeValue(req.Form, f)
+		case tagPostForm:
+			err = decodeValue(req.PostForm, f)
+		case tagTrailer:
+			if req.Trailer == nil {
+				req.Trailer = make(http.Header)
+			}
+			err = decodeValue(req.Trailer, f)
+		case tagRemoteAddr:
+			req.RemoteAddr = string(f.data)
+		case tagRequestURI:
+			req.RequestURI = string(f.data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding request: %w", err)
+		}
+	}
+	req.Body = newBody(body)
+	return req, nil
+}
+
+// DecodeResponse decodes the response encoded by EncodeResponse or by the
+// legacy encoder and returns the id of the request it answers
+func DecodeResponse(buf []byte) (string, *http.Response, error) {
+	if !bytes.HasPrefix(buf, []byte(Magic)) {
+		return decodeLegacyResponse(buf)
+	}
+	fields, err := decodeFields(buf, kindResponse)
+	if err != nil {
+		return "", nil, err
+	}
+	var id string
+	resp := &http.Response{Header: make(http.Header)}
+	body := []byte{}
+	for _, f := range fields {
+		var i int64
+		switch f.tag {
+		case tagID:
+			id = string(f.data)
+		case tagStatusCode:
+			i, err = decodeInt(f)
+			resp.StatusCode = int(i)
+		case tagResponseHeader:
+			err = decodeValue(resp.Header, f)
+		case tagResponseBody:
+			body = f.data
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	if resp.StatusCode < 100 || resp.StatusCode > 999 {
+		return "", nil, fmt.Errorf("%w: invalid status code %d", ErrInvalidFrame, resp.StatusCode)
+	}
+	resp.Body = io.NopCloser(bytes.NewBuffer(body))
+	resp.ContentLength = int64(len(body))
+	return id, resp, nil
+}
+
+// EncodeAck encodes the acknowledgement sent by the client once it
+// handled the request with the id, err is the error of forwarding
+// the request to the local program
+func EncodeAck(id string, err error) []byte {
+	if err != nil {
+		return []byte(fmt.Sprintf("ack %s error %s", id, err))
+	}
+	return []byte(fmt.Sprintf("ack %s ok", id))
+}
+
+// DecodeAck decodes the acknowledgement encoded by EncodeAck, it returns
+// the id of the request and the error message of the client, ok is
+// false if msg is not an acknowledgement
+func DecodeAck(msg []byte) (id string, errMsg string, ok bool) {
+	rest, ok := strings.CutPrefix(string(msg), "ack ")
+	if !ok {
+		return "", "", false
+	}
+	id, outcome, ok := strings.Cut(rest, " ")
+	if !ok || id == "" {
+		return "", "", false
+	}
+	if outcome == "ok" {
+		return id, "", true
+	}
+	errMsg, ok = strings.CutPrefix(outcome, "error ")
+	if !ok {
+		return "", "", false
+	}
+	return id, errMsg, true
 }
@@ -2,6 +2,7 @@ package serialize_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"reflect"
@@ -18,11 +19,69 @@ func TestEncoderAndDecoder(t *testing.T) {
 			t.Errorf("%v", err)
 		}
 
-		buf := serialize.EncodeRequest(req)
-		got := serialize.DecodeRequest(buf)
+		buf, err := serialize.EncodeRequest(req)
+		if err != nil {
+			t.Fatalf("encoding request: %v", err)
+		}
+		got, err := serialize.DecodeRequest(buf)
+		if err != nil {
+			t.Fatalf("decoding request: %v", err)
+		}
 
 		assertRequest(t, *got, *req)
 	})
+
+	t.Run("decodes requests in the legacy format", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/hook?x=1", bytes.NewBufferString("a=1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		buf, err := serialize.EncodeLegacyRequest(req)
+		if err != nil {
+			t.Fatalf("encoding request: %v", err)
+		}
+		got, err := serialize.DecodeRequest(buf)
+		if err != nil {
+			t.Fatalf("decoding request: %v", err)
+		}
+
+		assertRequest(t, *got, *req)
+	})
+
+	t.Run("rejects bodies larger than the limit", func(t *testing.T) {
+		defer func(size int64) { serialize.MaxBodySize = size }(serialize.MaxBodySize)
+		serialize.MaxBodySize = 4
+
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("too large"))
+		if _, err := serialize.EncodeRequest(req); !errors.Is(err, serialize.ErrTooLarge) {
+			t.Errorf("got error %v, want %v", err, serialize.ErrTooLarge)
+		}
+	})
+
+	t.Run("rejects truncated frames", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		buf, _ := serialize.EncodeRequest(req)
+		if _, err := serialize.DecodeRequest(buf[:len(buf)-1]); !errors.Is(err, serialize.ErrInvalidFrame) {
+			t.Errorf("got error %v, want %v", err, serialize.ErrInvalidFrame)
+		}
+	})
+
+	t.Run("rejects newer versions", func(t *testing.T) {
+		buf := []byte(serialize.Magic + "\x02q")
+		if _, err := serialize.DecodeRequest(buf); !errors.Is(err, serialize.ErrUnsupportedVersion) {
+			t.Errorf("got error %v, want %v", err, serialize.ErrUnsupportedVersion)
+		}
+	})
+
+	t.Run("skips unknown fields", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080", bytes.NewBufferString("hello"))
+		buf, _ := serialize.EncodeRequest(req)
+		buf = append(buf, 200, 3, 'n', 'e', 'w')
+		got, err := serialize.DecodeRequest(buf)
+		if err != nil {
+			t.Fatalf("decoding request: %v", err)
+		}
+		assertRequest(t, *got, *req)
+	})
 }
 
 func assertRequest(t testing.TB, got, want http.Request) {
@@ -61,3 +120,118 @@ func assertStruct(t testing.TB, fields []string, structA, structB interface{}) {
 		}
 	}
 }
+
+func TestResponseEncoderAndDecoder(t *testing.T) {
+	t.Run("encodes and decodes http response with request id", func(t *testing.T) {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		resp := &http.Response{
+			StatusCode: http.StatusTeapot,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"ok":true}`)),
+		}
+
+		buf, err := serialize.EncodeResponse("1234", resp)
+		if err != nil {
+			t.Fatalf("encoding response: %v", err)
+		}
+		id, got, err := serialize.DecodeResponse(buf)
+		if err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+
+		if id != "1234" {
+			t.Errorf("different id, got %q, want %q", id, "1234")
+		}
+		if got.StatusCode != http.StatusTeapot {
+			t.Errorf("different StatusCode, got %d, want %d", got.StatusCode, http.StatusTeapot)
+		}
+		if !reflect.DeepEqual(got.Header, header) {
+			t.Errorf("different Header, got %v, want %v", got.Header, header)
+		}
+		body, _ := io.ReadAll(got.Body)
+		if string(body) != `{"ok":true}` {
+			t.Errorf("different Body, got %q, want %q", string(body), `{"ok":true}`)
+		}
+	})
+
+	t.Run("decodes responses in the legacy format", func(t *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusTeapot, Body: io.NopCloser(bytes.NewBufferString("hello"))}
+		buf, err := serialize.EncodeLegacyResponse("1234", resp)
+		if err != nil {
+			t.Fatalf("encoding response: %v", err)
+		}
+		id, got, err := serialize.DecodeResponse(buf)
+		if err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if id != "1234" || got.StatusCode != http.StatusTeapot {
+			t.Errorf("got (%q, %d), want (%q, %d)", id, got.StatusCode, "1234", http.StatusTeapot)
+		}
+	})
+
+	t.Run("rejects invalid responses", func(t *testing.T) {
+		for _, buf := range [][]byte{nil, []byte("hello"), []byte(serialize.Magic + "\x01s")} {
+			if _, _, err := serialize.DecodeResponse(buf); err == nil {
+				t.Errorf("decoded %q as response", buf)
+			}
+		}
+	})
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/hook?x=1", bytes.NewBufferString("a=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	buf, _ := serialize.EncodeRequest(req)
+	f.Add(buf)
+	legacy, _ := serialize.EncodeLegacyRequest(req)
+	f.Add(legacy)
+	f.Add([]byte(serialize.Magic))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := serialize.DecodeRequest(data)
+		if err != nil {
+			return
+		}
+		// decoded requests encode again
+		if _, err := serialize.EncodeRequest(req); err != nil {
+			t.Errorf("encoding decoded request: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString("hello"))}
+	buf, _ := serialize.EncodeResponse("1234", resp)
+	f.Add(buf)
+	legacy, _ := serialize.EncodeLegacyResponse("1234", resp)
+	f.Add(legacy)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		serialize.DecodeResponse(data)
+	})
+}
+
+func TestAckEncoderAndDecoder(t *testing.T) {
+	t.Run("encodes and decodes successful acknowledgement", func(t *testing.T) {
+		id, errMsg, ok := serialize.DecodeAck(serialize.EncodeAck("1234", nil))
+		if !ok || id != "1234" || errMsg != "" {
+			t.Errorf("got (%q, %q, %v), want (%q, %q, %v)", id, errMsg, ok, "1234", "", true)
+		}
+	})
+
+	t.Run("encodes and decodes failed acknowledgement", func(t *testing.T) {
+		id, errMsg, ok := serialize.DecodeAck(serialize.EncodeAck("1234", errors.New("connection refused")))
+		if !ok || id != "1234" || errMsg != "connection refused" {
+			t.Errorf("got (%q, %q, %v), want (%q, %q, %v)", id, errMsg, ok, "1234", "connection refused", true)
+		}
+	})
+
+	t.Run("rejects other messages", func(t *testing.T) {
+		for _, msg := range []string{"hello", "ack ", "ack 1234", "ack 1234 maybe"} {
+			if _, _, ok := serialize.DecodeAck([]byte(msg)); ok {
+				t.Errorf("decoded %q as acknowledgement", msg)
+			}
+		}
+	})
+}
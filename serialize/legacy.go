@@ -0,0 +1,139 @@
+package serialize
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// EncodeLegacyRequest encodes the request in the gob format understood
+// by clients which don't speak the control protocol
+func EncodeLegacyRequest(req *http.Request) ([]byte, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.ParseForm()
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	buf := bytes.NewBuffer([]byte{})
+	encoder := gob.NewEncoder(buf)
+	for _, v := range []any{req.Method, req.URL, req.Proto, req.ProtoMajor, req.ProtoMinor,
+		req.Header, body, req.ContentLength, req.TransferEncoding, req.Host, req.Form,
+		req.PostForm, req.Trailer, req.RemoteAddr, req.RequestURI} {
+		if err := encoder.Encode(v); err != nil {
+			return nil, fmt.Errorf("encoding request: %w", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeLegacyResponse encodes the response in the gob format understood
+// by servers which don't speak the control protocol
+func EncodeLegacyResponse(id string, resp *http.Response) ([]byte, error) {
+	body, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer([]byte{})
+	encoder := gob.NewEncoder(buf)
+	for _, v := range []any{id, resp.StatusCode, resp.Header, body} {
+		if err := encoder.Encode(v); err != nil {
+			return nil, fmt.Errorf("encoding response: %w", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// legacyDecoder reads the gob values, limiting the size of the frame
+type legacyDecoder struct {
+	decoder *gob.Decoder
+	err     error
+}
+
+func newLegacyDecoder(buf []byte) (*legacyDecoder, error) {
+	if int64(len(buf)) > MaxBodySize+int64(MaxFieldSize) {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrTooLarge, len(buf))
+	}
+	if err := checkLegacyFrame(buf); err != nil {
+		return nil, err
+	}
+	return &legacyDecoder{decoder: gob.NewDecoder(bytes.NewReader(buf))}, nil
+}
+
+// checkLegacyFrame walks the messages of the gob stream and checks that
+// none is longer than the frame, gob allocates the declared length of a
+// message before reading it
+func checkLegacyFrame(buf []byte) error {
+	for len(buf) > 0 {
+		size, n := uint64(buf[0]), 1
+		if size >= 0x80 {
+			// negated byte count of a big endian length
+			n = 1 + 256 - int(buf[0])
+			if n > 9 || n > len(buf) {
+				return fmt.Errorf("%w: invalid message length", ErrInvalidFrame)
+			}
+			size = 0
+			for _, b := range buf[1:n] {
+				size = size<<8 | uint64(b)
+			}
+		}
+		if size > uint64(len(buf)-n) {
+			return fmt.Errorf("%w: truncated message", ErrInvalidFrame)
+		}
+		buf = buf[n+int(size):]
+	}
+	return nil
+}
+
+func (d *legacyDecoder) decode(v any) {
+	if d.err != nil {
+		return
+	}
+	if err := d.decoder.Decode(v); err != nil {
+		d.err = fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+}
+
+func decodeLegacyRequest(buf []byte) (*http.Request, error) {
+	d, err := newLegacyDecoder(buf)
+	if err != nil {
+		return nil, err
+	}
+	req := http.Request{}
+	body := []byte{}
+	for _, v := range []any{&req.Method, &req.URL, &req.Proto, &req.ProtoMajor, &req.ProtoMinor,
+		&req.Header, &body, &req.ContentLength, &req.TransferEncoding, &req.Host, &req.Form,
+		&req.PostForm, &req.Trailer, &req.RemoteAddr, &req.RequestURI} {
+		d.decode(v)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("decoding legacy request: %w", d.err)
+	}
+	req.Body = newBody(body)
+	return &req, nil
+}
+
+func decodeLegacyResponse(buf []byte) (string, *http.Response, error) {
+	d, err := newLegacyDecoder(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	var id string
+	resp := http.Response{}
+	body := []byte{}
+	for _, v := range []any{&id, &resp.StatusCode, &resp.Header, &body} {
+		d.decode(v)
+	}
+	if d.err != nil {
+		return "", nil, fmt.Errorf("decoding legacy response: %w", d.err)
+	}
+	if resp.StatusCode < 100 || resp.StatusCode > 999 {
+		return "", nil, fmt.Errorf("%w: invalid status code %d", ErrInvalidFrame, resp.StatusCode)
+	}
+	resp.Body = io.NopCloser(bytes.NewBuffer(body))
+	resp.ContentLength = int64(len(body))
+	return id, &resp, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// AckWaitTime is how long the server waits for a client to
+	// acknowledge a request before sending it again, by default
+	AckWaitTime = 30 * time.Second
+	// MaxDeliveryAttempts is the number of times a request is sent
+	// to a client which doesn't acknowledge it
+	MaxDeliveryAttempts = 5
+)
+
+// ackResult is the outcome of forwarding a request reported by a client
+type ackResult struct {
+	// err is the error of the client forwarding the request to
+	// its local program, empty if the request was delivered
+	err string
+}
+
+// pendingRequest is a request sent to a client which has not been
+// acknowledged yet
+type pendingRequest struct {
+	id         string
+	msg        []byte
+	receivedAt time.Time
+	sentAt     time.Time
+	attempts   int
+}
+
+// pendingRequests holds the requests sent to a client, in the order
+// they were sent, until the client acknowledges them
+type pendingRequests struct {
+	items []*pendingRequest
+	sync.Mutex
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{}
+}
+
+// add keeps the request received at receivedAt, sent at now
+func (p *pendingRequests) add(id string, msg []byte, receivedAt time.Time, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.items = append(p.items, &pendingRequest{id: id, msg: msg, receivedAt: receivedAt, sentAt: now, attempts: 1})
+}
+
+// ack removes the request, it reports if the request was pending
+func (p *pendingRequests) ack(id string) bool {
+	p.Lock()
+	defer p.Unlock()
+	for i, item := range p.items {
+		if item.id == id {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// due returns the requests which were not acknowledged within the wait
+// time and marks them as sent again, requests which ran out of attempts
+// are dropped
+func (p *pendingRequests) due(now time.Time, wait time.Duration) []*pendingRequest {
+	p.Lock()
+	defer p.Unlock()
+	var res []*pendingRequest
+	kept := p.items[:0]
+	for _, item := range p.items {
+		if now.Sub(item.sentAt) < wait {
+			kept = append(kept, item)
+			continue
+		}
+		if item.attempts >= MaxDeliveryAttempts {
+			fmt.Printf("\ndropped unacknowledged request: %s", item.id)
+			continue
+		}
+		item.attempts++
+		item.sentAt = now
+		res = append(res, item)
+		kept = append(kept, item)
+	}
+	p.items = kept
+	return res
+}
+
+// drain empties the pending requests and returns them in the order
+// they were sent
+func (p *pendingRequests) drain() []*pendingRequest {
+	p.Lock()
+	defer p.Unlock()
+	res := p.items
+	p.items = nil
+	return res
+}
+
+// redeliver sends the requests the client didn't acknowledge again,
+// until done is closed
+func (m *Manager) redeliver(c *client, done chan struct{}) {
+	ticker := time.NewTicker(m.AckWaitTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, item := range c.pending.due(time.Now(), m.AckWaitTime) {
+				c.send(item.id, item.msg, time.Time{})
+			}
+		}
+	}
+}
+
+// handleAck records the acknowledgement of the client and reports
+// the outcome to the webhook sender waiting on it
+func (m *Manager) handleAck(c *client, id string, errMsg string) {
+	if c.pending != nil {
+		c.pending.ack(id)
+	}
+	if errMsg == "" {
+		c.stats.acked.Add(1)
+	} else {
+		c.stats.failed.Add(1)
+	}
+	m.acks.deliver(id, ackResult{err: errMsg})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingRequests(t *testing.T) {
+	now := time.Now()
+
+	t.Run("acknowledged requests are not due", func(t *testing.T) {
+		p := newPendingRequests()
+		p.add("1", []byte("1"), now, now)
+		p.add("2", []byte("2"), now, now)
+		assert.True(t, p.ack("1"))
+		assert.False(t, p.ack("1"))
+
+		due := p.due(now.Add(time.Minute), time.Second)
+		require.Len(t, due, 1)
+		assert.Equal(t, "2", due[0].id)
+	})
+
+	t.Run("requests are dropped after max attempts", func(t *testing.T) {
+		p := newPendingRequests()
+		p.add("1", []byte("1"), now, now)
+		for i := 1; i < MaxDeliveryAttempts; i++ {
+			now = now.Add(time.Minute)
+			assert.Len(t, p.due(now, time.Second), 1)
+		}
+		assert.Empty(t, p.due(now.Add(time.Minute), time.Second))
+		assert.Empty(t, p.drain())
+	})
+}
+
+// readRequestID reads the next request sent to the client and returns its id
+func readRequestID(t testing.TB, ws *websocket.Conn) string {
+	t.Helper()
+	for {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		msgType, data, err := ws.ReadMessage()
+		require.NoError(t, err, "reading request")
+		if msgType == websocket.BinaryMessage {
+			req, err := serialize.DecodeRequest(data)
+			require.NoError(t, err, "decoding request")
+			return req.Header.Get(serialize.RequestIDHeader)
+		}
+	}
+}
+
+func TestAcknowledgements(t *testing.T) {
+	// the wait is set before the clients connect, their redelivery
+	// reads it
+	newAckServer := func(t *testing.T) (*Manager, *httptest.Server) {
+		manager, srv := newTestServer(t)
+		manager.AckWaitTime = 100 * time.Millisecond
+		return manager, srv
+	}
+	ackHeader := func() http.Header {
+		header := make(http.Header)
+		header.Set("ack", "true")
+		return header
+	}
+
+	t.Run("sender learns the outcome of the delivery", func(t *testing.T) {
+		_, srv := newAckServer(t)
+		ws, u, _ := dialTestClient(t, srv, ackHeader())
+
+		outcomes := []error{nil, errors.New("connection refused")}
+		go func() {
+			for _, outcome := range outcomes {
+				id := readRequestID(t, ws)
+				ws.WriteMessage(websocket.TextMessage, serialize.EncodeAck(id, outcome))
+			}
+		}()
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		resp = sendWebhook(t, srv, http.MethodPost, u, "hello")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Contains(t, string(body), "connection refused")
+	})
+
+	t.Run("unacknowledged request is sent again", func(t *testing.T) {
+		_, srv := newAckServer(t)
+		ws, u, _ := dialTestClient(t, srv, ackHeader())
+
+		go func() {
+			resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+			resp.Body.Close()
+		}()
+		first := readRequestID(t, ws)
+		second := readRequestID(t, ws)
+		assert.Equal(t, first, second)
+
+		// no more deliveries once it is acknowledged
+		ws.WriteMessage(websocket.TextMessage, serialize.EncodeAck(first, nil))
+		ws.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		for {
+			msgType, _, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			assert.NotEqual(t, websocket.BinaryMessage, msgType, "acknowledged request is sent again")
+		}
+	})
+
+	t.Run("unacknowledged request is sent again on reconnect", func(t *testing.T) {
+		manager, srv := newAckServer(t)
+		manager.GracePeriod = time.Minute
+		ws, msg := dialTestClientHandshake(t, srv, ackHeader())
+		u := strings.Split(msg, "\n")[0]
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		resp.Body.Close()
+		id := readRequestID(t, ws)
+		ws.Close()
+		waitForClients(t, manager, groupKey(u), 0)
+
+		header := ackHeader()
+		header.Set("session", readSession(t, msg))
+		resumed, _ := dialTestClientHandshake(t, srv, header)
+		assert.Equal(t, id, readRequestID(t, resumed))
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PathPrefix starts the path of the urls in path mode, it is followed
+// by the id of the group and the path sent to the clients
+const PathPrefix = "/h/"
+
+// groupKey returns the id of the group of the url, which is the path
+// segment after PathPrefix for urls in path mode and the subdomain of
+// the url otherwise
+func groupKey(u string) string {
+	uStruct, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(uStruct.Path, PathPrefix); ok {
+		key, _, _ := strings.Cut(rest, "/")
+		return key
+	}
+	return strings.Split(uStruct.Host, ".")[0]
+}
+
+// generateURL returns the url of a new group with an id which is not
+// in use. The caller must hold the lock of the manager.
+func (m *Manager) generateURL(domain string) (string, error) {
+	id, err := m.newID()
+	if err != nil {
+		return "", err
+	}
+	return m.nameURL(domain, id), nil
+}
+
+// GenerateRandomPathURL generates a random id and returns the url of
+// the id under PathPrefix on the domain
+func GenerateRandomPathURL(scheme string, domain string, idLen int) string {
+	u := url.URL{
+		Scheme: scheme,
+		Host:   domain,
+		Path:   PathPrefix + GenerateRandomString(idLen),
+	}
+	return u.String()
+}
+
+// requestGroup returns the id of the group the webhook was sent to, in
+// path mode the group prefix is removed from the path so that the
+// clients get the path after the id
+func (m *Manager) requestGroup(r *http.Request) (string, bool) {
+	if !m.PathMode {
+		return strings.Split(r.Host, ".")[0], true
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, PathPrefix)
+	if !ok {
+		return "", false
+	}
+	key, rest, _ := strings.Cut(rest, "/")
+	if key == "" {
+		return "", false
+	}
+	r.URL.Path = "/" + rest
+	if r.URL.RawPath != "" {
+		raw := strings.TrimPrefix(r.URL.RawPath, PathPrefix)
+		_, raw, _ = strings.Cut(raw, "/")
+		r.URL.RawPath = "/" + raw
+	}
+	r.RequestURI = r.URL.RequestURI()
+	return key, true
+}
+
+// groupHost reports if the host is the subdomain of a group, every
+// request sent to it is a webhook. In path mode the groups share the
+// host of the server.
+func (m *Manager) groupHost(domain string, host string) bool {
+	if m.PathMode {
+		return false
+	}
+	return strings.HasSuffix(hostname(host), "."+hostname(domain))
+}
+
+// serverOnly serves the requests sent to the host of the server with h,
+// the ones sent to the subdomain of a group are webhooks
+func (m *Manager) serverOnly(domain string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.groupHost(domain, r.Host) {
+			m.ServeHTTP(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// hostname returns the host without its port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
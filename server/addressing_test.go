@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"whtester/serialize"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupKey(t *testing.T) {
+	assert.Equal(t, "abc", groupKey("http://abc.localhost:8080"))
+	assert.Equal(t, "abc", groupKey("https://hooks.example.com/h/abc"))
+	assert.Equal(t, "abc", groupKey("https://hooks.example.com/h/abc/github"))
+}
+
+func TestRequestGroup(t *testing.T) {
+	t.Run("subdomain mode routes on the host", func(t *testing.T) {
+		m := NewManager()
+		r := httptest.NewRequest(http.MethodPost, "http://abc.localhost/h/xyz/github", nil)
+		key, ok := m.requestGroup(r)
+		assert.True(t, ok)
+		assert.Equal(t, "abc", key)
+		assert.Equal(t, "/h/xyz/github", r.URL.Path)
+	})
+
+	t.Run("path mode routes on the path prefix", func(t *testing.T) {
+		m := NewManager()
+		m.PathMode = true
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/h/abc/github/push%2Fall?x=1", nil)
+		key, ok := m.requestGroup(r)
+		assert.True(t, ok)
+		assert.Equal(t, "abc", key)
+		assert.Equal(t, "/github/push/all", r.URL.Path)
+		assert.Equal(t, "/github/push%2Fall?x=1", r.RequestURI)
+
+		r = httptest.NewRequest(http.MethodPost, "http://localhost/h/abc", nil)
+		key, ok = m.requestGroup(r)
+		assert.True(t, ok)
+		assert.Equal(t, "abc", key)
+		assert.Equal(t, "/", r.URL.Path)
+	})
+
+	t.Run("path mode rejects other paths", func(t *testing.T) {
+		m := NewManager()
+		m.PathMode = true
+		for _, target := range []string{"http://localhost/", "http://localhost/hooks/abc", "http://localhost/h/"} {
+			_, ok := m.requestGroup(httptest.NewRequest(http.MethodPost, target, nil))
+			assert.False(t, ok, target)
+		}
+	})
+}
+
+func TestPathMode(t *testing.T) {
+	manager, srv := newTestServer(t)
+	manager.PathMode = true
+	manager.Scheme = "https"
+	ws, u, _ := dialTestClient(t, srv, nil)
+	require.True(t, strings.HasPrefix(u, "https://localhost/h/"), u)
+
+	resp := sendWebhook(t, srv, http.MethodPost, u+"/github/push?x=1", "hello")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	req, err := serialize.DecodeRequest(data)
+	require.NoError(t, err)
+	assert.Equal(t, "/github/push?x=1", req.URL.RequestURI())
+
+	resp = sendWebhook(t, srv, http.MethodPost, "https://localhost/github", "hello")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,449 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// serverStats count what the server handled since it started
+type serverStats struct {
+	startedAt time.Time
+	// requests received for the groups
+	requests atomic.Int64
+	// clients which connected and groups which were created
+	clients atomic.Int64
+	groups  atomic.Int64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{startedAt: time.Now()}
+}
+
+// groupStats count the requests received for a group
+type groupStats struct {
+	requests atomic.Int64
+}
+
+// clientStats count the requests sent to a client and what became of them
+type clientStats struct {
+	delivered atomic.Int64
+	acked     atomic.Int64
+	failed    atomic.Int64
+}
+
+// AdminStats are the totals of the server
+type AdminStats struct {
+	StartedAt    time.Time `json:"started_at"`
+	Groups       int       `json:"groups"`
+	Clients      int       `json:"clients"`
+	Queued       int       `json:"queued"`
+	Reservations int       `json:"reservations"`
+	Requests     int64     `json:"requests_total"`
+	ClientsTotal int64     `json:"clients_total"`
+	GroupsTotal  int64     `json:"groups_total"`
+}
+
+// AdminGroup describes a group, Members is only set when a single group
+// is asked for
+type AdminGroup struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	// Owner is the name of the api token which created the group
+	Owner    string        `json:"owner,omitempty"`
+	Clients  int           `json:"clients"`
+	Queued   int           `json:"queued"`
+	Requests int64         `json:"requests"`
+	Members  []AdminClient `json:"members,omitempty"`
+}
+
+// AdminToken describes an api token, without its hash
+type AdminToken struct {
+	Name       string  `json:"name"`
+	Scopes     []Scope `json:"scopes"`
+	MaxGroups  int     `json:"max_groups,omitempty"`
+	MaxClients int     `json:"max_clients,omitempty"`
+	// Groups and Clients are the groups created with the token and
+	// the clients connected with it
+	Groups  int `json:"groups"`
+	Clients int `json:"clients"`
+}
+
+// AdminReservation describes a reserved name, Live reports if the group
+// of the name exists
+type AdminReservation struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Live      bool      `json:"live"`
+}
+
+// AdminClient describes a connected client
+type AdminClient struct {
+	ID          string        `json:"id"`
+	Group       string        `json:"group"`
+	RemoteAddr  string        `json:"remote_addr"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	Role        protocol.Role `json:"role"`
+	// Protocol is the version of the control protocol, zero for
+	// clients using the legacy format
+	Protocol int  `json:"protocol"`
+	Relay    bool `json:"relay"`
+	// Token is the name of the api token of the client
+	Token     string `json:"token,omitempty"`
+	Delivered int64  `json:"delivered"`
+	Acked     int64  `json:"acked"`
+	Failed    int64  `json:"failed"`
+}
+
+func (c client) admin() AdminClient {
+	return AdminClient{
+		ID:          c.uid,
+		Group:       groupKey(c.url),
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		Role:        c.role,
+		Protocol:    c.proto,
+		Relay:       c.relay,
+		Token:       c.token,
+		Delivered:   c.stats.delivered.Load(),
+		Acked:       c.stats.acked.Load(),
+		Failed:      c.stats.failed.Load(),
+	}
+}
+
+// adminGroup describes the group. The caller must hold the lock of the manager.
+func (m *Manager) adminGroup(key string, g *clientGroup) AdminGroup {
+	res := AdminGroup{
+		ID:        key,
+		URL:       g.url,
+		CreatedAt: g.createdAt,
+		Owner:     m.tokens.owner(g.url),
+		Clients:   len(g.clients),
+		Requests:  g.stats.requests.Load(),
+	}
+	if g.queue != nil {
+		res.Queued = len(g.queue.items)
+	}
+	return res
+}
+
+// groupClients returns the clients of the group, the oldest first
+func groupClients(g *clientGroup) []AdminClient {
+	res := []AdminClient{}
+	for _, c := range g.clients {
+		res = append(res, c.admin())
+	}
+	slices.SortFunc(res, func(a, b AdminClient) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return res
+}
+
+// NewAdminHandler serves the admin api under /admin/api, requests need
+// an api token with the admin scope. It is meant for its own listener,
+// apart from the webhooks.
+func NewAdminHandler(m *Manager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/api/stats", m.handleAdminStats)
+	mux.HandleFunc("GET /admin/api/groups", m.handleAdminGroups)
+	mux.HandleFunc("GET /admin/api/groups/{id}", m.handleAdminGroup)
+	mux.HandleFunc("DELETE /admin/api/groups/{id}", m.handleAdminDeleteGroup)
+	mux.HandleFunc("POST /admin/api/groups/{id}/password", m.handleAdminRotatePassword)
+	mux.HandleFunc("GET /admin/api/groups/{id}/requests", m.handleAdminRequests)
+	mux.HandleFunc("GET /admin/api/clients", m.handleAdminClients)
+	mux.HandleFunc("DELETE /admin/api/clients/{id}", m.handleAdminKickClient)
+	mux.HandleFunc("GET /admin/api/tokens", m.handleAdminTokens)
+	mux.HandleFunc("POST /admin/api/tokens", m.handleAdminCreateToken)
+	mux.HandleFunc("DELETE /admin/api/tokens/{name}", m.handleAdminDeleteToken)
+	mux.HandleFunc("GET /admin/api/reservations", m.handleAdminReservations)
+	mux.HandleFunc("DELETE /admin/api/reservations/{name}", m.handleAdminReleaseName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := m.tokens.lookup(bearerToken(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whtester admin"`)
+			http.Error(w, "missing or invalid api token", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(token.Scopes, ScopeAdmin) {
+			http.Error(w, "api token has no admin scope", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (m *Manager) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats := AdminStats{
+		StartedAt:    m.stats.startedAt,
+		Requests:     m.stats.requests.Load(),
+		ClientsTotal: m.stats.clients.Load(),
+		GroupsTotal:  m.stats.groups.Load(),
+	}
+	m.RLock()
+	stats.Groups = len(m.ClientList)
+	for _, g := range m.ClientList {
+		stats.Clients += len(g.clients)
+		if g.queue != nil {
+			stats.Queued += len(g.queue.items)
+		}
+	}
+	m.RUnlock()
+	m.reservations.Lock()
+	stats.Reservations = len(m.reservations.names)
+	m.reservations.Unlock()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (m *Manager) handleAdminGroups(w http.ResponseWriter, r *http.Request) {
+	m.RLock()
+	groups := []AdminGroup{}
+	for key, g := range m.ClientList {
+		groups = append(groups, m.adminGroup(key, g))
+	}
+	m.RUnlock()
+	slices.SortFunc(groups, func(a, b AdminGroup) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (m *Manager) handleAdminGroup(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("id")
+	m.RLock()
+	g, ok := m.ClientList[key]
+	var group AdminGroup
+	if ok {
+		group = m.adminGroup(key, g)
+		group.Members = groupClients(g)
+	}
+	m.RUnlock()
+	if !ok {
+		http.Error(w, "group does not exist", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+func (m *Manager) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	m.RLock()
+	clients := []AdminClient{}
+	for _, g := range m.ClientList {
+		clients = append(clients, groupClients(g)...)
+	}
+	m.RUnlock()
+	slices.SortFunc(clients, func(a, b AdminClient) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// handleAdminDeleteGroup deletes the group and disconnects its clients,
+// their sessions are deleted along with the group so they can't come back
+func (m *Manager) handleAdminDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("id")
+	m.Lock()
+	g, ok := m.ClientList[key]
+	var clients []client
+	if ok {
+		for _, c := range g.clients {
+			clients = append(clients, c)
+		}
+		if g.expire != nil {
+			g.expire.Stop()
+		}
+		m.deleteGroup(key, g)
+	}
+	m.Unlock()
+	if !ok {
+		http.Error(w, "group does not exist", http.StatusNotFound)
+		return
+	}
+	for _, c := range clients {
+		disconnect(c, "the group was deleted by an admin")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRotatePassword gives the group a new password, connected
+// clients stay connected and clients resume their session without it
+func (m *Manager) handleAdminRotatePassword(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("id")
+	password, hash := newPassword()
+	m.Lock()
+	g, ok := m.ClientList[key]
+	if ok {
+		m.Passwords[g.url] = hash
+		m.saveGroup(g.url)
+	}
+	m.Unlock()
+	if !ok {
+		http.Error(w, "group does not exist", http.StatusNotFound)
+		return
+	}
+	// the group is not locked out for the failures of the old password
+	m.lockout.succeed("group:" + g.url)
+	fmt.Printf("\nrotated password of client group: %s", key)
+	writeJSON(w, http.StatusOK, map[string]string{"url": g.url, "password": password})
+}
+
+// handleAdminKickClient disconnects the client and revokes its session,
+// so that it can only come back with the password or an invite
+func (m *Manager) handleAdminKickClient(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	m.Lock()
+	var kicked client
+	var found bool
+	for _, g := range m.ClientList {
+		if c, ok := g.clients[id]; ok {
+			kicked, found = c, true
+			break
+		}
+	}
+	if hash, _, ok := m.lookupSession(kicked.session); found && ok {
+		delete(m.sessions, hash)
+		m.saveGroup(kicked.url)
+	}
+	m.Unlock()
+	if !found {
+		http.Error(w, "client does not exist", http.StatusNotFound)
+		return
+	}
+	fmt.Printf("\nkicked client: %s", id)
+	disconnect(kicked, "kicked by an admin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRequests lists the requests received for the group, like
+// the history api without the password of the group
+func (m *Manager) handleAdminRequests(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("id")
+	m.RLock()
+	_, ok := m.ClientList[key]
+	m.RUnlock()
+	if !ok {
+		http.Error(w, "group does not exist", http.StatusNotFound)
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := m.history.query(key, q)
+	for i := range entries {
+		entries[i].Request = nil
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (m *Manager) handleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	res := []AdminToken{}
+	for _, t := range m.tokens.list() {
+		token := AdminToken{
+			Name:       t.Name,
+			Scopes:     t.Scopes,
+			MaxGroups:  t.MaxGroups,
+			MaxClients: t.MaxClients,
+			Groups:     m.tokens.groups(t.Name),
+		}
+		m.tokens.Lock()
+		token.Clients = m.tokens.clients[t.Name]
+		m.tokens.Unlock()
+		res = append(res, token)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleAdminCreateToken adds or replaces the api token of the body and
+// saves it in the store, a token is generated when the body has none.
+// The token is only returned once.
+func (m *Manager) handleAdminCreateToken(w http.ResponseWriter, r *http.Request) {
+	var t APIToken
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "invalid token: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.Hash = ""
+	if t.Token == "" {
+		t.Token = GenerateRandomString(32)
+	}
+	if err := t.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := t.Token
+	if err := m.PutToken(t); err != nil {
+		http.Error(w, "saving token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"name": t.Name, "token": secret})
+}
+
+func (m *Manager) handleAdminDeleteToken(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	m.tokens.Lock()
+	_, ok := m.tokens.tokens[name]
+	m.tokens.Unlock()
+	if !ok {
+		http.Error(w, "token does not exist", http.StatusNotFound)
+		return
+	}
+	if err := m.DeleteToken(name); err != nil {
+		http.Error(w, "deleting token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Manager) handleAdminReservations(w http.ResponseWriter, r *http.Request) {
+	res := []AdminReservation{}
+	for _, reservation := range m.reservations.list() {
+		m.RLock()
+		_, live := m.ClientList[reservation.Name]
+		m.RUnlock()
+		res = append(res, AdminReservation{Name: reservation.Name, CreatedAt: reservation.CreatedAt, Live: live})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleAdminReleaseName removes the reservation of the name, anyone can
+// ask for the name once its group expired
+func (m *Manager) handleAdminReleaseName(w http.ResponseWriter, r *http.Request) {
+	released, err := m.ReleaseName(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "releasing name: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !released {
+		http.Error(w, "name is not reserved", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disconnect says goodbye to the client and closes the connection with
+// protocol.CloseRemoved, so that the client doesn't reconnect
+func disconnect(c client, reason string) {
+	goodbye(c, protocol.Goodbye{Reason: reason}, protocol.CloseRemoved)
+}
+
+// goodbye sends the goodbye to clients speaking the control protocol, or
+// its reason to the others, and closes the connection with the code. The
+// client is removed from its group once its read loop ends.
+func goodbye(c client, bye protocol.Goodbye, code int) {
+	if c.proto > 0 {
+		msg := protocol.New(protocol.TypeGoodbye)
+		msg.Goodbye = &bye
+		c.sendMessage(msg)
+	} else {
+		c.out.push(outbound{msgType: websocket.TextMessage, data: []byte(bye.Reason)})
+	}
+	c.out.close(code, bye.Reason)
+}
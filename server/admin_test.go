@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAdminServer starts the admin api of the manager, with the admin
+// token "admin"
+func newAdminServer(t *testing.T, manager *Manager) *httptest.Server {
+	manager.AddTokens(APIToken{Name: "admin", Token: "admin", Scopes: []Scope{ScopeAdmin}})
+	srv := httptest.NewServer(NewAdminHandler(manager))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// adminRequest sends a request to the admin api with the admin token
+// and decodes the JSON response into v, unless v is nil
+func adminRequest(t *testing.T, srv *httptest.Server, method string, path string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+// adminPost posts the JSON body to the admin api and decodes the
+// response into v
+func adminPost(t *testing.T, srv *httptest.Server, path string, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	t.Run("admin api needs an admin token", func(t *testing.T) {
+		manager, _ := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		manager.AddTokens(APIToken{Name: "ci", Token: "ci", Scopes: []Scope{ScopeCreate, ScopeJoin}})
+		for token, status := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "ci": http.StatusForbidden} {
+			req, _ := http.NewRequest(http.MethodGet, admin.URL+"/admin/api/stats", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, token)
+		}
+	})
+
+	t.Run("groups, clients and totals are listed", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		go func() {
+			req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+			ack := protocol.New(protocol.TypeAck)
+			ack.Ack = &protocol.Ack{ID: req.ID}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+		}()
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		resp.Body.Close()
+
+		var stats AdminStats
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/stats", &stats))
+		assert.Equal(t, 1, stats.Groups)
+		assert.Equal(t, 1, stats.Clients)
+		assert.Equal(t, int64(1), stats.Requests)
+		assert.Equal(t, int64(1), stats.GroupsTotal)
+
+		var groups []AdminGroup
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/groups", &groups))
+		require.Len(t, groups, 1)
+		assert.Equal(t, welcome.URL, groups[0].URL)
+		assert.Equal(t, int64(1), groups[0].Requests)
+		assert.Empty(t, groups[0].Members)
+
+		var group AdminGroup
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/groups/"+groupKey(welcome.URL), &group))
+		require.Len(t, group.Members, 1)
+		member := group.Members[0]
+		assert.Equal(t, protocol.RoleForwarder, member.Role)
+		assert.NotEmpty(t, member.RemoteAddr)
+		assert.WithinDuration(t, time.Now(), member.ConnectedAt, time.Minute)
+		assert.Equal(t, int64(1), member.Delivered)
+		assert.Equal(t, int64(1), member.Acked)
+
+		var clients []AdminClient
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/clients", &clients))
+		assert.Equal(t, []AdminClient{member}, clients)
+
+		assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodGet, "/admin/api/groups/unknown", nil))
+	})
+
+	t.Run("kicked clients can't resume their session", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		var clients []AdminClient
+		adminRequest(t, admin, http.MethodGet, "/admin/api/clients", &clients)
+		require.Len(t, clients, 1)
+
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, admin, http.MethodDelete, "/admin/api/clients/"+clients[0].ID, nil))
+		goodbye := readProtocolMessage(t, ws, protocol.TypeGoodbye).Goodbye
+		assert.Contains(t, goodbye.Reason, "kicked")
+		_, _, err := ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, protocol.CloseRemoved), "%v", err)
+		waitForClients(t, manager, groupKey(welcome.URL), 0)
+
+		again := dialProtocolClient(t, srv, protocol.Hello{URL: welcome.URL, Session: welcome.Session})
+		assert.Equal(t, protocol.ErrInvalidKey, readProtocolMessage(t, again, protocol.TypeError).Error.Code)
+		assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodDelete, "/admin/api/clients/"+clients[0].ID, nil))
+	})
+
+	t.Run("deleted groups disconnect their clients", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, admin, http.MethodDelete, "/admin/api/groups/"+groupKey(welcome.URL), nil))
+		readProtocolMessage(t, ws, protocol.TypeGoodbye)
+		_, _, err := ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, protocol.CloseRemoved), "%v", err)
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		resp.Body.Close()
+		assert.Equal(t, manager.NoClientStatus, resp.StatusCode)
+		var groups []AdminGroup
+		adminRequest(t, admin, http.MethodGet, "/admin/api/groups", &groups)
+		assert.Empty(t, groups)
+	})
+
+	t.Run("rotated passwords replace the old one", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		var rotated map[string]string
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodPost, "/admin/api/groups/"+groupKey(welcome.URL)+"/password", &rotated))
+		assert.NotEqual(t, welcome.Key, rotated["password"])
+
+		old := dialProtocolClient(t, srv, protocol.Hello{URL: welcome.URL, Key: welcome.Key})
+		assert.Equal(t, protocol.ErrInvalidKey, readProtocolMessage(t, old, protocol.TypeError).Error.Code)
+		joined := dialProtocolClient(t, srv, protocol.Hello{URL: welcome.URL, Key: rotated["password"]})
+		readProtocolMessage(t, joined, protocol.TypeWelcome)
+	})
+
+	t.Run("requests of a group are listed", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		go func() {
+			for range 2 {
+				req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+				ack := protocol.New(protocol.TypeAck)
+				ack.Ack = &protocol.Ack{ID: req.ID}
+				ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+			}
+		}()
+		for _, method := range []string{http.MethodPost, http.MethodPut} {
+			resp := sendWebhook(t, srv, method, welcome.URL, "hello")
+			resp.Body.Close()
+		}
+
+		var entries []HistoryEntry
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/groups/"+groupKey(welcome.URL)+"/requests?method=PUT", &entries))
+		require.Len(t, entries, 1)
+		assert.Equal(t, http.MethodPut, entries[0].Method)
+		assert.Empty(t, entries[0].Request)
+	})
+
+	t.Run("tokens are created, listed and deleted", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.RequireToken = true
+		admin := newAdminServer(t, manager)
+
+		var created map[string]string
+		require.Equal(t, http.StatusCreated, adminPost(t, admin, "/admin/api/tokens", `{"name": "ci", "scopes": ["create"], "max_groups": 2}`, &created))
+		assert.Equal(t, "ci", created["name"])
+		require.NotEmpty(t, created["token"])
+		ws := dialWithToken(t, srv, created["token"], protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		var tokens []AdminToken
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/tokens", &tokens))
+		require.Len(t, tokens, 2)
+		assert.Equal(t, AdminToken{Name: "ci", Scopes: []Scope{ScopeCreate}, MaxGroups: 2, Groups: 1, Clients: 1}, tokens[1])
+		state, _ := manager.store.Load()
+		assert.Len(t, state.Tokens, 1, "created tokens are saved in the store")
+
+		assert.Equal(t, http.StatusBadRequest, adminPost(t, admin, "/admin/api/tokens", `{"name": "bad", "scopes": ["delete"]}`, nil))
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, admin, http.MethodDelete, "/admin/api/tokens/ci", nil))
+		assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodDelete, "/admin/api/tokens/ci", nil))
+	})
+
+	t.Run("reservations are listed and released", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		admin := newAdminServer(t, manager)
+		ws := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		var reservations []AdminReservation
+		require.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/api/reservations", &reservations))
+		require.Len(t, reservations, 1)
+		assert.Equal(t, "team-payments", reservations[0].Name)
+		assert.True(t, reservations[0].Live)
+
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, admin, http.MethodDelete, "/admin/api/reservations/team-payments", nil))
+		assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodDelete, "/admin/api/reservations/team-payments", nil))
+		state, _ := manager.store.Load()
+		assert.Empty(t, state.Reservations)
+	})
+}
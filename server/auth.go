@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"whtester/protocol"
+)
+
+// Scope is something an api token allows
+type Scope string
+
+const (
+	// ScopeCreate allows creating groups
+	ScopeCreate Scope = "create"
+	// ScopeJoin allows joining existing groups
+	ScopeJoin Scope = "join"
+	// ScopeAdmin allows managing the server
+	ScopeAdmin Scope = "admin"
+)
+
+// APIToken lets clients connect to a server which requires tokens
+type APIToken struct {
+	Name string `json:"name"`
+	// Token is only set in tokens files, it is hashed when loaded
+	Token string `json:"token,omitempty"`
+	// Hash is the hex encoded sha256 of the token
+	Hash   string  `json:"token_hash,omitempty"`
+	Scopes []Scope `json:"scopes"`
+	// MaxGroups limits the groups created with the token which exist
+	// at the same time, MaxClients limits the clients connected with
+	// the token at the same time, zero means no limit
+	MaxGroups  int `json:"max_groups,omitempty"`
+	MaxClients int `json:"max_clients,omitempty"`
+}
+
+func (t APIToken) allows(scope Scope) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// LoadTokens reads the api tokens from a JSON file, tokens given in
+// clear are hashed
+func LoadTokens(file string) ([]APIToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading tokens: %w", err)
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parsing tokens: %w", err)
+	}
+	for i, t := range tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d has no name", i)
+		}
+		if t.Token != "" {
+			tokens[i].Hash = hashToken(t.Token)
+			tokens[i].Token = ""
+		}
+		if err := tokens[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// validate checks that the token has a name, a hash and known scopes
+func (t APIToken) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("token has no name")
+	}
+	if t.Hash == "" && t.Token == "" {
+		return fmt.Errorf("token %s has neither token nor token_hash", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		if scope != ScopeCreate && scope != ScopeJoin && scope != ScopeAdmin {
+			return fmt.Errorf("token %s has unknown scope %q", t.Name, scope)
+		}
+	}
+	if t.MaxGroups < 0 || t.MaxClients < 0 {
+		return fmt.Errorf("token %s has negative limits", t.Name)
+	}
+	return nil
+}
+
+// tokenRegistry keeps the api tokens along with what they use, the
+// groups are keyed by their url
+type tokenRegistry struct {
+	tokens  map[string]APIToken
+	owners  map[string]string
+	clients map[string]int
+	sync.Mutex
+}
+
+func newTokenRegistry() *tokenRegistry {
+	return &tokenRegistry{
+		tokens:  make(map[string]APIToken),
+		owners:  make(map[string]string),
+		clients: make(map[string]int),
+	}
+}
+
+func (r *tokenRegistry) put(t APIToken) {
+	r.Lock()
+	defer r.Unlock()
+	r.tokens[t.Name] = t
+}
+
+func (r *tokenRegistry) remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.tokens, name)
+}
+
+// list returns the tokens sorted by name
+func (r *tokenRegistry) list() []APIToken {
+	r.Lock()
+	defer r.Unlock()
+	res := []APIToken{}
+	for _, t := range r.tokens {
+		res = append(res, t)
+	}
+	slices.SortFunc(res, func(a, b APIToken) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+// lookup returns the token with the secret
+func (r *tokenRegistry) lookup(secret string) (APIToken, bool) {
+	r.Lock()
+	defer r.Unlock()
+	hash := []byte(hashToken(secret))
+	for _, t := range r.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// own records that the group of the url was created with the token
+func (r *tokenRegistry) own(u string, name string) {
+	r.Lock()
+	defer r.Unlock()
+	if name != "" {
+		r.owners[u] = name
+	}
+}
+
+func (r *tokenRegistry) owner(u string) string {
+	r.Lock()
+	defer r.Unlock()
+	return r.owners[u]
+}
+
+func (r *tokenRegistry) disown(u string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.owners, u)
+}
+
+// groups returns the number of groups created with the token
+func (r *tokenRegistry) groups(name string) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, owner := range r.owners {
+		if owner == name {
+			n++
+		}
+	}
+	return n
+}
+
+// reserve takes a client slot of the token, if the token has no room
+// left it returns false along with its connected clients
+func (r *tokenRegistry) reserve(t APIToken) (int, bool) {
+	r.Lock()
+	defer r.Unlock()
+	if t.MaxClients > 0 && r.clients[t.Name] >= t.MaxClients {
+		return r.clients[t.Name], false
+	}
+	r.clients[t.Name]++
+	return 0, true
+}
+
+func (r *tokenRegistry) connected(name string, delta int) {
+	r.Lock()
+	defer r.Unlock()
+	if name == "" {
+		return
+	}
+	r.clients[name] += delta
+	if r.clients[name] <= 0 {
+		delete(r.clients, name)
+	}
+}
+
+// bearerToken returns the token of the Authorization header, or the
+// api-key header
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("api-key")
+}
+
+// authenticate returns the token of the websocket upgrade request, it
+// writes 401 and returns false if the manager requires tokens and the
+// request has no valid token
+func (m *Manager) authenticate(w http.ResponseWriter, r *http.Request) (*APIToken, bool) {
+	if !m.RequireToken {
+		return nil, true
+	}
+	token, ok := m.tokens.lookup(bearerToken(r))
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whtester"`)
+		http.Error(w, "missing or invalid api token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return &token, true
+}
+
+// authorize checks that the token allows the scope and takes a client
+// slot of the token, so that clients connecting at the same time can't
+// all pass the limit. The slot is given back with release if the client
+// doesn't join. A nil token is allowed everything
+func (m *Manager) authorize(token *APIToken, scope Scope) *protocol.Error {
+	if token == nil {
+		return nil
+	}
+	if !token.allows(scope) {
+		return &protocol.Error{Code: protocol.ErrForbidden, Message: fmt.Sprintf("api token can't %s groups", scope)}
+	}
+	if clients, ok := m.tokens.reserve(*token); !ok {
+		return &protocol.Error{Code: protocol.ErrLimitReached, Message: fmt.Sprintf("api token has %d clients connected already", clients)}
+	}
+	return nil
+}
+
+// release gives back the client slot taken by authorize
+func (m *Manager) release(token *APIToken) {
+	m.tokens.connected(tokenName(token), -1)
+}
+
+// checkGroupLimit checks that the token can create another group
+func (m *Manager) checkGroupLimit(token *APIToken) *protocol.Error {
+	if token == nil || token.MaxGroups <= 0 {
+		return nil
+	}
+	if groups := m.tokens.groups(token.Name); groups >= token.MaxGroups {
+		return &protocol.Error{Code: protocol.ErrLimitReached, Message: fmt.Sprintf("api token has %d groups already", groups)}
+	}
+	return nil
+}
+
+// AddTokens adds the api tokens, they are not saved in the store,
+// tokens given in clear are hashed
+func (m *Manager) AddTokens(tokens ...APIToken) {
+	for _, t := range tokens {
+		if t.Token != "" {
+			t.Hash = hashToken(t.Token)
+			t.Token = ""
+		}
+		m.tokens.put(t)
+	}
+}
+
+// tokenName returns the name of the token, empty for a nil token
+func tokenName(token *APIToken) string {
+	if token == nil {
+		return ""
+	}
+	return token.Name
+}
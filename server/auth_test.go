@@ -0,0 +1,185 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialWithToken connects a client speaking the control protocol with
+// the api token and sends the hello message
+func dialWithToken(t *testing.T, srv *httptest.Server, token string, hello protocol.Hello) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.Subprotocol}}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	require.NoError(t, err, "dialing server")
+	t.Cleanup(func() { ws.Close() })
+	msg := protocol.New(protocol.TypeHello)
+	msg.Hello = &hello
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+	return ws
+}
+
+func newTokenServer(t *testing.T, tokens ...APIToken) (*Manager, *httptest.Server) {
+	manager, srv := newTestServer(t)
+	manager.RequireToken = true
+	for _, token := range tokens {
+		require.NoError(t, manager.PutToken(token))
+	}
+	return manager, srv
+}
+
+func TestLoadTokens(t *testing.T) {
+	write := func(t *testing.T, data string) string {
+		file := filepath.Join(t.TempDir(), "tokens.json")
+		require.NoError(t, os.WriteFile(file, []byte(data), 0o600))
+		return file
+	}
+
+	t.Run("tokens in clear are hashed", func(t *testing.T) {
+		file := write(t, `[{"name": "ci", "token": "secret", "scopes": ["create"], "max_groups": 2}]`)
+		tokens, err := LoadTokens(file)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		assert.Empty(t, tokens[0].Token)
+		assert.Equal(t, hashToken("secret"), tokens[0].Hash)
+		assert.Equal(t, 2, tokens[0].MaxGroups)
+	})
+
+	t.Run("invalid tokens are refused", func(t *testing.T) {
+		for _, data := range []string{
+			`[{"token": "secret", "scopes": ["create"]}]`,
+			`[{"name": "ci", "scopes": ["create"]}]`,
+			`[{"name": "ci", "token": "secret", "scopes": ["delete"]}]`,
+			`{`,
+		} {
+			_, err := LoadTokens(write(t, data))
+			assert.Error(t, err, data)
+		}
+	})
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Run("clients without a valid token are refused", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate}})
+		for _, header := range []http.Header{nil, {"Authorization": {"Bearer wrong"}}} {
+			_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+			require.Error(t, err)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("token creates groups", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate}})
+		ws := dialWithToken(t, srv, "secret", protocol.Hello{})
+		assert.NotEmpty(t, readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome.URL)
+	})
+
+	t.Run("api-key header is accepted", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate}})
+		header := http.Header{"api-key": {"secret"}}
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+		require.NoError(t, err)
+		defer ws.Close()
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "password: ")
+	})
+
+	t.Run("scopes of the token are enforced", func(t *testing.T) {
+		_, srv := newTokenServer(t,
+			APIToken{Name: "owner", Token: "owner", Scopes: []Scope{ScopeCreate}},
+			APIToken{Name: "guest", Token: "guest", Scopes: []Scope{ScopeJoin}},
+		)
+		ws := dialWithToken(t, srv, "owner", protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		guest := dialWithToken(t, srv, "guest", protocol.Hello{})
+		assert.Equal(t, protocol.ErrForbidden, readProtocolMessage(t, guest, protocol.TypeError).Error.Code)
+		guest = dialWithToken(t, srv, "guest", protocol.Hello{URL: welcome.URL, Key: welcome.Key})
+		readProtocolMessage(t, guest, protocol.TypeWelcome)
+		owner := dialWithToken(t, srv, "owner", protocol.Hello{URL: welcome.URL, Key: welcome.Key})
+		assert.Equal(t, protocol.ErrForbidden, readProtocolMessage(t, owner, protocol.TypeError).Error.Code)
+	})
+
+	t.Run("legacy clients get the refusal as text", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "guest", Token: "guest", Scopes: []Scope{ScopeJoin}})
+		header := http.Header{"Authorization": {"Bearer guest"}}
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+		require.NoError(t, err)
+		defer ws.Close()
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), protocol.ErrForbidden)
+	})
+
+	t.Run("groups of a token are limited", func(t *testing.T) {
+		manager, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate}, MaxGroups: 1})
+		ws := dialWithToken(t, srv, "secret", protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		assert.Equal(t, "ci", manager.tokens.owner(welcome.URL))
+
+		second := dialWithToken(t, srv, "secret", protocol.Hello{})
+		assert.Equal(t, protocol.ErrLimitReached, readProtocolMessage(t, second, protocol.TypeError).Error.Code)
+		named := dialWithToken(t, srv, "secret", protocol.Hello{Name: "team-payments"})
+		assert.Equal(t, protocol.ErrLimitReached, readProtocolMessage(t, named, protocol.TypeError).Error.Code)
+	})
+
+	t.Run("clients of a token are limited", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate, ScopeJoin}, MaxClients: 1})
+		ws := dialWithToken(t, srv, "secret", protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		second := dialWithToken(t, srv, "secret", protocol.Hello{URL: welcome.URL, Key: welcome.Key})
+		assert.Equal(t, protocol.ErrLimitReached, readProtocolMessage(t, second, protocol.TypeError).Error.Code)
+	})
+
+	t.Run("clients connecting at the same time don't pass the limit", func(t *testing.T) {
+		manager := NewManager()
+		token := APIToken{Name: "ci", Scopes: []Scope{ScopeCreate}, MaxClients: 1}
+		// the first client hasn't joined its group yet
+		assert.Nil(t, manager.authorize(&token, ScopeCreate))
+		refused := manager.authorize(&token, ScopeCreate)
+		require.NotNil(t, refused)
+		assert.Equal(t, protocol.ErrLimitReached, refused.Code)
+		manager.release(&token)
+		assert.Nil(t, manager.authorize(&token, ScopeCreate))
+	})
+
+	t.Run("refused clients give their slot back", func(t *testing.T) {
+		_, srv := newTokenServer(t, APIToken{Name: "ci", Token: "secret", Scopes: []Scope{ScopeCreate, ScopeJoin}, MaxClients: 1})
+		ws := dialWithToken(t, srv, "secret", protocol.Hello{URL: "http://unknown.localhost", Key: "wrong"})
+		assert.Equal(t, protocol.ErrGroupNotFound, readProtocolMessage(t, ws, protocol.TypeError).Error.Code)
+
+		ws = dialWithToken(t, srv, "secret", protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+	})
+
+	t.Run("tokens and owners are restored from the store", func(t *testing.T) {
+		store := NewMemoryStore()
+		require.NoError(t, store.PutToken(APIToken{Name: "ci", Hash: hashToken("secret"), Scopes: []Scope{ScopeCreate}}))
+		require.NoError(t, store.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "secret", Owner: "ci"}))
+		manager, srv := newTestServer(t)
+		manager.RequireToken = true
+		manager.GracePeriod = time.Minute
+		require.NoError(t, manager.Restore(store))
+		assert.Equal(t, "ci", manager.tokens.owner("http://abc.localhost"))
+
+		ws := dialWithToken(t, srv, "secret", protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		require.NoError(t, manager.DeleteToken("ci"))
+		state, _ := store.Load()
+		assert.Empty(t, state.Tokens)
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"whtester/serialize"
+)
+
+// challenge is the answer of the server to a provider verifying
+// the url before it sends events
+type challenge struct {
+	provider    string
+	status      int
+	contentType string
+	body        string
+}
+
+func (c challenge) write(w http.ResponseWriter) {
+	if c.contentType != "" {
+		w.Header().Set("Content-Type", c.contentType)
+	}
+	w.WriteHeader(c.status)
+	io.WriteString(w, c.body)
+}
+
+// answerChallenge recognizes the verification requests of Slack, Meta,
+// WebSub, Twitch and Microsoft Graph and returns their answer, verifyToken
+// is checked against the verify token of Meta when it is set
+func answerChallenge(r *http.Request, verifyToken string) (challenge, bool) {
+	query := r.URL.Query()
+
+	// Microsoft Graph sends the token to echo in the query
+	if token := query.Get("validationToken"); token != "" {
+		return challenge{provider: "microsoft graph", status: http.StatusOK, contentType: "text/plain", body: token}, true
+	}
+
+	// Meta and WebSub verify the subscription with a GET
+	if r.Method == http.MethodGet && query.Has("hub.mode") {
+		switch query.Get("hub.mode") {
+		case "subscribe", "unsubscribe":
+			if verifyToken != "" && query.Get("hub.verify_token") != verifyToken {
+				return challenge{provider: "meta/websub", status: http.StatusForbidden, body: "invalid verify token"}, true
+			}
+			return challenge{provider: "meta/websub", status: http.StatusOK, contentType: "text/plain", body: query.Get("hub.challenge")}, true
+		case "denied":
+			return challenge{provider: "websub", status: http.StatusOK}, true
+		}
+	}
+
+	if r.Method != http.MethodPost || r.Body == nil {
+		return challenge{}, false
+	}
+	// bodies over the limit are not challenges, the rest of the body is
+	// kept for the encoding of the request to refuse it
+	body, _ := io.ReadAll(io.LimitReader(r.Body, serialize.MaxBodySize+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if int64(len(body)) > serialize.MaxBodySize {
+		return challenge{}, false
+	}
+	var payload struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}
+	if json.Unmarshal(body, &payload) != nil || payload.Challenge == "" {
+		return challenge{}, false
+	}
+
+	// Twitch marks the verification in a header
+	if r.Header.Get("Twitch-Eventsub-Message-Type") == "webhook_callback_verification" {
+		return challenge{provider: "twitch", status: http.StatusOK, contentType: "text/plain", body: payload.Challenge}, true
+	}
+	if payload.Type == "url_verification" {
+		return challenge{provider: "slack", status: http.StatusOK, contentType: "text/plain", body: payload.Challenge}, true
+	}
+	return challenge{}, false
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnswerChallenge(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		header      http.Header
+		body        string
+		verifyToken string
+		ok          bool
+		status      int
+		answer      string
+	}{
+		{
+			name:   "slack url verification",
+			method: http.MethodPost,
+			target: "/slack",
+			body:   `{"token": "x", "challenge": "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P", "type": "url_verification"}`,
+			ok:     true, status: http.StatusOK, answer: "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P",
+		},
+		{
+			name:   "meta subscription",
+			method: http.MethodGet,
+			target: "/meta?hub.mode=subscribe&hub.challenge=1158201444&hub.verify_token=secret",
+			ok:     true, status: http.StatusOK, answer: "1158201444",
+			verifyToken: "secret",
+		},
+		{
+			name:   "meta subscription with wrong verify token",
+			method: http.MethodGet,
+			target: "/meta?hub.mode=subscribe&hub.challenge=1158201444&hub.verify_token=wrong",
+			ok:     true, status: http.StatusForbidden, answer: "invalid verify token",
+			verifyToken: "secret",
+		},
+		{
+			name:   "websub unsubscribe",
+			method: http.MethodGet,
+			target: "/feed?hub.mode=unsubscribe&hub.topic=http://example.com/feed&hub.challenge=abc",
+			ok:     true, status: http.StatusOK, answer: "abc",
+		},
+		{
+			name:   "twitch callback verification",
+			method: http.MethodPost,
+			target: "/twitch",
+			header: http.Header{"Twitch-Eventsub-Message-Type": {"webhook_callback_verification"}},
+			body:   `{"challenge": "pogchamp-kappa-360noscope-vohiyo", "subscription": {}}`,
+			ok:     true, status: http.StatusOK, answer: "pogchamp-kappa-360noscope-vohiyo",
+		},
+		{
+			name:   "microsoft graph validation",
+			method: http.MethodPost,
+			target: "/graph?validationToken=Validation%3A+Testing+client+application+reachability",
+			ok:     true, status: http.StatusOK, answer: "Validation: Testing client application reachability",
+		},
+		{
+			name:   "regular webhook",
+			method: http.MethodPost,
+			target: "/github",
+			body:   `{"action": "opened"}`,
+		},
+		{
+			name:   "challenge field without verification",
+			method: http.MethodPost,
+			target: "/slack",
+			body:   `{"type": "event_callback", "challenge": "x"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			answer, ok := answerChallenge(r, tt.verifyToken)
+			require.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.status, answer.status)
+			assert.Equal(t, tt.answer, answer.body)
+
+			// the body is still there for the clients
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+func TestChallengeResponder(t *testing.T) {
+	t.Run("server answers challenges and notifies the clients", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.Challenges = true
+		ws, u, _ := dialTestClient(t, srv, nil)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, `{"type": "url_verification", "challenge": "abc"}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "abc", string(body))
+
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		req, err := serialize.DecodeRequest(data)
+		require.NoError(t, err)
+		reqBody, _ := io.ReadAll(req.Body)
+		assert.Contains(t, string(reqBody), "url_verification")
+	})
+
+	t.Run("challenges are answered with methods the group doesn't take", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.Challenges = true
+		manager.AllowedMethods = []string{http.MethodPost}
+		_, u, _ := dialTestClient(t, srv, nil)
+
+		resp := sendWebhook(t, srv, http.MethodGet, u+"/?hub.mode=subscribe&hub.challenge=42", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "42", string(body))
+
+		resp = sendWebhook(t, srv, http.MethodGet, u, "")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("bodies over the limit are refused", func(t *testing.T) {
+		defer func(size int64) { serialize.MaxBodySize = size }(serialize.MaxBodySize)
+		serialize.MaxBodySize = 64
+		manager, srv := newTestServer(t)
+		manager.Challenges = true
+		_, u, _ := dialTestClient(t, srv, nil)
+
+		body := `{"type": "url_verification", "challenge": "` + strings.Repeat("a", 64) + `"}`
+		resp := sendWebhook(t, srv, http.MethodPost, u, body)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("challenges are forwarded when the responder is off", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, _ := dialTestClient(t, srv, nil)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, `{"type": "url_verification", "challenge": "abc"}`)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+
+	t.Run("clients turn the responder on for their group", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		on, token := true, "secret"
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{Challenges: &on, VerifyToken: &token}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		settings := readProtocolMessage(t, ws, protocol.TypeSettings).Settings
+		assert.True(t, *settings.Challenges)
+
+		resp := sendWebhook(t, srv, http.MethodGet, welcome.URL+"/?hub.mode=subscribe&hub.challenge=42&hub.verify_token=secret", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "42", string(body))
+		readProtocolMessage(t, ws, protocol.TypeRequest)
+	})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientCloseWait is how long Drain waits for the disconnected clients
+// to be removed from their groups, so that their groups are saved
+var ClientCloseWait = time.Second
+
+// handleHealthz reports that the server is up
+func (m *Manager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz reports if the server takes new clients, it fails once
+// the server is draining so that load balancers stop sending traffic
+func (m *Manager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if m.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// acceptClients writes 503 and returns false if the server is draining,
+// clients retry and land on another instance
+func (m *Manager) acceptClients(w http.ResponseWriter) bool {
+	if m.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// Drain prepares the shutdown of the server. Readiness fails and new
+// clients are refused, the webhook requests in flight get until the
+// context is done to be delivered, then the clients are told to
+// reconnect to ReconnectURL and disconnected. It returns the error of
+// the context if requests were still in flight.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.draining.Store(true)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for err == nil && m.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("%d requests still in flight: %w", m.inflight.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	bye := protocol.Goodbye{Reason: "server going away", Reconnect: m.ReconnectURL}
+	if bye.Reconnect != "" {
+		bye.Reason = "server going away, reconnect to " + bye.Reconnect
+	}
+	m.RLock()
+	var clients []client
+	for _, g := range m.ClientList {
+		for _, c := range g.clients {
+			clients = append(clients, c)
+		}
+	}
+	m.RUnlock()
+	for _, c := range clients {
+		goodbye(c, bye, websocket.CloseGoingAway)
+	}
+
+	deadline := time.Now().Add(ClientCloseWait)
+	for m.connectedClients() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	return err
+}
+
+// connectedClients counts the clients of all the groups
+func (m *Manager) connectedClients() int {
+	m.RLock()
+	defer m.RUnlock()
+	n := 0
+	for _, g := range m.ClientList {
+		n += len(g.clients)
+	}
+	return n
+}
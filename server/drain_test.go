@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	t.Run("readiness fails and new clients are refused while draining", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		for _, path := range []string{"/healthz", "/readyz"} {
+			resp, err := http.Get(srv.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		}
+
+		require.NoError(t, manager.Drain(context.Background()))
+		resp, err := http.Get(srv.URL + "/readyz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		resp, err = http.Get(srv.URL + "/healthz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		for _, path := range []string{"/ws", "/wsold"} {
+			_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+			require.Error(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, path)
+		}
+	})
+
+	t.Run("health checks are webhook paths on the host of a group", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws, u, _ := dialTestClient(t, srv, nil)
+		for _, path := range []string{"/healthz", "/readyz"} {
+			resp := sendWebhook(t, srv, http.MethodGet, u+path, "")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode, path)
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			_, data, err := ws.ReadMessage()
+			require.NoError(t, err)
+			req, err := serialize.DecodeRequest(data)
+			require.NoError(t, err)
+			assert.Equal(t, path, req.URL.Path)
+		}
+	})
+
+	t.Run("clients are told where to reconnect", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.ReconnectURL = "wss://hooks2.example.com/ws"
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		legacy, u, _ := dialTestClient(t, srv, nil)
+		waitForClients(t, manager, groupKey(welcome.URL), 1)
+		waitForClients(t, manager, groupKey(u), 1)
+
+		require.NoError(t, manager.Drain(context.Background()))
+		bye := readProtocolMessage(t, ws, protocol.TypeGoodbye).Goodbye
+		assert.Equal(t, "wss://hooks2.example.com/ws", bye.Reconnect)
+		_, _, err := ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+
+		_, data, err := legacy.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "server going away, reconnect to wss://hooks2.example.com/ws", string(data))
+		_, _, err = legacy.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+		assert.Zero(t, manager.connectedClients())
+	})
+
+	t.Run("requests in flight are delivered before the clients are sent away", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		waitForClients(t, manager, groupKey(welcome.URL), 1)
+
+		status := make(chan int)
+		go func() {
+			resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+		drained := make(chan error)
+		go func() {
+			drained <- manager.Drain(context.Background())
+		}()
+		// the client is still connected to acknowledge the request
+		time.Sleep(50 * time.Millisecond)
+		ack := protocol.New(protocol.TypeAck)
+		ack.Ack = &protocol.Ack{ID: req.ID}
+		sendProtocolMessage(t, ws, ack)
+
+		assert.Equal(t, http.StatusAccepted, <-status)
+		assert.NoError(t, <-drained)
+		readProtocolMessage(t, ws, protocol.TypeGoodbye)
+	})
+
+	t.Run("drain gives up on requests in flight after the timeout", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		waitForClients(t, manager, groupKey(welcome.URL), 1)
+		// the sender gives up once the test is over, instead of waiting
+		// for the acknowledgement
+		sent, cancelSend := context.WithCancel(context.Background())
+		defer cancelSend()
+		go func() {
+			req, _ := http.NewRequestWithContext(sent, http.MethodPost, srv.URL, strings.NewReader("hello"))
+			req.Host = strings.TrimPrefix(welcome.URL, "http://")
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		readProtocolMessage(t, ws, protocol.TypeRequest)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := manager.Drain(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		readProtocolMessage(t, ws, protocol.TypeGoodbye)
+	})
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CompactEvery is the number of changes appended to the log of a
+// FileStore before it is compacted into the snapshot
+var CompactEvery = 1000
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "changes.log"
+)
+
+// logRecord is a change appended to the log of a FileStore, only the
+// fields of the operation are set
+type logRecord struct {
+	Op          string        `json:"op"`
+	Group       *GroupRecord  `json:"group,omitempty"`
+	URL         string        `json:"url,omitempty"`
+	Reservation *Reservation  `json:"reservation,omitempty"`
+	Token       *APIToken     `json:"token,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Entry       *HistoryEntry `json:"entry,omitempty"`
+}
+
+const (
+	opPutGroup       = "put-group"
+	opDeleteGroup    = "delete-group"
+	opPutReservation = "put-reservation"
+	opDelReservation = "delete-reservation"
+	opAddHistory     = "add-history"
+	opPutToken       = "put-token"
+	opDeleteToken    = "delete-token"
+)
+
+// FileStore keeps the state in a directory, every change is appended
+// to a log which is compacted into a snapshot on open and every
+// CompactEvery changes
+type FileStore struct {
+	dir     string
+	state   storeState
+	log     *os.File
+	changes int
+	sync.Mutex
+}
+
+// OpenFileStore opens the store in the directory, creating it if needed
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating store: %w", err)
+	}
+	s := &FileStore{dir: dir, state: newStoreState()}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("parsing snapshot: %w", err)
+		}
+		// maps missing from the snapshot are nil
+		s.state = storeState{
+			Groups:       orEmpty(s.state.Groups),
+			Reservations: orEmpty(s.state.Reservations),
+			Tokens:       orEmpty(s.state.Tokens),
+			History:      orEmpty(s.state.History),
+		}
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func orEmpty[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return make(map[string]V)
+	}
+	return m
+}
+
+// replay applies the changes of the log to the state of the snapshot,
+// only the last change may be cut short, when the server stopped while
+// writing it
+func (s *FileStore) replay() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, logFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading log: %w", err)
+	}
+	for n := 1; len(data) > 0; n++ {
+		line, rest, complete := bytes.Cut(data, []byte("\n"))
+		data = rest
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if !complete {
+				return nil
+			}
+			return fmt.Errorf("parsing change %d of the log: %w", n, err)
+		}
+		s.apply(rec)
+	}
+	return nil
+}
+
+func (s *FileStore) apply(rec logRecord) {
+	switch {
+	case rec.Op == opPutGroup && rec.Group != nil:
+		s.state.putGroup(*rec.Group)
+	case rec.Op == opDeleteGroup:
+		s.state.deleteGroup(rec.URL)
+	case rec.Op == opPutReservation && rec.Reservation != nil:
+		s.state.putReservation(*rec.Reservation)
+	case rec.Op == opDelReservation:
+		s.state.deleteReservation(rec.Name)
+	case rec.Op == opAddHistory && rec.Entry != nil:
+		s.state.addHistory(rec.URL, *rec.Entry)
+	case rec.Op == opPutToken && rec.Token != nil:
+		s.state.putToken(*rec.Token)
+	case rec.Op == opDeleteToken:
+		s.state.deleteToken(rec.Name)
+	}
+}
+
+// compact writes the state to the snapshot and starts a new log
+func (s *FileStore) compact() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFile), data); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, err = os.OpenFile(filepath.Join(s.dir, logFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening log: %w", err)
+	}
+	s.changes = 0
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file which then
+// replaces the file
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// append applies the change and appends it to the log
+func (s *FileStore) append(rec logRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.log == nil {
+		return errors.New("store is closed")
+	}
+	s.apply(rec)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("appending to log: %w", err)
+	}
+	s.changes++
+	if s.changes >= CompactEvery {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) Load() (State, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state.export(), nil
+}
+
+func (s *FileStore) PutGroup(g GroupRecord) error {
+	return s.append(logRecord{Op: opPutGroup, Group: &g})
+}
+
+func (s *FileStore) DeleteGroup(u string) error {
+	return s.append(logRecord{Op: opDeleteGroup, URL: u})
+}
+
+func (s *FileStore) PutReservation(r Reservation) error {
+	return s.append(logRecord{Op: opPutReservation, Reservation: &r})
+}
+
+func (s *FileStore) DeleteReservation(name string) error {
+	return s.append(logRecord{Op: opDelReservation, Name: name})
+}
+
+func (s *FileStore) PutToken(t APIToken) error {
+	t.Token = ""
+	return s.append(logRecord{Op: opPutToken, Token: &t})
+}
+
+func (s *FileStore) DeleteToken(name string) error {
+	return s.append(logRecord{Op: opDeleteToken, Name: name})
+}
+
+func (s *FileStore) AddHistory(u string, e HistoryEntry) error {
+	return s.append(logRecord{Op: opAddHistory, URL: u, Entry: &e})
+}
+
+// Close compacts the log into the snapshot and closes the log
+func (s *FileStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	if err := s.compact(); err != nil {
+		return err
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
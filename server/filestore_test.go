@@ -0,0 +1,107 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"whtester/serialize"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	t.Run("changes are replayed after a crash", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenFileStore(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "secret"}))
+		require.NoError(t, s.PutReservation(Reservation{Name: "team-payments"}))
+		// the store is not closed, a half written change ends the log
+		f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		f.WriteString(`{"op": "put-gr`)
+		f.Close()
+
+		s, err = OpenFileStore(dir)
+		require.NoError(t, err)
+		defer s.Close()
+		state, err := s.Load()
+		require.NoError(t, err)
+		require.Len(t, state.Groups, 1)
+		assert.Equal(t, "secret", state.Groups[0].PasswordHash)
+		assert.Len(t, state.Reservations, 1)
+
+		// the log is compacted into the snapshot on open
+		info, err := os.Stat(filepath.Join(dir, logFile))
+		require.NoError(t, err)
+		assert.Zero(t, info.Size())
+	})
+
+	t.Run("invalid change in the log is an error", func(t *testing.T) {
+		dir := t.TempDir()
+		log := []byte(`{"op": "put-group", "group": {"url": "http://abc.localhost"}}
+{"op": "put-gr
+{"op": "put-group", "group": {"url": "http://def.localhost"}}
+`)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, logFile), log, 0o600))
+
+		_, err := OpenFileStore(dir)
+		assert.ErrorContains(t, err, "change 2")
+		// the log is kept for the changes after the invalid one
+		data, err := os.ReadFile(filepath.Join(dir, logFile))
+		require.NoError(t, err)
+		assert.Equal(t, log, data)
+	})
+
+	t.Run("large changes are replayed", func(t *testing.T) {
+		defer func(size int64) { serialize.MaxBodySize = size }(serialize.MaxBodySize)
+		serialize.MaxBodySize = 1024
+		dir := t.TempDir()
+		s, err := OpenFileStore(dir)
+		require.NoError(t, err)
+		entry := HistoryEntry{ID: "1", Request: make([]byte, 2*serialize.MaxBodySize)}
+		require.NoError(t, s.AddHistory("http://abc.localhost", entry))
+		require.NoError(t, s.PutGroup(GroupRecord{URL: "http://abc.localhost"}))
+
+		s, err = OpenFileStore(dir)
+		require.NoError(t, err)
+		defer s.Close()
+		state, err := s.Load()
+		require.NoError(t, err)
+		assert.Len(t, state.Groups, 1)
+	})
+
+	t.Run("log is compacted every CompactEvery changes", func(t *testing.T) {
+		defer func(n int) { CompactEvery = n }(CompactEvery)
+		CompactEvery = 3
+		dir := t.TempDir()
+		s, err := OpenFileStore(dir)
+		require.NoError(t, err)
+		defer s.Close()
+		for _, u := range []string{"http://a.localhost", "http://b.localhost", "http://c.localhost", "http://d.localhost"} {
+			require.NoError(t, s.PutGroup(GroupRecord{URL: u}))
+		}
+		data, err := os.ReadFile(filepath.Join(dir, logFile))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "http://d.localhost")
+		assert.NotContains(t, string(data), "http://c.localhost")
+		snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+		require.NoError(t, err)
+		assert.Contains(t, string(snapshot), "http://c.localhost")
+	})
+
+	t.Run("closed store refuses changes", func(t *testing.T) {
+		s, err := OpenFileStore(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+		assert.Error(t, s.PutGroup(GroupRecord{URL: "http://abc.localhost"}))
+	})
+
+	t.Run("invalid snapshot is an error", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFile), []byte("{"), 0o600))
+		_, err := OpenFileStore(dir)
+		assert.Error(t, err)
+	})
+}
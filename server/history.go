@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"whtester/protocol"
+)
+
+// HistorySize is the number of requests remembered for every group
+var HistorySize = 100
+
+// HistoryEntry is a request received by the server for a group
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	Size       int       `json:"size"`
+	// Seq numbers the requests of the group in the order they were
+	// added to the history, starting at 1
+	Seq uint64 `json:"seq"`
+	// Request is the request encoded by serialize.EncodeRequest
+	Request []byte `json:"request,omitempty"`
+}
+
+// ringBuffer holds the latest entries, overwriting the oldest
+// entry when it is full
+type ringBuffer struct {
+	entries []HistoryEntry
+	next    int
+	full    bool
+	// seq is the sequence number of the latest entry
+	seq uint64
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{entries: make([]HistoryEntry, size)}
+}
+
+// add numbers the entry and adds it, restored entries keep their
+// number
+func (b *ringBuffer) add(e HistoryEntry) HistoryEntry {
+	if e.Seq <= b.seq {
+		e.Seq = b.seq + 1
+	}
+	b.seq = e.Seq
+	if len(b.entries) == 0 {
+		return e
+	}
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+	return e
+}
+
+// list returns the entries, oldest first
+func (b *ringBuffer) list() []HistoryEntry {
+	if !b.full {
+		return append([]HistoryEntry{}, b.entries[:b.next]...)
+	}
+	res := append([]HistoryEntry{}, b.entries[b.next:]...)
+	return append(res, b.entries[:b.next]...)
+}
+
+// historyQuery filters the entries of a group
+type historyQuery struct {
+	since  time.Time
+	after  uint64
+	method string
+	limit  int
+}
+
+// historyStore keeps the request history of every group, keyed
+// by the id of the group
+type historyStore struct {
+	groups map[string]*ringBuffer
+	size   int
+	sync.RWMutex
+}
+
+func newHistoryStore(size int) *historyStore {
+	return &historyStore{
+		groups: make(map[string]*ringBuffer),
+		size:   size,
+	}
+}
+
+// add adds the entry to the history of the group and returns it
+// with its sequence number
+func (s *historyStore) add(group string, e HistoryEntry) HistoryEntry {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.groups[group]
+	if !ok {
+		b = newRingBuffer(s.size)
+		s.groups[group] = b
+	}
+	return b.add(e)
+}
+
+// query returns the entries of the group matching q, oldest first, if
+// there are more than q.limit entries only the latest are returned
+func (s *historyStore) query(group string, q historyQuery) []HistoryEntry {
+	s.RLock()
+	defer s.RUnlock()
+	res := []HistoryEntry{}
+	b, ok := s.groups[group]
+	if !ok {
+		return res
+	}
+	for _, e := range b.list() {
+		if !q.since.IsZero() && !e.ReceivedAt.After(q.since) {
+			continue
+		}
+		if e.Seq <= q.after {
+			continue
+		}
+		if q.method != "" && !strings.EqualFold(q.method, e.Method) {
+			continue
+		}
+		res = append(res, e)
+	}
+	if q.limit > 0 && len(res) > q.limit {
+		res = res[len(res)-q.limit:]
+	}
+	return res
+}
+
+func (s *historyStore) get(group string, id string) (HistoryEntry, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.groups[group]
+	if !ok {
+		return HistoryEntry{}, false
+	}
+	for _, e := range b.list() {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func (s *historyStore) remove(group string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.groups, group)
+}
+
+// parseHistoryQuery reads the since, after, method and limit query
+// parameters
+func parseHistoryQuery(r *http.Request) (historyQuery, error) {
+	var q historyQuery
+	var err error
+	values := r.URL.Query()
+	if since := values.Get("since"); since != "" {
+		q.since, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return q, err
+		}
+	}
+	if after := values.Get("after"); after != "" {
+		q.after, err = strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return q, err
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		q.limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+	}
+	q.method = values.Get("method")
+	return q, nil
+}
+
+// authorizeGroup checks that the group exists and that the request
+// carries the password of the group in the key header
+func (m *Manager) authorizeGroup(w http.ResponseWriter, r *http.Request, group string) bool {
+	m.RLock()
+	g, ok := m.ClientList[group]
+	m.RUnlock()
+	if !ok {
+		http.Error(w, "group does not exist", http.StatusNotFound)
+		return false
+	}
+	refused := m.checkJoin(remoteIP(r.RemoteAddr), g.url, r.Header.Get("key"))
+	switch {
+	case refused == nil:
+		return true
+	case refused.Code == protocol.ErrTooManyAttempts:
+		wait := m.lockout.locked(time.Now(), "ip:"+remoteIP(r.RemoteAddr), "group:"+g.url)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, refused.Message, http.StatusTooManyRequests)
+	default:
+		http.Error(w, refused.Message, http.StatusUnauthorized)
+	}
+	return false
+}
+
+// HandleListRequests lists the requests received for a group
+func (m *Manager) HandleListRequests(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("id")
+	if !m.authorizeGroup(w, r, group) {
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := m.history.query(group, q)
+	// the list only holds the metadata of the requests
+	for i := range entries {
+		entries[i].Request = nil
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// HandleGetRequest returns a request received for a group
+func (m *Manager) HandleGetRequest(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("id")
+	if !m.authorizeGroup(w, r, group) {
+		return
+	}
+	entry, ok := m.history.get(group, r.PathValue("reqid"))
+	if !ok {
+		http.Error(w, "request does not exist", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"whtester/serialize"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBuffer(t *testing.T) {
+	t.Run("keeps only the latest entries, oldest first", func(t *testing.T) {
+		b := newRingBuffer(3)
+		for i := 0; i < 5; i++ {
+			b.add(HistoryEntry{ID: fmt.Sprint(i)})
+		}
+		var ids []string
+		for _, e := range b.list() {
+			ids = append(ids, e.ID)
+		}
+		assert.Equal(t, []string{"2", "3", "4"}, ids)
+	})
+}
+
+func TestHistoryStore(t *testing.T) {
+	s := newHistoryStore(10)
+	start := time.Now()
+	s.add("group", HistoryEntry{ID: "1", Method: "POST", ReceivedAt: start})
+	s.add("group", HistoryEntry{ID: "2", Method: "GET", ReceivedAt: start.Add(time.Second)})
+	s.add("group", HistoryEntry{ID: "3", Method: "POST", ReceivedAt: start.Add(2 * time.Second)})
+
+	ids := func(entries []HistoryEntry) []string {
+		res := []string{}
+		for _, e := range entries {
+			res = append(res, e.ID)
+		}
+		return res
+	}
+
+	t.Run("filters by method", func(t *testing.T) {
+		got := s.query("group", historyQuery{method: "post"})
+		assert.Equal(t, []string{"1", "3"}, ids(got))
+	})
+
+	t.Run("filters by receive time", func(t *testing.T) {
+		got := s.query("group", historyQuery{since: start})
+		assert.Equal(t, []string{"2", "3"}, ids(got))
+	})
+
+	t.Run("filters by sequence number", func(t *testing.T) {
+		got := s.query("group", historyQuery{after: 1})
+		assert.Equal(t, []string{"2", "3"}, ids(got))
+	})
+
+	t.Run("limit keeps the latest entries", func(t *testing.T) {
+		got := s.query("group", historyQuery{limit: 1})
+		assert.Equal(t, []string{"3"}, ids(got))
+	})
+
+	t.Run("unknown group has no entries", func(t *testing.T) {
+		assert.Empty(t, s.query("unknown", historyQuery{}))
+	})
+
+	t.Run("entries are numbered in the order they are added", func(t *testing.T) {
+		s := newHistoryStore(2)
+		assert.Equal(t, uint64(5), s.add("group", HistoryEntry{ID: "restored", Seq: 5}).Seq)
+		assert.Equal(t, uint64(6), s.add("group", HistoryEntry{ID: "a"}).Seq)
+		assert.Equal(t, uint64(7), s.add("group", HistoryEntry{ID: "b", Seq: 1}).Seq)
+		assert.Equal(t, uint64(1), s.add("other", HistoryEntry{ID: "c"}).Seq)
+	})
+}
+
+func TestHistoryAPI(t *testing.T) {
+	_, srv := newTestServer(t)
+	_, u, key := dialTestClient(t, srv, nil)
+	group := groupKey(u)
+
+	resp := sendWebhook(t, srv, http.MethodPost, u, "first")
+	resp.Body.Close()
+	resp = sendWebhook(t, srv, http.MethodPost, u, "second")
+	resp.Body.Close()
+
+	get := func(t *testing.T, path string, key string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("key", key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("lists the requests of the group", func(t *testing.T) {
+		resp := get(t, "/api/groups/"+group+"/requests", key)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var entries []HistoryEntry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+		require.Len(t, entries, 2)
+		assert.Equal(t, http.MethodPost, entries[0].Method)
+		assert.Nil(t, entries[0].Request)
+	})
+
+	t.Run("fetches a single request", func(t *testing.T) {
+		resp := get(t, "/api/groups/"+group+"/requests?limit=1", key)
+		var entries []HistoryEntry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+		require.Len(t, entries, 1)
+
+		resp = get(t, "/api/groups/"+group+"/requests/"+entries[0].ID, key)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var entry HistoryEntry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&entry))
+		req, err := serialize.DecodeRequest(entry.Request)
+		require.NoError(t, err)
+		body := make([]byte, 6)
+		n, _ := req.Body.Read(body)
+		assert.Equal(t, "second", string(body[:n]))
+	})
+
+	t.Run("rejects invalid password", func(t *testing.T) {
+		resp := get(t, "/api/groups/"+group+"/requests", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("unknown group is not found", func(t *testing.T) {
+		resp := get(t, "/api/groups/unknown/requests", key)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("rejects invalid query", func(t *testing.T) {
+		resp := get(t, "/api/groups/"+group+"/requests?limit=abc", key)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestHistoryAPIPathOnGroupHost(t *testing.T) {
+	_, srv := newTestServer(t)
+	ws, u, _ := dialTestClient(t, srv, nil)
+
+	resp := sendWebhook(t, srv, http.MethodGet, u+"/api/groups/"+groupKey(u)+"/requests", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	req, err := serialize.DecodeRequest(data)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/groups/"+groupKey(u)+"/requests", req.URL.Path)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDCharset holds the characters of the random ids, they are valid in
+// subdomains and paths
+const IDCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// maxIDAttempts is how many ids are generated for a new group before
+// the server gives up finding one which is not in use
+const maxIDAttempts = 10
+
+// errNoFreeID is returned when every generated id was in use
+var errNoFreeID = errors.New("no free id for a new group, try again")
+
+// IDGenerator generates the ids of the urls of new groups, the ids are
+// used as subdomains so they must be valid DNS labels
+type IDGenerator interface {
+	NewID() (string, error)
+	// Entropy is the number of random bits in an id
+	Entropy() float64
+}
+
+// RandomIDs generates ids of Length characters drawn uniformly from
+// Charset, IDCharset when empty
+type RandomIDs struct {
+	Length  int
+	Charset string
+}
+
+func (g RandomIDs) charset() string {
+	if g.Charset == "" {
+		return IDCharset
+	}
+	return g.Charset
+}
+
+func (g RandomIDs) NewID() (string, error) {
+	return randomString(g.charset(), g.Length)
+}
+
+func (g RandomIDs) Entropy() float64 {
+	return float64(g.Length) * math.Log2(float64(len(g.charset())))
+}
+
+// UUIDs generates random (version 4) UUIDs
+type UUIDs struct{}
+
+func (UUIDs) NewID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func (UUIDs) Entropy() float64 {
+	return 122
+}
+
+// crockford is the base32 alphabet of ULIDs, lower cased for subdomains
+const crockford = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// ULIDs generates ULIDs, which sort by their creation time
+type ULIDs struct{}
+
+func (ULIDs) NewID() (string, error) {
+	// 48 bits of milliseconds followed by 80 random bits
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(data[6:]); err != nil {
+		return "", err
+	}
+	// 26 characters of 5 bits, the first holds the 3 leading bits
+	hi := binary.BigEndian.Uint64(data[:8])
+	lo := binary.BigEndian.Uint64(data[8:])
+	id := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id), nil
+}
+
+func (ULIDs) Entropy() float64 {
+	return 80
+}
+
+// WordIDs generates ids of Words words joined by dashes, e.g.
+// "brave-otter-lime"
+type WordIDs struct {
+	Words int
+}
+
+func (g WordIDs) NewID() (string, error) {
+	words := make([]string, g.Words)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(wordList))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = wordList[n.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+func (g WordIDs) Entropy() float64 {
+	return float64(g.Words) * math.Log2(float64(len(wordList)))
+}
+
+// NewIDGenerator returns the generator of the kind, which is random,
+// uuid, ulid or words. Length is the number of characters of random ids
+// and the number of words of words ids, it is ignored otherwise. A zero
+// length gives 8 characters or 4 words.
+func NewIDGenerator(kind string, length int) (IDGenerator, error) {
+	switch kind {
+	case "random":
+		if length == 0 {
+			length = 8
+		}
+		// ids are at most 63 characters in a subdomain
+		if length < 4 || length > 63 {
+			return nil, fmt.Errorf("random ids are 4 to 63 characters, got %d", length)
+		}
+		return RandomIDs{Length: length}, nil
+	case "uuid":
+		return UUIDs{}, nil
+	case "ulid":
+		return ULIDs{}, nil
+	case "words":
+		if length == 0 {
+			length = 4
+		}
+		// the longest words take 8 characters and a dash
+		if length < 2 || length > 7 {
+			return nil, fmt.Errorf("words ids are 2 to 7 words, got %d", length)
+		}
+		return WordIDs{Words: length}, nil
+	}
+	return nil, fmt.Errorf("unknown id kind %q, expected random, uuid, ulid or words", kind)
+}
+
+// newID returns an id which is not used by a group, a reservation or
+// the blocklist. The caller must hold the lock of the manager.
+func (m *Manager) newID() (string, error) {
+	for range maxIDAttempts {
+		id, err := m.IDs.NewID()
+		if err != nil {
+			return "", fmt.Errorf("generating id: %w", err)
+		}
+		if m.idInUse(id) {
+			continue
+		}
+		return id, nil
+	}
+	return "", errNoFreeID
+}
+
+// idInUse reports if the id belongs to a group, including groups kept
+// for their grace period, or can't be handed out. The caller must hold
+// the lock of the manager.
+func (m *Manager) idInUse(id string) bool {
+	if _, ok := m.ClientList[id]; ok {
+		return true
+	}
+	for u := range m.Passwords {
+		if groupKey(u) == id {
+			return true
+		}
+	}
+	for _, name := range m.Blocklist {
+		if name == id {
+			return true
+		}
+	}
+	_, reserved := m.reservations.get(id)
+	return reserved
+}
+
+// wordList holds the words of words ids, 256 short words so that every
+// word adds 8 bits
+var wordList = [256]string{
+	"acorn", "agate", "alder", "amber", "anchor", "apple", "arch", "aspen",
+	"atlas", "aurora", "badge", "baker", "bamboo", "banjo", "basil", "beach",
+	"beacon", "bean", "bear", "berry", "birch", "bison", "blaze", "bloom",
+	"board", "bolt", "brave", "breeze", "brick", "brook", "cabin", "cactus",
+	"camel", "candle", "canoe", "canyon", "cedar", "chalk", "cherry", "chess",
+	"cider", "clay", "cliff", "clover", "cobalt", "comet", "coral", "cosmos",
+	"cotton", "crane", "creek", "crisp", "crown", "cube", "daisy", "dawn",
+	"delta", "desert", "dingo", "dove", "dream", "dune", "eagle", "echo",
+	"elm", "ember", "falcon", "fern", "fig", "finch", "fjord", "flame",
+	"flint", "flute", "forest", "fox", "frost", "galaxy", "garnet", "gecko",
+	"ginger", "glade", "glow", "granite", "grape", "grove", "gull", "harbor",
+	"hazel", "heron", "hill", "honey", "horizon", "husky", "iris", "island",
+	"ivory", "ivy", "jade", "jasper", "jelly", "jungle", "juniper", "kayak",
+	"kelp", "kettle", "kiwi", "koala", "lagoon", "lake", "lantern", "larch",
+	"lark", "lava", "lemon", "lilac", "lily", "lime", "linen", "lotus",
+	"lunar", "lynx", "maple", "marble", "meadow", "melon", "mesa", "meteor",
+	"mint", "mist", "moon", "moose", "moss", "nectar", "nest", "noble",
+	"north", "nova", "oak", "oasis", "ocean", "olive", "onyx", "opal",
+	"orbit", "orchid", "otter", "owl", "palm", "panda", "paper", "peach",
+	"pearl", "pebble", "pepper", "pine", "pixel", "planet", "plum", "polar",
+	"pond", "poppy", "prairie", "prism", "puffin", "quail", "quartz", "quiet",
+	"rain", "raven", "reef", "ridge", "river", "robin", "rocket", "rose",
+	"ruby", "sage", "salmon", "sand", "sapphire", "scout", "shell", "shore",
+	"silver", "sky", "slate", "snow", "solar", "sparrow", "spruce", "star",
+	"stone", "storm", "sugar", "summit", "sun", "swan", "swift", "tango",
+	"tea", "thistle", "thunder", "tide", "tiger", "timber", "topaz", "trail",
+	"tulip", "tundra", "twig", "valley", "velvet", "violet", "vista", "walnut",
+	"wave", "willow", "wind", "winter", "wolf", "wren", "yak", "yarrow",
+	"zebra", "zenith", "zephyr", "zinc", "bright", "calm", "clever", "cozy",
+	"eager", "gentle", "happy", "jolly", "keen", "lucky", "merry", "mellow",
+	"nimble", "proud", "rapid", "rustic", "sunny", "tidy", "vivid", "witty",
+	"bold", "fancy", "fresh", "golden", "quick", "royal", "sleek", "wild",
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"whtester/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedIDs hands out the ids in order
+type fixedIDs struct {
+	ids []string
+}
+
+func (g *fixedIDs) NewID() (string, error) {
+	id := g.ids[0]
+	if len(g.ids) > 1 {
+		g.ids = g.ids[1:]
+	}
+	return id, nil
+}
+
+func (g *fixedIDs) Entropy() float64 {
+	return 0
+}
+
+func TestIDGenerators(t *testing.T) {
+	t.Run("random ids use the whole charset", func(t *testing.T) {
+		seen := make(map[rune]bool)
+		g := RandomIDs{Length: 8}
+		for range 500 {
+			id, err := g.NewID()
+			require.NoError(t, err)
+			require.Len(t, id, 8)
+			for _, c := range id {
+				seen[c] = true
+			}
+		}
+		assert.Len(t, seen, len(IDCharset))
+		assert.InDelta(t, 41.4, g.Entropy(), 0.1)
+	})
+
+	t.Run("random strings longer than the charset", func(t *testing.T) {
+		assert.Len(t, GenerateRandomString(64), 64)
+	})
+
+	t.Run("ids are valid names", func(t *testing.T) {
+		for _, kind := range []string{"random", "uuid", "ulid", "words"} {
+			g, err := NewIDGenerator(kind, 0)
+			require.NoError(t, err)
+			id, err := g.NewID()
+			require.NoError(t, err)
+			assert.Regexp(t, `^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`, id, kind)
+		}
+	})
+
+	t.Run("ulids sort by creation time", func(t *testing.T) {
+		first, _ := ULIDs{}.NewID()
+		assert.Len(t, first, 26)
+		second, _ := ULIDs{}.NewID()
+		assert.LessOrEqual(t, first[:10], second[:10])
+	})
+
+	t.Run("words ids have the number of words", func(t *testing.T) {
+		id, err := WordIDs{Words: 7}.NewID()
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(id, "-"), 7)
+		assert.LessOrEqual(t, len(id), 63)
+	})
+
+	t.Run("word list has distinct words", func(t *testing.T) {
+		seen := make(map[string]bool)
+		for _, w := range wordList {
+			assert.Regexp(t, `^[a-z]{2,8}$`, w)
+			assert.False(t, seen[w], "duplicate word %s", w)
+			seen[w] = true
+		}
+	})
+
+	t.Run("invalid kinds and lengths are refused", func(t *testing.T) {
+		for _, c := range []struct {
+			kind   string
+			length int
+		}{{"random", 3}, {"random", 64}, {"words", 1}, {"words", 8}, {"serial", 0}} {
+			_, err := NewIDGenerator(c.kind, c.length)
+			assert.Error(t, err, "%s %d", c.kind, c.length)
+		}
+	})
+}
+
+func TestNewID(t *testing.T) {
+	t.Run("skips ids in use", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		// www is blocklisted, first is taken by the first group and
+		// second is reserved
+		manager.IDs = &fixedIDs{ids: []string{"www", "first", "first", "second", "third"}}
+		manager.reservations.add(Reservation{Name: "second"})
+
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		assert.Equal(t, "http://first.localhost", readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome.URL)
+		ws = dialProtocolClient(t, srv, protocol.Hello{})
+		assert.Equal(t, "http://third.localhost", readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome.URL)
+	})
+
+	t.Run("gives up when every id is in use", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.IDs = &fixedIDs{ids: []string{"first"}}
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		ws = dialProtocolClient(t, srv, protocol.Hello{})
+		refused := readProtocolMessage(t, ws, protocol.TypeError).Error
+		assert.Equal(t, protocol.ErrUnavailable, refused.Code)
+	})
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"whtester/protocol"
+)
+
+var (
+	// InviteTTL is how long invites last when the client doesn't say,
+	// MaxInviteTTL is the longest they can last
+	InviteTTL    = 24 * time.Hour
+	MaxInviteTTL = 7 * 24 * time.Hour
+	// MaxInvites bounds the outstanding invites of a group
+	MaxInvites = 20
+)
+
+// Invite lets clients join a group without its password, with the role
+// of the invite. Invite codes are of the form <id>.<secret>, the server
+// only keeps the hash of the secret.
+type Invite struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// SecretHash is the hex encoded sha256 of the secret of the code
+	SecretHash string        `json:"secret_hash"`
+	Role       protocol.Role `json:"role"`
+	MaxUses    int           `json:"max_uses"`
+	Uses       int           `json:"uses"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ExpiresAt  time.Time     `json:"expires_at"`
+}
+
+// valid reports if clients can still join with the invite
+func (inv Invite) valid(now time.Time) bool {
+	return now.Before(inv.ExpiresAt) && inv.Uses < inv.MaxUses
+}
+
+// message returns the invite as sent to the clients, without its code
+func (inv Invite) message() protocol.Invite {
+	return protocol.Invite{
+		ID:        inv.ID,
+		Role:      inv.Role,
+		ExpiresAt: inv.ExpiresAt,
+		MaxUses:   inv.MaxUses,
+		Uses:      inv.Uses,
+	}
+}
+
+// invites holds the outstanding invites, keyed by their id
+type invites struct {
+	byID map[string]Invite
+	sync.Mutex
+}
+
+func newInvites() *invites {
+	return &invites{byID: make(map[string]Invite)}
+}
+
+func (r *invites) add(inv Invite) {
+	r.Lock()
+	defer r.Unlock()
+	r.byID[inv.ID] = inv
+}
+
+// group returns the outstanding invites of the group of the url, oldest
+// first, expired invites are forgotten
+func (r *invites) group(u string, now time.Time) []Invite {
+	r.Lock()
+	defer r.Unlock()
+	var res []Invite
+	for id, inv := range r.byID {
+		if !inv.valid(now) {
+			delete(r.byID, id)
+			continue
+		}
+		if inv.URL == u {
+			res = append(res, inv)
+		}
+	}
+	slices.SortFunc(res, func(a, b Invite) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return res
+}
+
+// revoke forgets the invite to the group of the url, it reports if the
+// invite existed
+func (r *invites) revoke(u string, id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	inv, ok := r.byID[id]
+	if !ok || inv.URL != u {
+		return false
+	}
+	delete(r.byID, id)
+	return true
+}
+
+// removeGroup forgets the invites to the group of the url
+func (r *invites) removeGroup(u string) {
+	r.Lock()
+	defer r.Unlock()
+	for id, inv := range r.byID {
+		if inv.URL == u {
+			delete(r.byID, id)
+		}
+	}
+}
+
+// use checks the invite code and counts one use of the invite, invites
+// are forgotten once they are used up
+func (r *invites) use(code string, now time.Time) (Invite, bool) {
+	id, secret, ok := strings.Cut(code, ".")
+	if !ok {
+		return Invite{}, false
+	}
+	r.Lock()
+	defer r.Unlock()
+	inv, ok := r.byID[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(inv.SecretHash)) != 1 {
+		return Invite{}, false
+	}
+	if !inv.valid(now) {
+		delete(r.byID, id)
+		return Invite{}, false
+	}
+	inv.Uses++
+	r.byID[id] = inv
+	if inv.Uses >= inv.MaxUses {
+		delete(r.byID, id)
+	}
+	return inv, true
+}
+
+// newInvite checks the invite asked for by the client and returns it
+// along with its code
+func newInvite(c *client, req *protocol.Invite, now time.Time) (Invite, string, *protocol.Error) {
+	inv := Invite{
+		ID:        GenerateRandomString(8),
+		URL:       c.url,
+		Role:      req.Role,
+		MaxUses:   req.MaxUses,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InviteTTL),
+	}
+	if inv.Role == "" {
+		inv.Role = c.role
+	}
+	switch {
+	case inv.Role != protocol.RoleForwarder && inv.Role != protocol.RoleObserver:
+		return Invite{}, "", &protocol.Error{Code: protocol.ErrInvalidInvite, Message: fmt.Sprintf("unknown role %q", inv.Role)}
+	case inv.Role == protocol.RoleForwarder && c.role == protocol.RoleObserver:
+		return Invite{}, "", &protocol.Error{Code: protocol.ErrForbidden, Message: "observers can only invite observers"}
+	}
+	if inv.MaxUses == 0 {
+		inv.MaxUses = 1
+	}
+	if inv.MaxUses < 0 {
+		return Invite{}, "", &protocol.Error{Code: protocol.ErrInvalidInvite, Message: "max uses must be positive"}
+	}
+	if req.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > MaxInviteTTL {
+			return Invite{}, "", &protocol.Error{
+				Code:    protocol.ErrInvalidInvite,
+				Message: fmt.Sprintf("invites expire in a duration up to %s, got %q", MaxInviteTTL, req.ExpiresIn),
+			}
+		}
+		inv.ExpiresAt = now.Add(ttl)
+	}
+	secret := GenerateRandomString(24)
+	inv.SecretHash = hashToken(secret)
+	return inv, inv.ID + "." + secret, nil
+}
+
+// sendError sends the error to the client without closing the connection
+func sendError(c *client, refused *protocol.Error) {
+	msg := protocol.New(protocol.TypeError)
+	msg.Error = refused
+	c.sendMessage(msg)
+}
+
+// handleInvite creates an invite to the group of the client and sends
+// it back along with its code
+func (m *Manager) handleInvite(c *client, req *protocol.Invite) {
+	now := time.Now()
+	inv, code, refused := newInvite(c, req, now)
+	if refused != nil {
+		sendError(c, refused)
+		return
+	}
+	m.Lock()
+	if _, ok := m.ClientList[groupKey(c.url)]; !ok {
+		m.Unlock()
+		return
+	}
+	if len(m.invites.group(c.url, now)) >= MaxInvites {
+		m.Unlock()
+		sendError(c, &protocol.Error{
+			Code:    protocol.ErrLimitReached,
+			Message: fmt.Sprintf("groups have up to %d outstanding invites", MaxInvites),
+		})
+		return
+	}
+	m.invites.add(inv)
+	m.saveGroup(c.url)
+	m.Unlock()
+	fmt.Printf("\nnew %s invite %s for %s", inv.Role, inv.ID, groupKey(c.url))
+
+	msg := protocol.New(protocol.TypeInvite)
+	created := inv.message()
+	created.Code = code
+	msg.Invite = &created
+	c.sendMessage(msg)
+}
+
+// sendInvites sends the outstanding invites of the group to the client
+func (m *Manager) sendInvites(c *client) {
+	msg := protocol.New(protocol.TypeInvites)
+	msg.Invites = &protocol.InviteList{Invites: []protocol.Invite{}}
+	for _, inv := range m.invites.group(c.url, time.Now()) {
+		msg.Invites.Invites = append(msg.Invites.Invites, inv.message())
+	}
+	c.sendMessage(msg)
+}
+
+// handleRevoke revokes the invite to the group of the client and sends
+// the outstanding invites back
+func (m *Manager) handleRevoke(c *client, revoke *protocol.Revoke) {
+	m.Lock()
+	revoked := m.invites.revoke(c.url, revoke.ID)
+	if revoked {
+		m.saveGroup(c.url)
+	}
+	m.Unlock()
+	if !revoked {
+		sendError(c, &protocol.Error{Code: protocol.ErrInvalidInvite, Message: fmt.Sprintf("no invite %q", revoke.ID)})
+		return
+	}
+	fmt.Printf("\nrevoked invite %s for %s", revoke.ID, groupKey(c.url))
+	m.sendInvites(c)
+}
+
+// joinInvite checks the invite code for a client from the ip and returns
+// the url and role of the invite. Wrong codes count against the ip like
+// wrong passwords.
+func (m *Manager) joinInvite(ip string, code string) (string, protocol.Role, *protocol.Error) {
+	now := time.Now()
+	ipKey := "ip:" + ip
+	if wait := m.lockout.locked(now, ipKey); wait > 0 {
+		return "", "", tooManyAttempts(wait)
+	}
+	inv, ok := m.invites.use(code, now)
+	if !ok {
+		m.lockout.fail(now, ipKey)
+		return "", "", &protocol.Error{Code: protocol.ErrInvalidInvite, Message: "invite is unknown, expired, revoked or used up"}
+	}
+	m.lockout.succeed(ipKey)
+	m.RLock()
+	_, ok = m.ClientList[groupKey(inv.URL)]
+	m.RUnlock()
+	if !ok {
+		return "", "", &protocol.Error{Code: protocol.ErrGroupNotFound, Message: "group does not exist"}
+	}
+	return inv.URL, inv.Role, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendProtocolMessage writes the control message to the connection
+func sendProtocolMessage(t testing.TB, ws *websocket.Conn, msg protocol.Message) {
+	t.Helper()
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+}
+
+// createInvite asks the server for an invite to the group of the client
+func createInvite(t testing.TB, ws *websocket.Conn, req protocol.Invite) protocol.Message {
+	t.Helper()
+	msg := protocol.New(protocol.TypeInvite)
+	msg.Invite = &req
+	sendProtocolMessage(t, ws, msg)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	reply, err := protocol.Decode(data)
+	require.NoError(t, err)
+	return reply
+}
+
+func TestInvites(t *testing.T) {
+	t.Run("invite joins the group without the password", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, owner, protocol.TypeWelcome).Welcome
+		invite := createInvite(t, owner, protocol.Invite{}).Invite
+		require.NotNil(t, invite)
+		assert.NotEmpty(t, invite.Code)
+		assert.Equal(t, protocol.RoleForwarder, invite.Role)
+		assert.Equal(t, 1, invite.MaxUses)
+
+		member := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		joined := readProtocolMessage(t, member, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, joined.URL)
+		assert.Empty(t, joined.Key)
+		assert.Equal(t, protocol.RoleForwarder, joined.Role)
+
+		// the invite is used up
+		again := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		assert.Equal(t, protocol.ErrInvalidInvite, readProtocolMessage(t, again, protocol.TypeError).Error.Code)
+	})
+
+	t.Run("observers get requests but don't handle them", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, owner, protocol.TypeWelcome).Welcome
+		invite := createInvite(t, owner, protocol.Invite{Role: protocol.RoleObserver, MaxUses: 2}).Invite
+		observer := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		assert.Equal(t, protocol.RoleObserver, readProtocolMessage(t, observer, protocol.TypeWelcome).Welcome.Role)
+		waitForClients(t, manager, groupKey(welcome.URL), 2)
+
+		// observers can't change settings nor invite forwarders
+		settings := protocol.New(protocol.TypeSettings)
+		settings.Settings = &protocol.Settings{Methods: []string{"POST"}}
+		sendProtocolMessage(t, observer, settings)
+		assert.Equal(t, protocol.ErrForbidden, readProtocolMessage(t, observer, protocol.TypeError).Error.Code)
+		refused := createInvite(t, observer, protocol.Invite{Role: protocol.RoleForwarder})
+		assert.Equal(t, protocol.ErrForbidden, refused.Error.Code)
+
+		// the ack of the observer doesn't count, the sender waits for
+		// the forwarder
+		go func() {
+			req := readProtocolMessage(t, observer, protocol.TypeRequest).Request
+			ack := protocol.New(protocol.TypeAck)
+			ack.Ack = &protocol.Ack{ID: req.ID, Error: "observer"}
+			observer.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+			time.Sleep(50 * time.Millisecond)
+			req = readProtocolMessage(t, owner, protocol.TypeRequest).Request
+			ack.Ack = &protocol.Ack{ID: req.ID}
+			owner.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+		}()
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+
+	t.Run("members list and revoke invites", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, owner, protocol.TypeWelcome)
+		first := createInvite(t, owner, protocol.Invite{ExpiresIn: "1h"}).Invite
+		second := createInvite(t, owner, protocol.Invite{MaxUses: 5}).Invite
+
+		list := protocol.New(protocol.TypeInvites)
+		list.Invites = &protocol.InviteList{}
+		sendProtocolMessage(t, owner, list)
+		invites := readProtocolMessage(t, owner, protocol.TypeInvites).Invites.Invites
+		require.Len(t, invites, 2)
+		assert.Equal(t, first.ID, invites[0].ID)
+		assert.Empty(t, invites[0].Code)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), invites[0].ExpiresAt, time.Minute)
+
+		revoke := protocol.New(protocol.TypeRevokeInvite)
+		revoke.Revoke = &protocol.Revoke{ID: first.ID}
+		sendProtocolMessage(t, owner, revoke)
+		invites = readProtocolMessage(t, owner, protocol.TypeInvites).Invites.Invites
+		require.Len(t, invites, 1)
+		assert.Equal(t, second.ID, invites[0].ID)
+
+		revoked := dialProtocolClient(t, srv, protocol.Hello{Invite: first.Code})
+		assert.Equal(t, protocol.ErrInvalidInvite, readProtocolMessage(t, revoked, protocol.TypeError).Error.Code)
+	})
+
+	t.Run("invalid invites are refused", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, owner, protocol.TypeWelcome)
+		for _, req := range []protocol.Invite{
+			{Role: "admin"},
+			{ExpiresIn: "30d"},
+			{ExpiresIn: "-1h"},
+			{MaxUses: -1},
+		} {
+			reply := createInvite(t, owner, req)
+			require.NotNil(t, reply.Error, "%+v", req)
+			assert.Equal(t, protocol.ErrInvalidInvite, reply.Error.Code)
+		}
+	})
+
+	t.Run("invitees resume their session with their role", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, owner, protocol.TypeWelcome)
+		invite := createInvite(t, owner, protocol.Invite{Role: protocol.RoleObserver}).Invite
+		observer := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		joined := readProtocolMessage(t, observer, protocol.TypeWelcome).Welcome
+		observer.Close()
+
+		again := dialProtocolClient(t, srv, protocol.Hello{URL: joined.URL, Session: joined.Session})
+		resumed := readProtocolMessage(t, again, protocol.TypeWelcome).Welcome
+		assert.Equal(t, joined.URL, resumed.URL)
+		assert.Equal(t, protocol.RoleObserver, resumed.Role)
+	})
+
+	t.Run("observers resume as observers on the legacy endpoint", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, owner, protocol.TypeWelcome).Welcome
+		invite := createInvite(t, owner, protocol.Invite{Role: protocol.RoleObserver}).Invite
+		observer := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		joined := readProtocolMessage(t, observer, protocol.TypeWelcome).Welcome
+		observer.Close()
+		waitForClients(t, manager, groupKey(welcome.URL), 1)
+
+		header := make(http.Header)
+		header.Set("session", joined.Session)
+		header.Set("relay", "true")
+		_, handshake := dialTestClientHandshake(t, srv, header)
+		assert.True(t, strings.HasPrefix(handshake, welcome.URL+"\n"), handshake)
+		waitForClients(t, manager, groupKey(welcome.URL), 2)
+
+		manager.RLock()
+		defer manager.RUnlock()
+		for _, c := range manager.ClientList[groupKey(welcome.URL)].clients {
+			if c.session == joined.Session {
+				assert.Equal(t, protocol.RoleObserver, c.role)
+				assert.False(t, c.relay)
+			} else {
+				assert.Equal(t, protocol.RoleForwarder, c.role)
+			}
+		}
+	})
+
+	t.Run("invites and observers are restored from the store", func(t *testing.T) {
+		store := NewMemoryStore()
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		require.NoError(t, manager.Restore(store))
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, owner, protocol.TypeWelcome)
+		observerInvite := createInvite(t, owner, protocol.Invite{Role: protocol.RoleObserver}).Invite
+		invite := createInvite(t, owner, protocol.Invite{}).Invite
+		observer := dialProtocolClient(t, srv, protocol.Hello{Invite: observerInvite.Code})
+		joined := readProtocolMessage(t, observer, protocol.TypeWelcome).Welcome
+
+		restarted, srv := newTestServer(t)
+		restarted.GracePeriod = time.Minute
+		require.NoError(t, restarted.Restore(store))
+		resumed := dialProtocolClient(t, srv, protocol.Hello{URL: joined.URL, Session: joined.Session})
+		assert.Equal(t, protocol.RoleObserver, readProtocolMessage(t, resumed, protocol.TypeWelcome).Welcome.Role)
+		member := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		assert.Equal(t, joined.URL, readProtocolMessage(t, member, protocol.TypeWelcome).Welcome.URL)
+	})
+
+	t.Run("guessing invites locks out the ip", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, owner, protocol.TypeWelcome)
+		invite := createInvite(t, owner, protocol.Invite{}).Invite
+		for range MaxFailedAttempts {
+			ws := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.ID + ".wrong"})
+			readProtocolMessage(t, ws, protocol.TypeError)
+		}
+		ws := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		assert.Equal(t, protocol.ErrTooManyAttempts, readProtocolMessage(t, ws, protocol.TypeError).Error.Code)
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"whtester/protocol"
+)
+
+var (
+	// MaxFailedAttempts is the number of wrong passwords from an ip
+	// or for a group after which they are locked out
+	MaxFailedAttempts = 5
+	// LockoutTime is how long the first lockout lasts, it doubles with
+	// every lockout up to MaxLockoutTime
+	LockoutTime    = time.Minute
+	MaxLockoutTime = time.Hour
+	// FailureWindow is how long failed attempts are remembered
+	FailureWindow = 10 * time.Minute
+)
+
+// maxTrackedKeys bounds the ips and groups remembered by a lockout,
+// stale entries are dropped once it is reached
+const maxTrackedKeys = 10000
+
+type attempts struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+// lockout counts the failed password checks of ips and groups, and
+// locks them out once they failed too often
+type lockout struct {
+	keys map[string]*attempts
+	sync.Mutex
+}
+
+func newLockout() *lockout {
+	return &lockout{keys: make(map[string]*attempts)}
+}
+
+// locked returns how long the longest lockout of the keys lasts, zero
+// if none of the keys is locked out
+func (l *lockout) locked(now time.Time, keys ...string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if a, ok := l.keys[key]; ok {
+			wait = max(wait, a.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for every key
+func (l *lockout) fail(now time.Time, keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.keys) >= maxTrackedKeys {
+		l.prune(now)
+	}
+	for _, key := range keys {
+		a, ok := l.keys[key]
+		if !ok {
+			a = &attempts{}
+			l.keys[key] = a
+		}
+		if now.Sub(a.last) > FailureWindow {
+			a.failures = 0
+		}
+		if now.Sub(a.last) > MaxLockoutTime {
+			a.lockouts = 0
+		}
+		a.last = now
+		a.failures++
+		if a.failures >= MaxFailedAttempts {
+			a.lockedUntil = now.Add(min(LockoutTime<<a.lockouts, MaxLockoutTime))
+			a.lockouts++
+			a.failures = 0
+		}
+	}
+}
+
+// succeed forgets the failed attempts of the keys
+func (l *lockout) succeed(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range keys {
+		delete(l.keys, key)
+	}
+}
+
+// prune drops the keys which are neither locked out nor failed recently.
+// The caller must hold the lock.
+func (l *lockout) prune(now time.Time) {
+	for key, a := range l.keys {
+		if now.After(a.lockedUntil) && now.Sub(a.last) > FailureWindow {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// remoteIP returns the ip of a remote address of the form host:port
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// tooManyAttempts is the error of clients which are locked out
+func tooManyAttempts(wait time.Duration) *protocol.Error {
+	return &protocol.Error{
+		Code:    protocol.ErrTooManyAttempts,
+		Message: fmt.Sprintf("too many failed attempts, retry in %s", wait.Round(time.Second)),
+	}
+}
+
+// checkJoin checks the password of the group of the url for a client
+// from the ip, ips and groups with too many failed attempts are locked
+// out for a while
+func (m *Manager) checkJoin(ip string, u string, password string) *protocol.Error {
+	now := time.Now()
+	ipKey, groupLock := "ip:"+ip, "group:"+u
+	if wait := m.lockout.locked(now, ipKey, groupLock); wait > 0 {
+		return tooManyAttempts(wait)
+	}
+	m.RLock()
+	hash, ok := m.Passwords[u]
+	m.RUnlock()
+	if !ok {
+		// guessing urls counts against the ip
+		m.lockout.fail(now, ipKey)
+		return &protocol.Error{Code: protocol.ErrGroupNotFound, Message: "group does not exist"}
+	}
+	if !checkPassword(hash, password) {
+		m.lockout.fail(now, ipKey, groupLock)
+		return &protocol.Error{Code: protocol.ErrInvalidKey, Message: "invalid group password"}
+	}
+	// the failures of the ip are kept, knowing the password of a
+	// group doesn't reset the guesses at other groups
+	m.lockout.succeed(groupLock)
+	return nil
+}
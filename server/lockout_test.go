@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockout(t *testing.T) {
+	t.Run("keys are locked out after too many failures", func(t *testing.T) {
+		l := newLockout()
+		now := time.Now()
+		for range MaxFailedAttempts - 1 {
+			l.fail(now, "ip:1")
+		}
+		assert.Zero(t, l.locked(now, "ip:1"))
+		l.fail(now, "ip:1")
+		assert.Equal(t, LockoutTime, l.locked(now, "ip:1"))
+		assert.Zero(t, l.locked(now.Add(LockoutTime), "ip:1"))
+		assert.Zero(t, l.locked(now, "ip:2"))
+	})
+
+	t.Run("lockouts get longer", func(t *testing.T) {
+		l := newLockout()
+		now := time.Now()
+		for range 2 * MaxFailedAttempts {
+			l.fail(now, "ip:1")
+		}
+		assert.Equal(t, 2*LockoutTime, l.locked(now, "ip:1"))
+	})
+
+	t.Run("old failures are forgotten", func(t *testing.T) {
+		l := newLockout()
+		now := time.Now()
+		for range MaxFailedAttempts - 1 {
+			l.fail(now, "ip:1")
+		}
+		l.fail(now.Add(FailureWindow+time.Second), "ip:1")
+		assert.Zero(t, l.locked(now.Add(FailureWindow+time.Second), "ip:1"))
+	})
+
+	t.Run("success forgets the failures", func(t *testing.T) {
+		l := newLockout()
+		now := time.Now()
+		for range MaxFailedAttempts - 1 {
+			l.fail(now, "ip:1")
+		}
+		l.succeed("ip:1")
+		l.fail(now, "ip:1")
+		assert.Zero(t, l.locked(now, "ip:1"))
+	})
+}
+
+func TestJoinGroup(t *testing.T) {
+	dialJoin := func(t *testing.T, srvURL string, u string, key string) *websocket.Conn {
+		t.Helper()
+		header := http.Header{"url": {u}, "key": {key}}
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvURL, "http")+"/wsold", header)
+		require.NoError(t, err)
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+
+	t.Run("wrong password is rejected and the connection closed", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, key := dialTestClient(t, srv, nil)
+
+		ws := dialJoin(t, srv.URL, u, key+"x")
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), protocol.ErrInvalidKey)
+		_, _, err = ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got %v", err)
+	})
+
+	t.Run("right password joins", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, key := dialTestClient(t, srv, nil)
+
+		ws := dialJoin(t, srv.URL, u, key)
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, key, strings.Split(string(data), "password: ")[1])
+	})
+
+	t.Run("group is locked out after too many wrong passwords", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, key := dialTestClient(t, srv, nil)
+		for range MaxFailedAttempts {
+			ws := dialJoin(t, srv.URL, u, "wrong")
+			ws.ReadMessage()
+		}
+
+		// the right password is refused too while locked out
+		ws := dialJoin(t, srv.URL, u, key)
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), protocol.ErrTooManyAttempts)
+
+		joined := dialProtocolClient(t, srv, protocol.Hello{URL: u, Key: key})
+		assert.Equal(t, protocol.ErrTooManyAttempts, readProtocolMessage(t, joined, protocol.TypeError).Error.Code)
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/groups/"+groupKey(u)+"/requests", nil)
+		req.Header.Set("key", key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	})
+
+	t.Run("guessing urls locks out the ip", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, key := dialTestClient(t, srv, nil)
+		for range MaxFailedAttempts {
+			ws := dialJoin(t, srv.URL, "http://guess.localhost", "wrong")
+			ws.ReadMessage()
+		}
+		ws := dialJoin(t, srv.URL, u, key)
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), protocol.ErrTooManyAttempts)
+	})
+	t.Run("joining a group doesn't forget the failures of the ip", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, key := dialTestClient(t, srv, nil)
+		for range MaxFailedAttempts - 1 {
+			ws := dialJoin(t, srv.URL, "http://guess.localhost", "wrong")
+			ws.ReadMessage()
+			ws = dialJoin(t, srv.URL, u, key)
+			_, data, err := ws.ReadMessage()
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), protocol.ErrTooManyAttempts)
+		}
+		ws := dialJoin(t, srv.URL, "http://guess.localhost", "wrong")
+		ws.ReadMessage()
+		ws = dialJoin(t, srv.URL, u, key)
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), protocol.ErrTooManyAttempts)
+	})
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the buckets of the
+// latency histograms
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods are the methods counted under their own label, the
+// others are counted as OTHER so that senders can't grow the series
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// histogram counts observations in cumulative buckets, like the
+// histograms of Prometheus
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	sync.Mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the series of the histogram in the text format
+func (h *histogram) write(w io.Writer, name string) {
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// requestKey are the labels of the requests counter
+type requestKey struct {
+	method string
+	status int
+}
+
+// metrics are the counters and histograms of the server which don't
+// belong to a group or a client, so that they keep counting when
+// groups and clients go away
+type metrics struct {
+	requests map[requestKey]int64
+	// forwardedBytes are the bytes of the requests written to the
+	// clients, writeFailures the writes to the clients which failed
+	// and overflows the messages for clients with a full write queue
+	forwardedBytes atomic.Int64
+	writeFailures  atomic.Int64
+	overflows      atomic.Int64
+	// pingRTT is the time between a ping and its pong, delivery the
+	// time between the receipt of a request and its write to a client
+	pingRTT  *histogram
+	delivery *histogram
+	sync.Mutex
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestKey]int64),
+		pingRTT:  newHistogram(LatencyBuckets),
+		delivery: newHistogram(LatencyBuckets),
+	}
+}
+
+// request counts a webhook request answered with the status
+func (m *metrics) request(method string, status int) {
+	if !slices.Contains(metricMethods, method) {
+		method = "OTHER"
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{method, status}]++
+}
+
+// written counts a message written to a client, err is the outcome of
+// the write
+func (m *metrics) written(msg outbound, err error) {
+	if err != nil {
+		m.writeFailures.Add(1)
+		return
+	}
+	if !msg.request {
+		return
+	}
+	m.forwardedBytes.Add(int64(len(msg.data)))
+	if !msg.receivedAt.IsZero() {
+		m.delivery.observe(time.Since(msg.receivedAt).Seconds())
+	}
+}
+
+// pong observes the round trip of the ping whose payload is the time
+// it was sent, as written by pingPayload
+func (m *metrics) pong(appData string, now time.Time) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		return
+	}
+	m.pingRTT.observe(now.Sub(time.Unix(0, sent)).Seconds())
+}
+
+// pingPayload is the payload of the pings, the time they are sent, which
+// the clients send back in their pong
+func pingPayload(now time.Time) []byte {
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+// statusRecorder keeps the status written to the webhook sender
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes the label value for the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// NewMetricsHandler serves the metrics of the server at /metrics in the
+// Prometheus text format. It has no authentication and is meant for its
+// own listener, apart from the webhooks.
+func NewMetricsHandler(m *Manager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", m.handleMetrics)
+	return mux
+}
+
+func (m *Manager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	type groupMetrics struct {
+		key      string
+		clients  int
+		requests int64
+	}
+	var groups []groupMetrics
+	var clients, queued, deepest int
+	m.RLock()
+	for key, g := range m.ClientList {
+		groups = append(groups, groupMetrics{key, len(g.clients), g.stats.requests.Load()})
+		clients += len(g.clients)
+		for _, c := range g.clients {
+			depth := c.out.depth()
+			queued += depth
+			deepest = max(deepest, depth)
+		}
+	}
+	m.RUnlock()
+	slices.SortFunc(groups, func(a, b groupMetrics) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	m.metrics.Lock()
+	var requests []requestKey
+	counts := make(map[requestKey]int64, len(m.metrics.requests))
+	for key, n := range m.metrics.requests {
+		requests = append(requests, key)
+		counts[key] = n
+	}
+	m.metrics.Unlock()
+	slices.SortFunc(requests, func(a, b requestKey) int {
+		if c := strings.Compare(a.method, b.method); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("whtester_clients", "gauge", "Connected clients.")
+	fmt.Fprintf(w, "whtester_clients %d\n", clients)
+	metric("whtester_groups", "gauge", "Active groups, including the ones waiting for their clients to reconnect.")
+	fmt.Fprintf(w, "whtester_groups %d\n", len(groups))
+	metric("whtester_requests_total", "counter", "Webhook requests received, by method and response status.")
+	for _, key := range requests {
+		fmt.Fprintf(w, "whtester_requests_total{method=\"%s\",status=\"%d\"} %d\n", key.method, key.status, counts[key])
+	}
+	metric("whtester_forwarded_bytes_total", "counter", "Bytes of requests written to the clients.")
+	fmt.Fprintf(w, "whtester_forwarded_bytes_total %d\n", m.metrics.forwardedBytes.Load())
+	metric("whtester_websocket_write_failures_total", "counter", "Requests and pings which could not be written to a client.")
+	fmt.Fprintf(w, "whtester_websocket_write_failures_total %d\n", m.metrics.writeFailures.Load())
+	metric("whtester_write_queue_messages", "gauge", "Messages waiting in the write queues of the clients.")
+	fmt.Fprintf(w, "whtester_write_queue_messages %d\n", queued)
+	metric("whtester_write_queue_max_depth", "gauge", "Messages waiting in the fullest write queue of a client.")
+	fmt.Fprintf(w, "whtester_write_queue_max_depth %d\n", deepest)
+	metric("whtester_write_queue_overflows_total", "counter", "Messages for clients whose write queue was full, handled by the overflow policy.")
+	fmt.Fprintf(w, "whtester_write_queue_overflows_total %d\n", m.metrics.overflows.Load())
+	metric("whtester_ping_rtt_seconds", "histogram", "Time between a ping to a client and its pong.")
+	m.metrics.pingRTT.write(w, "whtester_ping_rtt_seconds")
+	metric("whtester_delivery_latency_seconds", "histogram", "Time between the receipt of a webhook request and its write to a client.")
+	m.metrics.delivery.write(w, "whtester_delivery_latency_seconds")
+	metric("whtester_group_clients", "gauge", "Connected clients of the group.")
+	for _, g := range groups {
+		fmt.Fprintf(w, "whtester_group_clients{group=\"%s\"} %d\n", escapeLabel(g.key), g.clients)
+	}
+	metric("whtester_group_requests_total", "counter", "Webhook requests forwarded to the group.")
+	for _, g := range groups {
+		fmt.Fprintf(w, "whtester_group_requests_total{group=\"%s\"} %d\n", escapeLabel(g.key), g.requests)
+	}
+}
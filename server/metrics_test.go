@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrapeMetrics returns the metrics of the manager in the text format
+func scrapeMetrics(t *testing.T, manager *Manager) string {
+	t.Helper()
+	srv := httptest.NewServer(NewMetricsHandler(manager))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 0.5, 3} {
+		h.observe(v)
+	}
+	var out stringWriter
+	h.write(&out, "latency_seconds")
+	assert.Equal(t, `latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 4.05
+latency_seconds_count 4
+`, out.String())
+}
+
+// stringWriter collects what is written to it
+type stringWriter struct {
+	b []byte
+}
+
+func (w *stringWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func (w *stringWriter) String() string {
+	return string(w.b)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("requests, groups and deliveries are counted", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		// legacy clients don't acknowledge requests, the sender gets
+		// its response right away
+		_, u, _ := dialTestClient(t, srv, nil)
+		waitForClients(t, manager, groupKey(u), 1)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		resp.Body.Close()
+		resp = sendWebhook(t, srv, "PURGE", u, "hello")
+		resp.Body.Close()
+		resp = sendWebhook(t, srv, http.MethodGet, "http://unknown.localhost/", "")
+		resp.Body.Close()
+
+		out := scrapeMetrics(t, manager)
+		assert.Contains(t, out, "# TYPE whtester_clients gauge\nwhtester_clients 1\n")
+		assert.Contains(t, out, "whtester_groups 1\n")
+		assert.Contains(t, out, `whtester_requests_total{method="POST",status="202"} 1`)
+		assert.Contains(t, out, `whtester_requests_total{method="OTHER",status="202"} 1`)
+		assert.Contains(t, out, `whtester_requests_total{method="GET",status="503"} 1`)
+		assert.Contains(t, out, `whtester_group_clients{group="`+groupKey(u)+`"} 1`)
+		assert.Contains(t, out, `whtester_group_requests_total{group="`+groupKey(u)+`"} 2`)
+		assert.Contains(t, out, "whtester_delivery_latency_seconds_count 2\n")
+		assert.Contains(t, out, "whtester_websocket_write_failures_total 0\n")
+		assert.NotContains(t, out, "whtester_forwarded_bytes_total 0\n")
+	})
+
+	t.Run("pongs time the round trip of the pings", func(t *testing.T) {
+		m := newMetrics()
+		now := time.Now()
+		m.pong(string(pingPayload(now.Add(-20*time.Millisecond))), now)
+		m.pong("not a ping of the server", now)
+		assert.Equal(t, uint64(1), m.pingRTT.count)
+		assert.InDelta(t, 0.02, m.pingRTT.sum, 0.001)
+	})
+
+	t.Run("written requests and failed writes are counted", func(t *testing.T) {
+		m := newMetrics()
+		request := outbound{data: make([]byte, 10), request: true, receivedAt: time.Now()}
+		m.written(request, nil)
+		m.written(outbound{data: make([]byte, 10)}, nil)
+		m.written(request, websocket.ErrCloseSent)
+		m.written(outbound{}, errors.New("broken pipe"))
+		assert.Equal(t, int64(10), m.forwardedBytes.Load())
+		assert.Equal(t, int64(2), m.writeFailures.Load())
+		assert.Equal(t, uint64(1), m.delivery.count)
+	})
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+)
+
+// HelloWaitTime is how long the server waits for the hello message of
+// a client speaking the control protocol
+var HelloWaitTime = 10 * time.Second
+
+// sendMessage writes the control message to the connection
+func sendMessage(ws *websocket.Conn, msg protocol.Message) error {
+	return ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg))
+}
+
+// refuse sends the error to the client and closes the connection
+func refuse(ws *websocket.Conn, code string, message string) {
+	msg := protocol.New(protocol.TypeError)
+	msg.Error = &protocol.Error{Code: code, Message: message}
+	sendMessage(ws, msg)
+	closeRefused(ws, message)
+}
+
+// rejectLegacy sends the error to a client using the legacy format as
+// a text message and closes the connection
+func rejectLegacy(ws *websocket.Conn, refused *protocol.Error) {
+	ws.WriteMessage(websocket.TextMessage, []byte(refused.Error()))
+	closeRefused(ws, refused.Message)
+}
+
+// closeRefused sends the close message to a refused client and closes
+// the connection
+func closeRefused(ws *websocket.Conn, reason string) {
+	closeConn(ws, websocket.ClosePolicyViolation, reason)
+}
+
+// closeConn sends the close message with the code and closes the
+// connection
+func closeConn(ws *websocket.Conn, code int, reason string) {
+	// the reason must fit a control frame
+	if len(reason) > 120 {
+		reason = reason[:120]
+	}
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// claimGroup returns the url, password and session for a client which
+// creates a group with the api token, clients with a valid session get
+// back their url, and their password if they sent it
+func (m *Manager) claimGroup(domain string, session string, key string, apiToken *APIToken) (string, string, string, error) {
+	if u, ok := m.resumeSession(session); ok {
+		return u, m.echoPassword(u, key), session, nil
+	}
+	m.Lock()
+	if refused := m.checkGroupLimit(apiToken); refused != nil {
+		m.Unlock()
+		return "", "", "", refused
+	}
+	// the url is taken while holding the lock, so that two new groups
+	// can't get the same id
+	u, err := m.generateURL(domain)
+	if err != nil {
+		m.Unlock()
+		return "", "", "", err
+	}
+	password, hash := newPassword()
+	m.Passwords[u] = hash
+	m.tokens.own(u, tokenName(apiToken))
+	m.Unlock()
+	return u, password, m.newSession(u, protocol.RoleForwarder), nil
+}
+
+// handleHello reads the hello message of a client speaking the control
+// protocol and adds the client to its group
+func (m *Manager) handleHello(ws *websocket.Conn, domain string, apiToken *APIToken) {
+	ws.SetReadDeadline(time.Now().Add(HelloWaitTime))
+	_, data, err := ws.ReadMessage()
+	ws.SetReadDeadline(time.Time{})
+	if err != nil {
+		ws.Close()
+		return
+	}
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		refuse(ws, protocol.ErrInvalidMessage, err.Error())
+		return
+	}
+	if msg.Type != protocol.TypeHello {
+		refuse(ws, protocol.ErrInvalidMessage, "expected hello message")
+		return
+	}
+
+	hello := msg.Hello
+	scope := ScopeCreate
+	if hello.URL != "" || hello.Invite != "" {
+		scope = ScopeJoin
+	}
+	if refused := m.authorize(apiToken, scope); refused != nil {
+		refuse(ws, refused.Code, refused.Message)
+		return
+	}
+	joined := false
+	defer func() {
+		if !joined {
+			m.release(apiToken)
+		}
+	}()
+	var u, password, session, token string
+	if hello.Invite != "" {
+		// join the group of the invite, with the role of the invite
+		var role protocol.Role
+		var refused *protocol.Error
+		u, role, refused = m.joinInvite(remoteIP(ws.RemoteAddr().String()), hello.Invite)
+		if refused != nil {
+			refuse(ws, refused.Code, refused.Message)
+			return
+		}
+		session = m.newSession(u, role)
+	} else if su, ok := m.resumeSession(hello.Session); ok && hello.URL != "" && su == hello.URL {
+		// members which joined with an invite don't have the password
+		u, password, session = su, m.echoPassword(su, hello.Key), hello.Session
+	} else if hello.URL != "" {
+		// join an existing group
+		if refused := m.checkJoin(remoteIP(ws.RemoteAddr().String()), hello.URL, hello.Key); refused != nil {
+			refuse(ws, refused.Code, refused.Message)
+			return
+		}
+		u, password, session = hello.URL, hello.Key, m.newSession(hello.URL, protocol.RoleForwarder)
+	} else if hello.Name != "" {
+		var refused *protocol.Error
+		u, password, session, token, refused = m.claimName(domain, hello.Name, hello.Token, hello.Session, hello.Key, apiToken)
+		if refused != nil {
+			refuse(ws, refused.Code, refused.Message)
+			return
+		}
+	} else {
+		var err error
+		u, password, session, err = m.claimGroup(domain, hello.Session, hello.Key, apiToken)
+		var refused *protocol.Error
+		if errors.As(err, &refused) {
+			refuse(ws, refused.Code, refused.Message)
+			return
+		}
+		if err != nil {
+			refuse(ws, protocol.ErrUnavailable, err.Error())
+			return
+		}
+	}
+
+	// the welcome is written before the writer of the client takes
+	// over the connection
+	role := m.sessionRole(session)
+	welcome := protocol.New(protocol.TypeWelcome)
+	welcome.Welcome = &protocol.Welcome{URL: u, Key: password, Session: session, Token: token, Role: role}
+	sendMessage(ws, welcome)
+	joined = true
+	m.AddNewClient(u, ws, ClientOptions{Relay: hello.Relay, Ack: true, Protocol: msg.Version, Token: tokenName(apiToken), Role: role, Session: session})
+	m.deliverQueued(u, ws)
+	m.announceMember(u, ws)
+}
+
+// announceMember tells the other clients of the group speaking the
+// control protocol that the client joined the group
+func (m *Manager) announceMember(u string, ws *websocket.Conn) {
+	m.RLock()
+	group, ok := m.ClientList[groupKey(u)]
+	if !ok {
+		m.RUnlock()
+		return
+	}
+	msg := protocol.New(protocol.TypeMemberJoined)
+	msg.Member = &protocol.Member{Members: len(group.clients)}
+	var others []client
+	for _, c := range group.clients {
+		if c.ws == ws {
+			msg.Member.ID = c.uid
+			msg.Member.Role = c.role
+		} else if c.proto > 0 {
+			others = append(others, c)
+		}
+	}
+	m.RUnlock()
+	for _, c := range others {
+		c.sendMessage(msg)
+	}
+}
+
+// handleMessage handles a control message sent by the client, it
+// returns false if the client said goodbye
+func (m *Manager) handleMessage(c *client, data []byte) bool {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		reply := protocol.New(protocol.TypeError)
+		reply.Error = &protocol.Error{Code: protocol.ErrInvalidMessage, Message: err.Error()}
+		c.sendMessage(reply)
+		return true
+	}
+	switch msg.Type {
+	case protocol.TypeAck:
+		// observers get a copy of the requests, they don't handle them
+		if c.role == protocol.RoleObserver {
+			return true
+		}
+		if c.relay && len(msg.Ack.Response) > 0 {
+			_, resp, err := serialize.DecodeResponse(msg.Ack.Response)
+			if err != nil {
+				reply := protocol.New(protocol.TypeError)
+				reply.Error = &protocol.Error{Code: protocol.ErrInvalidMessage, Message: err.Error()}
+				c.sendMessage(reply)
+				return true
+			}
+			m.relays.deliver(msg.Ack.ID, resp)
+		}
+		m.handleAck(c, msg.Ack.ID, msg.Ack.Error)
+	case protocol.TypeSettings:
+		m.handleSettings(c, msg.Settings)
+	case protocol.TypeInvite:
+		m.handleInvite(c, msg.Invite)
+	case protocol.TypeInvites:
+		m.sendInvites(c)
+	case protocol.TypeRevokeInvite:
+		m.handleRevoke(c, msg.Revoke)
+	case protocol.TypeGoodbye:
+		return false
+	default:
+		reply := protocol.New(protocol.TypeError)
+		reply.Error = &protocol.Error{
+			Code:    protocol.ErrInvalidMessage,
+			Message: fmt.Sprintf("unexpected message of type %q", msg.Type),
+		}
+		c.sendMessage(reply)
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialProtocolClient connects a client speaking the control protocol
+// and sends the hello message
+func dialProtocolClient(t testing.TB, srv *httptest.Server, hello protocol.Hello) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.Subprotocol}}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	ws, _, err := dialer.Dial(wsURL, nil)
+	require.NoError(t, err, "dialing server")
+	t.Cleanup(func() { ws.Close() })
+	require.Equal(t, protocol.Subprotocol, ws.Subprotocol())
+
+	msg := protocol.New(protocol.TypeHello)
+	msg.Hello = &hello
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+	return ws
+}
+
+// readProtocolMessage reads the next control message of the type
+func readProtocolMessage(t testing.TB, ws *websocket.Conn, typ protocol.Type) protocol.Message {
+	t.Helper()
+	for {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err, "reading %s message", typ)
+		msg, err := protocol.Decode(data)
+		require.NoError(t, err, "decoding message")
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func TestControlProtocol(t *testing.T) {
+	t.Run("client receives welcome and requests", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		assert.NotEmpty(t, welcome.URL)
+		assert.NotEmpty(t, welcome.Key)
+		assert.NotEmpty(t, welcome.Session)
+
+		go func() {
+			req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+			ack := protocol.New(protocol.TypeAck)
+			ack.Ack = &protocol.Ack{ID: req.ID}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+		}()
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+
+	t.Run("relay client sends the response in the acknowledgement", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{Relay: true})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		go func() {
+			req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+			resp := &http.Response{
+				StatusCode: http.StatusCreated,
+				Body:       io.NopCloser(bytes.NewBufferString("created")),
+			}
+			ack := protocol.New(protocol.TypeAck)
+			data, _ := serialize.EncodeResponse(req.ID, resp)
+			ack.Ack = &protocol.Ack{ID: req.ID, Response: data}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+		}()
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "created", string(body))
+	})
+
+	t.Run("members are told when a client joins", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		first := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, first, protocol.TypeWelcome).Welcome
+
+		second := dialProtocolClient(t, srv, protocol.Hello{URL: welcome.URL, Key: welcome.Key})
+		joined := readProtocolMessage(t, second, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, joined.URL)
+
+		member := readProtocolMessage(t, first, protocol.TypeMemberJoined).Member
+		assert.Equal(t, 2, member.Members)
+	})
+
+	t.Run("client with invalid password is refused", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		first := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, first, protocol.TypeWelcome).Welcome
+
+		second := dialProtocolClient(t, srv, protocol.Hello{URL: welcome.URL, Key: "wrong"})
+		refused := readProtocolMessage(t, second, protocol.TypeError).Error
+		assert.Equal(t, protocol.ErrInvalidKey, refused.Code)
+		_, _, err := second.ReadMessage()
+		assert.Error(t, err, "connection is closed")
+	})
+
+	t.Run("invalid message gets an error", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"version": 1, "type": "request"}`))
+		refused := readProtocolMessage(t, ws, protocol.TypeError).Error
+		assert.Equal(t, protocol.ErrInvalidMessage, refused.Code)
+	})
+
+	t.Run("legacy clients keep the legacy format", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws, u, key := dialTestClient(t, srv, nil)
+		assert.Equal(t, "", ws.Subprotocol())
+		assert.NotEmpty(t, u)
+		assert.NotEmpty(t, key)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		resp.Body.Close()
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		msgType, _, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, msgType)
+	})
+}
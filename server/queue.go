@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queuedRequest is a request received while the group had no clients
+type queuedRequest struct {
+	id         string
+	msg        []byte
+	receivedAt time.Time
+}
+
+// requestQueue holds the requests of a group until one of its clients
+// reconnects, requests older than maxAge are dropped
+type requestQueue struct {
+	items  []queuedRequest
+	size   int
+	maxAge time.Duration
+}
+
+func newRequestQueue(size int, maxAge time.Duration) *requestQueue {
+	return &requestQueue{size: size, maxAge: maxAge}
+}
+
+// expire drops the requests older than the max age of the queue, the
+// requests sent again aren't the latest so every request is checked
+func (q *requestQueue) expire(now time.Time) {
+	if q.maxAge <= 0 {
+		return
+	}
+	q.items = slices.DeleteFunc(q.items, func(item queuedRequest) bool {
+		return now.Sub(item.receivedAt) > q.maxAge
+	})
+}
+
+// push adds the request received at receivedAt to the queue, it returns
+// false if the queue is full
+func (q *requestQueue) push(id string, msg []byte, receivedAt time.Time, now time.Time) bool {
+	q.expire(now)
+	if len(q.items) >= q.size {
+		return false
+	}
+	q.items = append(q.items, queuedRequest{id: id, msg: msg, receivedAt: receivedAt})
+	return true
+}
+
+// drain empties the queue and returns the requests in the order they
+// were received
+func (q *requestQueue) drain(now time.Time) []queuedRequest {
+	q.expire(now)
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// enqueue queues the request for a group without clients, if clients
+// joined the group in the meantime they are returned instead so that
+// the request is sent to them right away
+func (m *Manager) enqueue(key string, id string, msg []byte) ([]client, bool) {
+	m.Lock()
+	defer m.Unlock()
+	group, ok := m.ClientList[key]
+	if !ok {
+		return nil, false
+	}
+	if len(group.clients) > 0 {
+		var clients []client
+		for _, c := range group.clients {
+			clients = append(clients, c)
+		}
+		return clients, true
+	}
+	if group.queue == nil {
+		group.queue = newRequestQueue(m.QueueSize, m.QueueMaxAge)
+	}
+	now := time.Now()
+	return nil, group.queue.push(id, msg, now, now)
+}
+
+// requeue queues the requests a disconnected client didn't acknowledge,
+// they keep the time they were received at so they still expire. The
+// caller must hold the lock of the manager
+func (m *Manager) requeue(group *clientGroup, items []*pendingRequest) {
+	if len(items) == 0 {
+		return
+	}
+	if group.queue == nil {
+		group.queue = newRequestQueue(m.QueueSize, m.QueueMaxAge)
+	}
+	now := time.Now()
+	for _, item := range items {
+		if !group.queue.push(item.id, item.msg, item.receivedAt, now) {
+			fmt.Printf("\ndropped unacknowledged request %s, the queue of %s is full", item.id, group.url)
+		}
+	}
+}
+
+// deliverQueued sends the requests queued for the group of the url
+// to the client of the connection which just joined the group
+func (m *Manager) deliverQueued(u string, ws *websocket.Conn) {
+	m.Lock()
+	var items []queuedRequest
+	var receiver client
+	if group, ok := m.ClientList[groupKey(u)]; ok {
+		for _, c := range group.clients {
+			if c.ws == ws {
+				receiver = c
+			}
+		}
+		// the queue is kept if the client is already gone
+		if receiver.ws != nil && group.queue != nil {
+			items = group.queue.drain(time.Now())
+		}
+	}
+	m.Unlock()
+	for _, item := range items {
+		receiver.deliver(item.id, item.msg, item.receivedAt)
+	}
+}
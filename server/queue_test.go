@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestQueue(t *testing.T) {
+	now := time.Now()
+
+	t.Run("drains requests in order", func(t *testing.T) {
+		q := newRequestQueue(10, time.Minute)
+		q.push("1", []byte("1"), now, now)
+		q.push("2", []byte("2"), now, now)
+		var ids []string
+		for _, item := range q.drain(now) {
+			ids = append(ids, item.id)
+		}
+		assert.Equal(t, []string{"1", "2"}, ids)
+		assert.Empty(t, q.drain(now))
+	})
+
+	t.Run("rejects requests when full", func(t *testing.T) {
+		q := newRequestQueue(1, time.Minute)
+		assert.True(t, q.push("1", []byte("1"), now, now))
+		assert.False(t, q.push("2", []byte("2"), now, now))
+	})
+
+	t.Run("drops expired requests", func(t *testing.T) {
+		q := newRequestQueue(1, time.Minute)
+		q.push("1", []byte("1"), now, now)
+		// the expired request makes room for the new one
+		assert.True(t, q.push("2", []byte("2"), now.Add(2*time.Minute), now.Add(2*time.Minute)))
+		items := q.drain(now.Add(2 * time.Minute))
+		require.Len(t, items, 1)
+		assert.Equal(t, "2", items[0].id)
+	})
+
+	t.Run("requests sent again keep their age", func(t *testing.T) {
+		manager := NewManager()
+		manager.QueueSize = 1
+		manager.QueueMaxAge = time.Minute
+		group := &clientGroup{url: "http://abc.localhost"}
+		manager.requeue(group, []*pendingRequest{
+			{id: "1", msg: []byte("1"), receivedAt: now.Add(-2 * time.Minute)},
+			{id: "2", msg: []byte("2"), receivedAt: now},
+			{id: "3", msg: []byte("3"), receivedAt: now},
+		})
+		// the first request expired, the third one didn't fit
+		items := group.queue.drain(time.Now())
+		require.Len(t, items, 1)
+		assert.Equal(t, "2", items[0].id)
+		assert.Equal(t, now, items[0].receivedAt)
+	})
+}
+
+func TestStoreAndForward(t *testing.T) {
+	t.Run("url without clients responds with the no client status", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.NoClientStatus = http.StatusNotFound
+		resp := sendWebhook(t, srv, http.MethodPost, "http://unknown.localhost", "hello")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("requests are delivered in order when a client reconnects", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		ws, msg := dialTestClientHandshake(t, srv, nil)
+		u := strings.Split(msg, "\n")[0]
+		ws.Close()
+		waitForClients(t, manager, groupKey(u), 0)
+
+		for _, body := range []string{"first", "second"} {
+			resp := sendWebhook(t, srv, http.MethodPost, u, body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		}
+
+		header := make(http.Header)
+		header.Set("session", readSession(t, msg))
+		resumed, _ := dialTestClientHandshake(t, srv, header)
+		for _, want := range []string{"first", "second"} {
+			resumed.SetReadDeadline(time.Now().Add(time.Second))
+			msgType, data, err := resumed.ReadMessage()
+			require.NoError(t, err)
+			require.Equal(t, websocket.BinaryMessage, msgType)
+			body := make([]byte, len(want))
+			req, err := serialize.DecodeRequest(data)
+			require.NoError(t, err)
+			req.Body.Read(body)
+			assert.Equal(t, want, string(body))
+		}
+	})
+
+	t.Run("full queue responds with the no client status", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		manager.QueueSize = 1
+		ws, u, _ := dialTestClient(t, srv, nil)
+		ws.Close()
+		waitForClients(t, manager, groupKey(u), 0)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "first")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp = sendWebhook(t, srv, http.MethodPost, u, "second")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+}
+
+// waitForClients waits until the group has n clients
+func waitForClients(t testing.TB, manager *Manager, key string, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		manager.RLock()
+		group, ok := manager.ClientList[key]
+		done := ok && len(group.clients) == n
+		manager.RUnlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("group %s doesn't have %d clients", key, n)
+}
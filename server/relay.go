@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// waiters keeps track of the requests which are waiting for their
+// clients, e.g. for a relay client to send back the response of its
+// local program
+type waiters[T any] struct {
+	waiting map[string]chan T
+	sync.Mutex
+}
+
+func newWaiters[T any]() *waiters[T] {
+	return &waiters[T]{
+		waiting: make(map[string]chan T),
+	}
+}
+
+// add registers the request id and returns the channel on which
+// the result for the request is delivered
+func (r *waiters[T]) add(id string) chan T {
+	r.Lock()
+	defer r.Unlock()
+	// buffered so that deliver never blocks on a request which
+	// has already timed out
+	ch := make(chan T, 1)
+	r.waiting[id] = ch
+	return ch
+}
+
+func (r *waiters[T]) remove(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.waiting, id)
+}
+
+// deliver sends the result to the request waiting on it, only the
+// first result for a request is delivered
+func (r *waiters[T]) deliver(id string, result T) {
+	r.Lock()
+	defer r.Unlock()
+	ch, ok := r.waiting[id]
+	if !ok {
+		return
+	}
+	delete(r.waiting, id)
+	ch <- result
+}
+
+// writeResponse writes the relayed response to the webhook sender
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		io.Copy(w, resp.Body)
+	}
+}
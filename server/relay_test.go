@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer starts the webhook server on a random port
+func newTestServer(t testing.TB) (*Manager, *httptest.Server) {
+	t.Helper()
+	manager := NewManager()
+	srv := httptest.NewServer(NewWebHookHandler(manager, "localhost"))
+	t.Cleanup(srv.Close)
+	return manager, srv
+}
+
+// dialTestClient connects a new client to the server and returns the
+// connection along with the url and password sent by the server
+func dialTestClient(t testing.TB, srv *httptest.Server, header http.Header) (*websocket.Conn, string, string) {
+	t.Helper()
+	ws, msg := dialTestClientHandshake(t, srv, header)
+	u := strings.Split(msg, "\n")[0]
+	key := strings.Split(msg, "password: ")[1]
+	return ws, u, key
+}
+
+// dialTestClientHandshake connects a new client to the server and
+// returns the connection along with the handshake message
+func dialTestClientHandshake(t testing.TB, srv *httptest.Server, header http.Header) (*websocket.Conn, string) {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	require.NoError(t, err, "dialing server")
+	t.Cleanup(func() { ws.Close() })
+
+	_, p, err := ws.ReadMessage()
+	require.NoError(t, err, "reading url from server")
+	return ws, string(p)
+}
+
+// sendWebhook sends a request to the test server as if it was sent to
+// the generated url u, keeping the path and query of u
+func sendWebhook(t testing.TB, srv *httptest.Server, method string, u string, body string) *http.Response {
+	t.Helper()
+	parsed, err := url.Parse(u)
+	require.NoError(t, err, "parsing url")
+	req, err := http.NewRequest(method, srv.URL+parsed.RequestURI(), bytes.NewBufferString(body))
+	require.NoError(t, err, "creating request")
+	req.Host = parsed.Host
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, "sending webhook")
+	return resp
+}
+
+func TestRelay(t *testing.T) {
+	t.Run("relay client response is written to the webhook sender", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		header := make(http.Header)
+		header.Set("relay", "true")
+		ws, u, _ := dialTestClient(t, srv, header)
+
+		// answer the request like the cli does
+		go func() {
+			for {
+				msgType, data, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if msgType != websocket.BinaryMessage {
+					continue
+				}
+				req, err := serialize.DecodeRequest(data)
+				if err != nil {
+					t.Errorf("decoding request: %v", err)
+					return
+				}
+				respHeader := make(http.Header)
+				respHeader.Set("X-Local", "yes")
+				resp := &http.Response{
+					StatusCode: http.StatusCreated,
+					Header:     respHeader,
+					Body:       io.NopCloser(bytes.NewBufferString("created")),
+				}
+				id := req.Header.Get(serialize.RequestIDHeader)
+				// clients without the control protocol send the legacy format
+				data, _ = serialize.EncodeLegacyResponse(id, resp)
+				ws.WriteMessage(websocket.BinaryMessage, data)
+			}
+		}()
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "yes", resp.Header.Get("X-Local"))
+		assert.Equal(t, "created", string(body))
+	})
+
+	t.Run("sender gets gateway timeout if relay client does not respond", func(t *testing.T) {
+		RelayWaitTime = 100 * time.Millisecond
+		defer func() { RelayWaitTime = 30 * time.Second }()
+
+		_, srv := newTestServer(t)
+		header := make(http.Header)
+		header.Set("relay", "true")
+		_, u, _ := dialTestClient(t, srv, header)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
+	t.Run("request is accepted right away without relay clients", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		_, u, _ := dialTestClient(t, srv, nil)
+
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+}
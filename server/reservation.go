@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"whtester/protocol"
+)
+
+// ReservedNames are the names clients can't request, the blocklist of
+// new managers starts with them
+var ReservedNames = []string{"www", "api", "admin", "app", "h", "ws", "wsold", "mail", "static", "status"}
+
+// validName matches the names clients can request, they are used as
+// subdomains so they must be valid DNS labels
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,30}[a-z0-9]$`)
+
+// Reservation gives the holder of the ownership token the name
+type Reservation struct {
+	Name string `json:"name"`
+	// TokenHash is the hex encoded sha256 of the ownership token
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// owns reports if the token is the ownership token of the reservation
+func (r Reservation) owns(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(r.TokenHash)) == 1
+}
+
+// reservations keeps the reserved names, they are saved in the store
+// of the manager so that they survive restarts of the server
+type reservations struct {
+	names map[string]Reservation
+	sync.Mutex
+}
+
+func newReservations() *reservations {
+	return &reservations{names: make(map[string]Reservation)}
+}
+
+func (r *reservations) get(name string) (Reservation, bool) {
+	r.Lock()
+	defer r.Unlock()
+	res, ok := r.names[name]
+	return res, ok
+}
+
+func (r *reservations) add(res Reservation) {
+	r.Lock()
+	defer r.Unlock()
+	r.names[res.Name] = res
+}
+
+func (r *reservations) remove(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.names[name]
+	delete(r.names, name)
+	return ok
+}
+
+// list returns the reservations, oldest first
+func (r *reservations) list() []Reservation {
+	r.Lock()
+	defer r.Unlock()
+	res := []Reservation{}
+	for _, reservation := range r.names {
+		res = append(res, reservation)
+	}
+	slices.SortFunc(res, func(a, b Reservation) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return res
+}
+
+// ReleaseName removes the reservation of the name from the manager and
+// the store, the group of the name is kept until it expires
+func (m *Manager) ReleaseName(name string) (bool, error) {
+	if !m.reservations.remove(name) {
+		return false, nil
+	}
+	return true, m.store.DeleteReservation(name)
+}
+
+// nameURL returns the url of the group with the name
+func (m *Manager) nameURL(domain string, name string) string {
+	u := url.URL{Scheme: m.Scheme, Host: name + "." + domain}
+	if m.PathMode {
+		u = url.URL{Scheme: m.Scheme, Host: domain, Path: PathPrefix + name}
+	}
+	return u.String()
+}
+
+// claimName returns the url and password of the group with the name,
+// along with the ownership token of the name. The name is reserved for
+// the client if it is free, otherwise the client must hold its token.
+// Clients with a valid session get back the url of their session, and
+// the password if they sent it. The api token is the owner of a new group.
+func (m *Manager) claimName(domain string, name string, token string, session string, key string, apiToken *APIToken) (u string, password string, newSession string, ownerToken string, err *protocol.Error) {
+	if u, ok := m.resumeSession(session); ok && groupKey(u) == name {
+		return u, m.echoPassword(u, key), session, token, nil
+	}
+	if !validName.MatchString(name) {
+		return "", "", "", "", &protocol.Error{
+			Code:    protocol.ErrInvalidName,
+			Message: "names are 3 to 32 lower case letters, digits or dashes",
+		}
+	}
+	unavailable := &protocol.Error{Code: protocol.ErrNameUnavailable, Message: fmt.Sprintf("name %q is not available", name)}
+	m.Lock()
+	if slices.Contains(m.Blocklist, name) {
+		m.Unlock()
+		return "", "", "", "", unavailable
+	}
+	res, reserved := m.reservations.get(name)
+	if reserved && !res.owns(token) {
+		m.Unlock()
+		return "", "", "", "", unavailable
+	}
+	group, live := m.ClientList[name]
+	switch {
+	case live && !reserved:
+		// a random url which happens to have the name
+		m.Unlock()
+		return "", "", "", "", unavailable
+	case live:
+		// the owner joins the group of the name, the server only
+		// keeps the hash of its password
+		u = group.url
+		if key != "" && checkPassword(m.Passwords[u], key) {
+			password = key
+		}
+	default:
+		if refused := m.checkGroupLimit(apiToken); refused != nil {
+			m.Unlock()
+			return "", "", "", "", refused
+		}
+		u = m.nameURL(domain, name)
+		var hash string
+		password, hash = newPassword()
+		m.Passwords[u] = hash
+		m.tokens.own(u, tokenName(apiToken))
+	}
+	// reserved while holding the lock, so that two clients asking
+	// for a free name don't both get it
+	ownerToken = token
+	if !reserved {
+		ownerToken = GenerateRandomString(32)
+		res := Reservation{Name: name, TokenHash: hashToken(ownerToken), CreatedAt: time.Now()}
+		m.reservations.add(res)
+		if err := m.store.PutReservation(res); err != nil {
+			fmt.Printf("\nerror saving reservation of %s, %v", name, err)
+		}
+	}
+	m.Unlock()
+	return u, password, m.newSession(u, protocol.RoleForwarder), ownerToken, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNames(t *testing.T) {
+	t.Run("client reserves a name", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		assert.Equal(t, "http://team-payments.localhost", welcome.URL)
+		assert.NotEmpty(t, welcome.Token)
+	})
+
+	t.Run("owner gets the name again with its token", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		ws.Close()
+		require.Eventually(t, func() bool {
+			manager.RLock()
+			defer manager.RUnlock()
+			_, ok := manager.ClientList["team-payments"]
+			return !ok
+		}, time.Second, 10*time.Millisecond, "group is removed")
+
+		again := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments", Token: welcome.Token})
+		got := readProtocolMessage(t, again, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, got.URL)
+		assert.Equal(t, welcome.Token, got.Token)
+	})
+
+	t.Run("owner joins the live group of the name", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		first := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		welcome := readProtocolMessage(t, first, protocol.TypeWelcome).Welcome
+
+		second := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments", Token: welcome.Token})
+		got := readProtocolMessage(t, second, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, got.URL)
+		// the server only keeps the hash of the password
+		assert.Empty(t, got.Key)
+
+		third := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments", Token: welcome.Token, Key: welcome.Key})
+		assert.Equal(t, welcome.Key, readProtocolMessage(t, third, protocol.TypeWelcome).Welcome.Key)
+	})
+
+	t.Run("name is refused without its token", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		first := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		readProtocolMessage(t, first, protocol.TypeWelcome)
+
+		for _, token := range []string{"", "wrong"} {
+			ws := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments", Token: token})
+			refused := readProtocolMessage(t, ws, protocol.TypeError).Error
+			assert.Equal(t, protocol.ErrNameUnavailable, refused.Code)
+		}
+	})
+
+	t.Run("invalid names are refused", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		for _, name := range []string{"ab", "Team", "-team", "team-", "team.payments", "a-name-which-is-much-too-long-for-us"} {
+			ws := dialProtocolClient(t, srv, protocol.Hello{Name: name})
+			refused := readProtocolMessage(t, ws, protocol.TypeError).Error
+			assert.Equal(t, protocol.ErrInvalidName, refused.Code, name)
+		}
+	})
+
+	t.Run("blocklisted names are refused", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.Blocklist = append(manager.Blocklist, "billing")
+		for _, name := range []string{"www", "admin", "billing"} {
+			ws := dialProtocolClient(t, srv, protocol.Hello{Name: name})
+			refused := readProtocolMessage(t, ws, protocol.TypeError).Error
+			assert.Equal(t, protocol.ErrNameUnavailable, refused.Code, name)
+		}
+	})
+
+	t.Run("reservations survive restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenFileStore(dir)
+		require.NoError(t, err)
+		manager, srv := newTestServer(t)
+		require.NoError(t, manager.Restore(store))
+		ws := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		require.NoError(t, store.Close())
+
+		store, err = OpenFileStore(dir)
+		require.NoError(t, err)
+		defer store.Close()
+		restarted, srv := newTestServer(t)
+		require.NoError(t, restarted.Restore(store))
+		refused := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments"})
+		assert.Equal(t, protocol.ErrNameUnavailable, readProtocolMessage(t, refused, protocol.TypeError).Error.Code)
+
+		owner := dialProtocolClient(t, srv, protocol.Hello{Name: "team-payments", Token: welcome.Token})
+		got := readProtocolMessage(t, owner, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, got.URL)
+	})
+}
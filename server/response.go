@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"whtester/protocol"
+)
+
+// MaxResponseDelay is the longest delay of a canned response
+var MaxResponseDelay = 5 * time.Minute
+
+// responseRule is a canned response written to the webhook senders
+// instead of the default response
+type responseRule struct {
+	protocol.Response
+	delay time.Duration
+	body  *template.Template
+}
+
+// responseData is available to the body templates of canned responses
+type responseData struct {
+	ID     string
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// compileResponses checks the canned responses and parses their body
+// templates
+func compileResponses(responses []protocol.Response) ([]responseRule, error) {
+	rules := []responseRule{}
+	for i, resp := range responses {
+		rule := responseRule{Response: resp}
+		if resp.Status < 100 || resp.Status > 999 {
+			return nil, fmt.Errorf("response %d has invalid status %d", i, resp.Status)
+		}
+		if _, err := path.Match(resp.Path, ""); err != nil {
+			return nil, fmt.Errorf("response %d has invalid path pattern: %w", i, err)
+		}
+		if resp.Delay != "" {
+			delay, err := time.ParseDuration(resp.Delay)
+			if err != nil || delay < 0 || delay > MaxResponseDelay {
+				return nil, fmt.Errorf("response %d has invalid delay %q, at most %s", i, resp.Delay, MaxResponseDelay)
+			}
+			rule.delay = delay
+		}
+		body, err := template.New("body").Parse(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("response %d has invalid body template: %w", i, err)
+		}
+		rule.body = body
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchResponse returns the first canned response matching the request
+func matchResponse(rules []responseRule, r *http.Request) (responseRule, bool) {
+	for _, rule := range rules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+			continue
+		}
+		if rule.Path != "" {
+			if ok, _ := path.Match(rule.Path, r.URL.Path); !ok {
+				continue
+			}
+		}
+		return rule, true
+	}
+	return responseRule{}, false
+}
+
+// write waits for the delay of the response, unless the webhook sender
+// gives up, and writes the response
+func (rule responseRule) write(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+	if rule.delay > 0 {
+		select {
+		case <-time.After(rule.delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	data := responseData{
+		ID:     id,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		Body:   string(body),
+	}
+	buf := new(bytes.Buffer)
+	if err := rule.body.Execute(buf, data); err != nil {
+		http.Error(w, "executing response template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for key, value := range rule.Headers {
+		w.Header().Set(key, value)
+	}
+	w.WriteHeader(rule.Status)
+	w.Write(buf.Bytes())
+}
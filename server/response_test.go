@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileResponses(t *testing.T) {
+	_, err := compileResponses([]protocol.Response{{Status: 500, Delay: "1s", Body: "{{.Method}}"}})
+	assert.NoError(t, err)
+
+	invalid := []protocol.Response{
+		{Status: 0},
+		{Status: 200, Path: "["},
+		{Status: 200, Delay: "forever"},
+		{Status: 200, Delay: "1h"},
+		{Status: 200, Body: "{{.Method"},
+	}
+	for _, resp := range invalid {
+		_, err := compileResponses([]protocol.Response{resp})
+		assert.Error(t, err, "%+v", resp)
+	}
+}
+
+func TestCannedResponses(t *testing.T) {
+	rules, err := compileResponses([]protocol.Response{
+		{Method: "POST", Path: "/fail/*", Status: http.StatusInternalServerError, Body: "failed {{.Method}} {{.Path}} {{.Query.Get \"x\"}}"},
+		{Path: "/slow", Status: http.StatusOK, Headers: map[string]string{"X-Test": "yes"}, Delay: "50ms"},
+	})
+	require.NoError(t, err)
+
+	t.Run("first matching response is written", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/fail/now?x=1", strings.NewReader("hello"))
+		rule, ok := matchResponse(rules, r)
+		require.True(t, ok)
+		w := httptest.NewRecorder()
+		rule.write(r.Context(), w, r, "1234")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "failed POST /fail/now 1", w.Body.String())
+	})
+
+	t.Run("response is delayed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		rule, ok := matchResponse(rules, r)
+		require.True(t, ok)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		rule.write(r.Context(), w, r, "1234")
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Equal(t, "yes", w.Header().Get("X-Test"))
+	})
+
+	t.Run("other requests get the default response", func(t *testing.T) {
+		_, ok := matchResponse(rules, httptest.NewRequest(http.MethodGet, "/fail/now", nil))
+		assert.False(t, ok)
+	})
+
+	t.Run("clients set the responses of their group", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{Responses: []protocol.Response{
+			{Status: http.StatusServiceUnavailable, Headers: map[string]string{"Retry-After": "5"}, Body: "try again"},
+		}}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		settings := readProtocolMessage(t, ws, protocol.TypeSettings).Settings
+		assert.Len(t, settings.Responses, 1)
+
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL+"/hook", "hello")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "try again", string(body))
+
+		// the client still gets the request
+		req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+		decoded, err := serialize.DecodeRequest(req.Data)
+		require.NoError(t, err)
+		assert.Equal(t, "/hook", decoded.URL.Path)
+
+		// an empty list restores the default response
+		msg.Settings = &protocol.Settings{Responses: []protocol.Response{}}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		settings = readProtocolMessage(t, ws, protocol.TypeSettings).Settings
+		assert.Empty(t, settings.Responses)
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// PasswordLength is the number of characters of generated group
+// passwords, 16 characters hold about 82 bits
+var PasswordLength = 16
+
+// newPassword generates a group password and returns it along with
+// its salted hash
+func newPassword() (string, string) {
+	password := GenerateRandomString(PasswordLength)
+	return password, hashPassword(password)
+}
+
+// hashPassword returns the salted hash of the password in the form
+// sha256$<salt>$<hash>. Group passwords are generated with enough
+// entropy that a slow hash is not needed.
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return "sha256$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedSum(salt, password))
+}
+
+func saltedSum(salt []byte, password string) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// checkPassword reports if the password matches the salted hash, in
+// constant time
+func checkPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(saltedSum(salt, password), want) == 1
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHash(t *testing.T) {
+	password, hash := newPassword()
+	assert.Len(t, password, PasswordLength)
+	assert.NotContains(t, hash, password)
+	assert.True(t, checkPassword(hash, password))
+	assert.False(t, checkPassword(hash, password+"x"))
+	assert.False(t, checkPassword(hash, ""))
+	assert.False(t, checkPassword(password, password), "passwords in clear are not hashes")
+
+	// the same password gets another salt
+	assert.NotEqual(t, hashPassword(password), hashPassword(password))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+	"whtester/protocol"
+)
+
+// session is the group of a client and its role in the group
+type session struct {
+	url  string
+	role protocol.Role
+}
+
+// newSession issues a session token for the url, the token lets a
+// client which lost its connection resume with the same url, password
+// and role
+func (m *Manager) newSession(u string, role protocol.Role) string {
+	m.Lock()
+	defer m.Unlock()
+	token := GenerateRandomString(32)
+	m.sessions[hashToken(token)] = session{url: u, role: role}
+	m.saveGroup(u)
+	return token
+}
+
+// lookupSession returns the session of the token along with the hash
+// the session is kept under. Session tokens reclaim a group, like
+// passwords only their hashes are kept and they are compared in
+// constant time. The caller must hold the lock of the manager.
+func (m *Manager) lookupSession(token string) (string, session, bool) {
+	if token == "" {
+		return "", session{}, false
+	}
+	hash := []byte(hashToken(token))
+	for h, s := range m.sessions {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			return h, s, true
+		}
+	}
+	return "", session{}, false
+}
+
+// resumeSession returns the url of the session, if the group of the
+// session still exists
+func (m *Manager) resumeSession(token string) (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	_, s, ok := m.lookupSession(token)
+	if !ok {
+		return "", false
+	}
+	if _, ok := m.ClientList[groupKey(s.url)]; !ok {
+		return "", false
+	}
+	return s.url, true
+}
+
+// sessionRole returns the role of the client of the session
+func (m *Manager) sessionRole(token string) protocol.Role {
+	m.RLock()
+	defer m.RUnlock()
+	if _, s, ok := m.lookupSession(token); ok && s.role != "" {
+		return s.role
+	}
+	return protocol.RoleForwarder
+}
+
+// echoPassword returns the password if it is the password of the group
+// of the url. The server only keeps the hash of the password, so clients
+// which resume their session send the password they have.
+func (m *Manager) echoPassword(u string, password string) string {
+	m.RLock()
+	hash := m.Passwords[u]
+	m.RUnlock()
+	if password == "" || !checkPassword(hash, password) {
+		return ""
+	}
+	return password
+}
+
+// reserveGroup keeps the empty group for the grace period of the
+// manager, so that its clients can reconnect to the same url. The
+// caller must hold the lock of the manager.
+func (m *Manager) reserveGroup(key string, group *clientGroup) {
+	m.reserveGroupFor(key, group, m.GracePeriod)
+}
+
+// reserveGroupFor keeps the empty group for the duration, the group is
+// deleted right away when it is not positive. The caller must hold the
+// lock of the manager.
+func (m *Manager) reserveGroupFor(key string, group *clientGroup, grace time.Duration) {
+	if grace <= 0 {
+		m.deleteGroup(key, group)
+		return
+	}
+	fmt.Printf("\nreserved client group: %s", key)
+	group.expire = time.AfterFunc(grace, func() {
+		m.Lock()
+		defer m.Unlock()
+		// a client could have joined the group while the
+		// timer was firing
+		if m.ClientList[key] == group && len(group.clients) == 0 {
+			m.deleteGroup(key, group)
+		}
+	})
+}
+
+// deleteGroup forgets the group along with its password, history,
+// sessions and invites. The caller must hold the lock of the manager.
+func (m *Manager) deleteGroup(key string, group *clientGroup) {
+	delete(m.ClientList, key)
+	delete(m.Passwords, group.url)
+	for token, s := range m.sessions {
+		if s.url == group.url {
+			delete(m.sessions, token)
+		}
+	}
+	m.invites.removeGroup(group.url)
+	m.history.remove(key)
+	m.tokens.disown(group.url)
+	if err := m.store.DeleteGroup(group.url); err != nil {
+		fmt.Printf("\nerror deleting client group %s from the store, %v", key, err)
+	}
+	fmt.Printf("\nremove client group: %s", key)
+}
+
+// handshake is the first message sent to a client, the password is
+// kept last as older clients read everything after "password: "
+func handshake(u string, session string, password string) []byte {
+	return []byte(fmt.Sprintf("%s\nsession: %s\npassword: %s", u, session, password))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSession returns the session token of the handshake message
+func readSession(t testing.TB, msg string) string {
+	t.Helper()
+	for _, line := range strings.Split(msg, "\n") {
+		if session, ok := strings.CutPrefix(line, "session: "); ok {
+			return session
+		}
+	}
+	t.Fatalf("handshake %q has no session", msg)
+	return ""
+}
+
+func TestSessionResume(t *testing.T) {
+	waitForGroup := func(manager *Manager, key string, want bool) bool {
+		for i := 0; i < 100; i++ {
+			manager.RLock()
+			group, ok := manager.ClientList[key]
+			empty := ok && len(group.clients) == 0
+			manager.RUnlock()
+			if ok == want && (!want || empty) {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	t.Run("handshake keeps the password last for older clients", func(t *testing.T) {
+		msg := string(handshake("http://abc.localhost", "token", "secret"))
+		assert.Equal(t, "http://abc.localhost", strings.Split(msg, "\n")[0])
+		assert.Equal(t, "secret", strings.Split(msg, "password: ")[1])
+		assert.Equal(t, "token", readSession(t, msg))
+	})
+
+	t.Run("client resumes session with the same url and password", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		ws, msg := dialTestClientHandshake(t, srv, nil)
+		u, key := strings.Split(msg, "\n")[0], strings.Split(msg, "password: ")[1]
+		session := readSession(t, msg)
+		ws.Close()
+		require.True(t, waitForGroup(manager, groupKey(u), true), "group is kept reserved")
+
+		// webhooks sent while the client is away
+		resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+		resp.Body.Close()
+
+		header := make(http.Header)
+		header.Set("session", session)
+		header.Set("key", key)
+		_, resumed := dialTestClientHandshake(t, srv, header)
+		assert.Equal(t, u, strings.Split(resumed, "\n")[0])
+		assert.Equal(t, key, strings.Split(resumed, "password: ")[1])
+		assert.Equal(t, session, readSession(t, resumed))
+
+		// the server only has the hash of the password to check the
+		// password sent by the client
+		header.Del("key")
+		_, resumed = dialTestClientHandshake(t, srv, header)
+		assert.Equal(t, u, strings.Split(resumed, "\n")[0])
+		assert.Empty(t, strings.Split(resumed, "password: ")[1])
+	})
+
+	t.Run("group is deleted after the grace period", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = 50 * time.Millisecond
+		ws, msg := dialTestClientHandshake(t, srv, nil)
+		u := strings.Split(msg, "\n")[0]
+		session := readSession(t, msg)
+		ws.Close()
+		require.True(t, waitForGroup(manager, groupKey(u), false), "group is deleted")
+
+		// expired session gets a new url
+		header := make(http.Header)
+		header.Set("session", session)
+		_, resumedURL, _ := dialTestClient(t, srv, header)
+		assert.NotEqual(t, u, resumedURL)
+	})
+
+	t.Run("group is deleted right away without grace period", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		ws, u, _ := dialTestClient(t, srv, nil)
+		ws.Close()
+		assert.True(t, waitForGroup(manager, groupKey(u), false), "group is deleted")
+	})
+}
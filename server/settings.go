@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"whtester/protocol"
+)
+
+// groupSettings are the settings of a group, set by the server config
+// when the group is created and changed by its clients
+type groupSettings struct {
+	// methods are the http methods forwarded to the clients, every
+	// method is forwarded when empty
+	methods []string
+	// challenges makes the server answer the verification requests
+	// of the providers, see answerChallenge
+	challenges bool
+	// verifyToken is checked against the verify token of Meta
+	verifyToken string
+	// responses are written instead of the default response
+	responses []responseRule
+}
+
+// allows reports if requests with the method are forwarded
+func (s groupSettings) allows(method string) bool {
+	return len(s.methods) == 0 || slices.Contains(s.methods, method)
+}
+
+// message returns the settings as a control message for a client with
+// the role, observers don't get the verify token
+func (s groupSettings) message(role protocol.Role) protocol.Message {
+	msg := protocol.New(protocol.TypeSettings)
+	msg.Settings = &protocol.Settings{
+		Methods:    append([]string{}, s.methods...),
+		Challenges: &s.challenges,
+		Responses:  []protocol.Response{},
+	}
+	if role != protocol.RoleObserver {
+		msg.Settings.VerifyToken = &s.verifyToken
+	}
+	for _, rule := range s.responses {
+		msg.Settings.Responses = append(msg.Settings.Responses, rule.Response)
+	}
+	return msg
+}
+
+// update changes the settings set in the control message, nothing
+// changes when a setting is invalid
+func (s *groupSettings) update(settings *protocol.Settings) error {
+	var methods []string
+	var responses []responseRule
+	var err error
+	if settings.Methods != nil {
+		if methods, err = normalizeMethods(settings.Methods); err != nil {
+			return err
+		}
+	}
+	if settings.Responses != nil {
+		if responses, err = compileResponses(settings.Responses); err != nil {
+			return err
+		}
+	}
+	if settings.Methods != nil {
+		s.methods = methods
+	}
+	if settings.Challenges != nil {
+		s.challenges = *settings.Challenges
+	}
+	if settings.VerifyToken != nil {
+		s.verifyToken = *settings.VerifyToken
+	}
+	if settings.Responses != nil {
+		s.responses = responses
+	}
+	return nil
+}
+
+// normalizeMethods upper cases the methods and checks they are valid
+// http methods
+func normalizeMethods(methods []string) ([]string, error) {
+	res := []string{}
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.IndexFunc(method, func(r rune) bool {
+			return (r < 'A' || r > 'Z') && r != '-'
+		}) >= 0 {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		if !slices.Contains(res, method) {
+			res = append(res, method)
+		}
+	}
+	return res, nil
+}
+
+// ParseMethods parses comma separated http methods like the -methods
+// flag of the client, * is every method and returns no methods
+func ParseMethods(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "*" {
+		return nil, nil
+	}
+	return normalizeMethods(strings.Split(value, ","))
+}
+
+// writeMethodNotAllowed tells the webhook sender which methods the
+// group accepts
+func writeMethodNotAllowed(w http.ResponseWriter, methods []string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// handleSettings changes the settings of the group of the client and
+// sends the new settings to every client of the group speaking the
+// control protocol
+func (m *Manager) handleSettings(c *client, settings *protocol.Settings) {
+	if c.role == protocol.RoleObserver {
+		sendError(c, &protocol.Error{Code: protocol.ErrForbidden, Message: "observers can't change the settings of the group"})
+		return
+	}
+	m.Lock()
+	group, ok := m.ClientList[groupKey(c.url)]
+	if !ok {
+		m.Unlock()
+		return
+	}
+	if err := group.settings.update(settings); err != nil {
+		m.Unlock()
+		reply := protocol.New(protocol.TypeError)
+		reply.Error = &protocol.Error{Code: protocol.ErrInvalidSettings, Message: err.Error()}
+		c.sendMessage(reply)
+		return
+	}
+	m.saveGroup(group.url)
+	current := group.settings
+	var members []client
+	for _, member := range group.clients {
+		if member.proto > 0 {
+			members = append(members, member)
+		}
+	}
+	m.Unlock()
+	for _, member := range members {
+		member.sendMessage(current.message(member.role))
+	}
+}
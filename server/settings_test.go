@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"whtester/protocol"
+	"whtester/serialize"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeMethods(t *testing.T) {
+	got, err := normalizeMethods([]string{"get", " Post", "GET"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET", "POST"}, got)
+
+	_, err = normalizeMethods([]string{"GET POST"})
+	assert.Error(t, err)
+
+	got, err = ParseMethods(" post,get ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"POST", "GET"}, got)
+	got, err = ParseMethods("*")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestMethodPolicy(t *testing.T) {
+	t.Run("every method is forwarded by default", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws, u, _ := dialTestClient(t, srv, nil)
+
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead} {
+			resp := sendWebhook(t, srv, method, u, "")
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode, method)
+
+			_, data, err := ws.ReadMessage()
+			require.NoError(t, err)
+			req, err := serialize.DecodeRequest(data)
+			require.NoError(t, err)
+			assert.Equal(t, method, req.Method)
+			assert.Equal(t, http.NoBody, req.Body)
+		}
+	})
+
+	t.Run("server config limits the methods of new groups", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		manager.AllowedMethods = []string{http.MethodPost}
+		_, u, _ := dialTestClient(t, srv, nil)
+
+		resp := sendWebhook(t, srv, http.MethodGet, u, "")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, "POST", resp.Header.Get("Allow"))
+
+		resp = sendWebhook(t, srv, http.MethodPost, u, "hello")
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	})
+
+	t.Run("clients change the methods of their group", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{Methods: []string{"get", "post"}}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		settings := readProtocolMessage(t, ws, protocol.TypeSettings).Settings
+		assert.Equal(t, []string{"GET", "POST"}, settings.Methods)
+
+		resp := sendWebhook(t, srv, http.MethodDelete, welcome.URL, "")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+
+		// an empty list forwards every method again
+		msg.Settings = &protocol.Settings{Methods: []string{}}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		settings = readProtocolMessage(t, ws, protocol.TypeSettings).Settings
+		assert.Empty(t, settings.Methods)
+
+		// the sender waits for the acknowledgement in the background
+		sent := make(chan int)
+		go func() {
+			sent <- sendWebhook(t, srv, http.MethodDelete, welcome.URL, "").StatusCode
+		}()
+		req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+		decoded, err := serialize.DecodeRequest(req.Data)
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodDelete, decoded.Method)
+		ack := protocol.New(protocol.TypeAck)
+		ack.Ack = &protocol.Ack{ID: req.ID}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack)))
+		assert.Equal(t, http.StatusAccepted, <-sent)
+	})
+
+	t.Run("invalid settings get an error", func(t *testing.T) {
+		_, srv := newTestServer(t)
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		readProtocolMessage(t, ws, protocol.TypeWelcome)
+
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{Methods: []string{"GET POST"}}
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, protocol.Encode(msg)))
+		reply := readProtocolMessage(t, ws, protocol.TypeError)
+		assert.Equal(t, protocol.ErrInvalidSettings, reply.Error.Code)
+	})
+	t.Run("observers don't get the verify token", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		owner := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, owner, protocol.TypeWelcome).Welcome
+		invite := createInvite(t, owner, protocol.Invite{Role: protocol.RoleObserver}).Invite
+		observer := dialProtocolClient(t, srv, protocol.Hello{Invite: invite.Code})
+		readProtocolMessage(t, observer, protocol.TypeWelcome)
+		waitForClients(t, manager, groupKey(welcome.URL), 2)
+
+		token := "secret"
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{VerifyToken: &token}
+		sendProtocolMessage(t, owner, msg)
+		settings := readProtocolMessage(t, owner, protocol.TypeSettings).Settings
+		require.NotNil(t, settings.VerifyToken)
+		assert.Equal(t, "secret", *settings.VerifyToken)
+		assert.Nil(t, readProtocolMessage(t, observer, protocol.TypeSettings).Settings.VerifyToken)
+	})
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"whtester/protocol"
+)
+
+// GroupRecord is the stored state of a group, enough for its clients
+// to reconnect to the same url after a restart of the server
+type GroupRecord struct {
+	URL string `json:"url"`
+	// PasswordHash is the salted hash of the password
+	PasswordHash string `json:"password_hash"`
+	// Sessions are the hashes of the session tokens issued to the
+	// clients, the sessions of observers are in Observers as well
+	Sessions  []string  `json:"session_hashes"`
+	Observers []string  `json:"observer_hashes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Settings are the methods, challenge responder and canned
+	// responses of the group, groups restored without settings get
+	// the settings of new groups
+	Settings *protocol.Settings `json:"settings,omitempty"`
+	// Owner is the name of the api token which created the group
+	Owner string `json:"owner,omitempty"`
+	// Invites are the outstanding invites to the group
+	Invites []Invite `json:"invites,omitempty"`
+}
+
+// State is everything a Store holds
+type State struct {
+	Groups       []GroupRecord
+	Reservations []Reservation
+	// Tokens are hashed, their Token is empty
+	Tokens []APIToken
+	// History holds the request history of the groups, keyed by the
+	// url of the group, oldest first
+	History map[string][]HistoryEntry
+}
+
+// Store keeps the state of the manager so that groups survive restarts
+// of the server, stores are safe for concurrent use
+type Store interface {
+	// Load returns the stored state
+	Load() (State, error)
+	// PutGroup adds or replaces the group with the url of the record
+	PutGroup(g GroupRecord) error
+	// DeleteGroup removes the group with the url along with its history
+	DeleteGroup(u string) error
+	PutReservation(r Reservation) error
+	DeleteReservation(name string) error
+	// PutToken adds or replaces the api token with the name
+	PutToken(t APIToken) error
+	DeleteToken(name string) error
+	// AddHistory adds a request received by the group, the store
+	// keeps the latest HistorySize requests of every group
+	AddHistory(u string, e HistoryEntry) error
+	Close() error
+}
+
+// MemoryStore keeps the state in memory, it is lost when the server
+// stops
+type MemoryStore struct {
+	state storeState
+	sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: newStoreState()}
+}
+
+func (s *MemoryStore) Load() (State, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state.export(), nil
+}
+
+func (s *MemoryStore) PutGroup(g GroupRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.putGroup(g)
+	return nil
+}
+
+func (s *MemoryStore) DeleteGroup(u string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.deleteGroup(u)
+	return nil
+}
+
+func (s *MemoryStore) PutReservation(r Reservation) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.putReservation(r)
+	return nil
+}
+
+func (s *MemoryStore) DeleteReservation(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.deleteReservation(name)
+	return nil
+}
+
+func (s *MemoryStore) PutToken(t APIToken) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.putToken(t)
+	return nil
+}
+
+func (s *MemoryStore) DeleteToken(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.deleteToken(name)
+	return nil
+}
+
+func (s *MemoryStore) AddHistory(u string, e HistoryEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.addHistory(u, e)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// storeState holds the state of the stores, keyed by the url of the
+// group, the reserved name and the name of the token
+type storeState struct {
+	Groups       map[string]GroupRecord    `json:"groups"`
+	Reservations map[string]Reservation    `json:"reservations"`
+	Tokens       map[string]APIToken       `json:"tokens"`
+	History      map[string][]HistoryEntry `json:"history,omitempty"`
+}
+
+func newStoreState() storeState {
+	return storeState{
+		Groups:       make(map[string]GroupRecord),
+		Reservations: make(map[string]Reservation),
+		Tokens:       make(map[string]APIToken),
+		History:      make(map[string][]HistoryEntry),
+	}
+}
+
+func (s *storeState) putGroup(g GroupRecord) {
+	s.Groups[g.URL] = g
+}
+
+func (s *storeState) deleteGroup(u string) {
+	delete(s.Groups, u)
+	delete(s.History, u)
+}
+
+func (s *storeState) putReservation(r Reservation) {
+	s.Reservations[r.Name] = r
+}
+
+func (s *storeState) deleteReservation(name string) {
+	delete(s.Reservations, name)
+}
+
+func (s *storeState) putToken(t APIToken) {
+	t.Token = ""
+	s.Tokens[t.Name] = t
+}
+
+func (s *storeState) deleteToken(name string) {
+	delete(s.Tokens, name)
+}
+
+func (s *storeState) addHistory(u string, e HistoryEntry) {
+	entries := append(s.History[u], e)
+	if len(entries) > HistorySize {
+		entries = entries[len(entries)-HistorySize:]
+	}
+	s.History[u] = entries
+}
+
+// export returns a copy of the state, groups and reservations in the
+// order they were created
+func (s *storeState) export() State {
+	state := State{History: make(map[string][]HistoryEntry)}
+	for _, g := range s.Groups {
+		state.Groups = append(state.Groups, g)
+	}
+	for _, r := range s.Reservations {
+		state.Reservations = append(state.Reservations, r)
+	}
+	for _, t := range s.Tokens {
+		state.Tokens = append(state.Tokens, t)
+	}
+	slices.SortFunc(state.Tokens, func(a, b APIToken) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	slices.SortFunc(state.Groups, func(a, b GroupRecord) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	slices.SortFunc(state.Reservations, func(a, b Reservation) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	for u, entries := range s.History {
+		state.History[u] = slices.Clone(entries)
+	}
+	return state
+}
+
+// Restore makes the manager keep its state in the store and restores
+// the groups and reservations of the store. Restored groups have no
+// clients, they are kept for the grace period of the manager, and at
+// least its RestoreGracePeriod, for their clients to reconnect.
+func (m *Manager) Restore(store Store) error {
+	state, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("loading state: %w", err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.store = store
+	for _, res := range state.Reservations {
+		m.reservations.add(res)
+	}
+	for _, t := range state.Tokens {
+		m.tokens.put(t)
+	}
+	for _, g := range state.Groups {
+		key := groupKey(g.URL)
+		m.Passwords[g.URL] = g.PasswordHash
+		m.tokens.own(g.URL, g.Owner)
+		for _, hash := range g.Sessions {
+			m.sessions[hash] = session{url: g.URL, role: protocol.RoleForwarder}
+		}
+		for _, hash := range g.Observers {
+			m.sessions[hash] = session{url: g.URL, role: protocol.RoleObserver}
+		}
+		for _, inv := range g.Invites {
+			m.invites.add(inv)
+		}
+		group := m.newGroup(g.URL)
+		group.createdAt = g.CreatedAt
+		if g.Settings != nil {
+			if err := group.settings.update(g.Settings); err != nil {
+				fmt.Printf("\nerror restoring the settings of client group %s, %v", key, err)
+			}
+		}
+		m.ClientList[key] = group
+		for _, e := range state.History[g.URL] {
+			m.history.add(key, e)
+		}
+		// the clients get the time to reconnect after the restart, even
+		// when groups are deleted as soon as their clients leave
+		m.reserveGroupFor(key, group, max(m.GracePeriod, m.RestoreGracePeriod))
+	}
+	return nil
+}
+
+// saveGroup saves the url, password, sessions, settings and invites of
+// the group in the store. The caller must hold the lock of the manager.
+func (m *Manager) saveGroup(u string) {
+	record := GroupRecord{URL: u, PasswordHash: m.Passwords[u], CreatedAt: time.Now(), Owner: m.tokens.owner(u)}
+	if group, ok := m.ClientList[groupKey(u)]; ok {
+		record.CreatedAt = group.createdAt
+		record.Settings = group.settings.message(protocol.RoleForwarder).Settings
+	}
+	for hash, s := range m.sessions {
+		if s.url != u {
+			continue
+		}
+		record.Sessions = append(record.Sessions, hash)
+		if s.role == protocol.RoleObserver {
+			record.Observers = append(record.Observers, hash)
+		}
+	}
+	slices.Sort(record.Sessions)
+	slices.Sort(record.Observers)
+	record.Invites = m.invites.group(u, time.Now())
+	if err := m.store.PutGroup(record); err != nil {
+		fmt.Printf("\nerror saving client group %s in the store, %v", groupKey(u), err)
+	}
+}
+
+// PutToken adds or replaces the api token and saves it in the store
+func (m *Manager) PutToken(t APIToken) error {
+	if t.Token != "" {
+		t.Hash = hashToken(t.Token)
+		t.Token = ""
+	}
+	m.tokens.put(t)
+	return m.store.PutToken(t)
+}
+
+// DeleteToken removes the api token from the manager and the store,
+// clients connected with it stay connected
+func (m *Manager) DeleteToken(name string) error {
+	m.tokens.remove(name)
+	return m.store.DeleteToken(name)
+}
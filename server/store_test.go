@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemoryStore() },
+		"file": func(t *testing.T) Store {
+			s, err := OpenFileStore(t.TempDir())
+			require.NoError(t, err)
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+	for name, open := range stores {
+		t.Run(name+" store keeps groups and reservations", func(t *testing.T) {
+			s := open(t)
+			now := time.Now()
+			require.NoError(t, s.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "old", CreatedAt: now}))
+			require.NoError(t, s.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "secret", Sessions: []string{hashToken("token")}, CreatedAt: now, Settings: &protocol.Settings{Methods: []string{"POST"}}}))
+			require.NoError(t, s.PutGroup(GroupRecord{URL: "http://xyz.localhost", PasswordHash: "other", CreatedAt: now.Add(time.Second)}))
+			require.NoError(t, s.DeleteGroup("http://xyz.localhost"))
+			require.NoError(t, s.PutReservation(Reservation{Name: "team-payments", TokenHash: hashToken("owner")}))
+
+			state, err := s.Load()
+			require.NoError(t, err)
+			require.Len(t, state.Groups, 1)
+			assert.Equal(t, "secret", state.Groups[0].PasswordHash)
+			assert.Equal(t, []string{hashToken("token")}, state.Groups[0].Sessions)
+			assert.Equal(t, []string{"POST"}, state.Groups[0].Settings.Methods)
+			require.Len(t, state.Reservations, 1)
+			assert.True(t, state.Reservations[0].owns("owner"))
+		})
+
+		t.Run(name+" store keeps the latest history", func(t *testing.T) {
+			s := open(t)
+			for i := range HistorySize + 5 {
+				require.NoError(t, s.AddHistory("http://abc.localhost", HistoryEntry{ID: string(rune('a' + i%26)), Size: i}))
+			}
+			state, err := s.Load()
+			require.NoError(t, err)
+			entries := state.History["http://abc.localhost"]
+			require.Len(t, entries, HistorySize)
+			assert.Equal(t, 5, entries[0].Size)
+
+			require.NoError(t, s.DeleteGroup("http://abc.localhost"))
+			state, err = s.Load()
+			require.NoError(t, err)
+			assert.Empty(t, state.History)
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Run("groups are restored for their clients to reconnect", func(t *testing.T) {
+		store := NewMemoryStore()
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		manager.StoreHistory = true
+		require.NoError(t, manager.Restore(store))
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		go func() {
+			req := readProtocolMessage(t, ws, protocol.TypeRequest).Request
+			ack := protocol.New(protocol.TypeAck)
+			ack.Ack = &protocol.Ack{ID: req.ID}
+			ws.WriteMessage(websocket.TextMessage, protocol.Encode(ack))
+		}()
+		resp := sendWebhook(t, srv, http.MethodPost, welcome.URL, "hello")
+		resp.Body.Close()
+
+		restarted, srv := newTestServer(t)
+		restarted.GracePeriod = time.Minute
+		require.NoError(t, restarted.Restore(store))
+		assert.Len(t, restarted.history.query(groupKey(welcome.URL), historyQuery{}), 1)
+
+		// webhooks are queued until the client reconnects
+		resp = sendWebhook(t, srv, http.MethodPost, welcome.URL, "queued")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		again := dialProtocolClient(t, srv, protocol.Hello{Session: welcome.Session, Key: welcome.Key})
+		got := readProtocolMessage(t, again, protocol.TypeWelcome).Welcome
+		assert.Equal(t, welcome.URL, got.URL)
+		assert.Equal(t, welcome.Key, got.Key)
+		readProtocolMessage(t, again, protocol.TypeRequest)
+	})
+
+	t.Run("restored groups expire after the grace period", func(t *testing.T) {
+		store := NewMemoryStore()
+		require.NoError(t, store.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "secret"}))
+		manager := NewManager()
+		manager.GracePeriod = 10 * time.Millisecond
+		manager.RestoreGracePeriod = 0
+		require.NoError(t, manager.Restore(store))
+		assert.Eventually(t, func() bool {
+			state, _ := store.Load()
+			return len(state.Groups) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("restored groups are kept without a grace period", func(t *testing.T) {
+		store := NewMemoryStore()
+		require.NoError(t, store.PutGroup(GroupRecord{URL: "http://abc.localhost", PasswordHash: "secret"}))
+		manager := NewManager()
+		manager.GracePeriod = 0
+		manager.RestoreGracePeriod = 50 * time.Millisecond
+		require.NoError(t, manager.Restore(store))
+		manager.RLock()
+		_, ok := manager.ClientList["abc"]
+		manager.RUnlock()
+		assert.True(t, ok)
+		assert.Eventually(t, func() bool {
+			state, _ := store.Load()
+			return len(state.Groups) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("session tokens are stored as hashes", func(t *testing.T) {
+		store := NewMemoryStore()
+		manager, srv := newTestServer(t)
+		require.NoError(t, manager.Restore(store))
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+
+		state, err := store.Load()
+		require.NoError(t, err)
+		require.Len(t, state.Groups, 1)
+		assert.Equal(t, []string{hashToken(welcome.Session)}, state.Groups[0].Sessions)
+	})
+
+	t.Run("settings are restored", func(t *testing.T) {
+		store := NewMemoryStore()
+		manager, srv := newTestServer(t)
+		manager.GracePeriod = time.Minute
+		require.NoError(t, manager.Restore(store))
+		ws := dialProtocolClient(t, srv, protocol.Hello{})
+		welcome := readProtocolMessage(t, ws, protocol.TypeWelcome).Welcome
+		on := true
+		msg := protocol.New(protocol.TypeSettings)
+		msg.Settings = &protocol.Settings{
+			Methods:    []string{"POST"},
+			Challenges: &on,
+			Responses:  []protocol.Response{{Path: "/github/*", Status: http.StatusTeapot}},
+		}
+		sendProtocolMessage(t, ws, msg)
+		readProtocolMessage(t, ws, protocol.TypeSettings)
+
+		restarted, srv := newTestServer(t)
+		require.NoError(t, restarted.Restore(store))
+		resp := sendWebhook(t, srv, http.MethodGet, welcome.URL, "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		resp = sendWebhook(t, srv, http.MethodPost, welcome.URL+"/github/push", "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+		resp = sendWebhook(t, srv, http.MethodPost, welcome.URL+"/?validationToken=abc", "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
@@ -2,14 +2,18 @@ package server
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"whtester/protocol"
 	"whtester/serialize"
 
 	"github.com/google/uuid"
@@ -19,133 +23,575 @@ import (
 var (
 	PongWaitTime = 1 * time.Minute
 	PingWaitTime = (PongWaitTime * 9) / 10
+	// RelayWaitTime is how long the server holds the webhook request
+	// open, waiting for a relay client to send back the response
+	RelayWaitTime = 30 * time.Second
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{protocol.Subprotocol},
 }
 
-type handler func(w http.ResponseWriter, r *http.Request)
+// ClientOptions are the features a client asks for when it connects
+type ClientOptions struct {
+	// Relay clients send back the response of their local program,
+	// which is then written to the webhook sender
+	Relay bool
+	// Ack clients acknowledge every request they handle, requests
+	// which are not acknowledged are sent again
+	Ack bool
+	// Protocol is the version of the control protocol spoken by
+	// the client, zero for clients using the legacy format
+	Protocol int
+	// Token is the name of the api token the client connected with
+	Token string
+	// Role of the client in its group, observers don't relay nor
+	// acknowledge requests
+	Role protocol.Role
+	// Session is the session token of the client, it is revoked when
+	// the client is kicked
+	Session string
+}
 
-func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h(w, r)
+// clientOptionsFrom reads the options from the headers of the
+// websocket upgrade request
+func clientOptionsFrom(r *http.Request) ClientOptions {
+	return ClientOptions{
+		Relay: r.Header.Get("relay") == "true",
+		Ack:   r.Header.Get("ack") == "true",
+	}
 }
 
 type client struct {
-	url string
-	ws  *websocket.Conn
-	uid string
-	handler
+	url   string
+	ws    *websocket.Conn
+	uid   string
+	relay bool
+	proto int
+	// token is the name of the api token of the client
+	token       string
+	role        protocol.Role
+	session     string
+	remoteAddr  string
+	connectedAt time.Time
+	stats       *clientStats
+	// out queues the messages for the client, only its writer writes
+	// to the connection once the client is in its group
+	out *outbox
+	// pending holds the requests the client has not acknowledged,
+	// nil for clients which don't acknowledge requests
+	pending *pendingRequests
+}
+
+// send queues the encoded request for the client, receivedAt is zero
+// when the request is sent again
+func (c client) send(id string, msg []byte, receivedAt time.Time) error {
+	out := outbound{msgType: websocket.TextMessage, request: true, receivedAt: receivedAt}
+	if c.proto > 0 {
+		req := protocol.New(protocol.TypeRequest)
+		req.Request = &protocol.Request{ID: id, Data: msg}
+		out.data = protocol.Encode(req)
+	} else {
+		// legacy clients only decode the gob format
+		r, err := serialize.DecodeRequest(msg)
+		if err != nil {
+			return err
+		}
+		out.data, err = serialize.EncodeLegacyRequest(r)
+		if err != nil {
+			return err
+		}
+		out.msgType = websocket.BinaryMessage
+	}
+	return c.out.push(out)
+}
+
+// deliver sends the request received at receivedAt and keeps it until
+// the client acknowledges it
+func (c client) deliver(id string, msg []byte, receivedAt time.Time) error {
+	c.stats.delivered.Add(1)
+	if c.pending != nil {
+		c.pending.add(id, msg, receivedAt, time.Now())
+	}
+	err := c.send(id, msg, receivedAt)
+	// the sender of a refused request retries, it is not sent again
+	if errors.Is(err, errQueueFull) && c.pending != nil {
+		c.pending.ack(id)
+	}
+	return err
 }
 
 type clientGroup struct {
+	url     string
 	clients map[string]client
+	// expire deletes the group once the grace period of an
+	// empty group is over
+	expire *time.Timer
+	// queue holds the requests received while the group has
+	// no clients
+	queue     *requestQueue
+	settings  groupSettings
+	createdAt time.Time
+	stats     *groupStats
+}
+
+// relay reports if any client of the group relays responses
+func (g clientGroup) relay() bool {
+	for _, c := range g.clients {
+		if c.relay {
+			return true
+		}
+	}
+	return false
+}
+
+// ack reports if any client of the group acknowledges requests
+func (g clientGroup) ack() bool {
+	for _, c := range g.clients {
+		if c.pending != nil {
+			return true
+		}
+	}
+	return false
 }
 
 type Manager struct {
-	ClientList map[string]clientGroup
-	Passwords  map[string]string
+	ClientList map[string]*clientGroup
+	// Passwords holds the salted hashes of the group passwords, keyed
+	// by the url of the group
+	Passwords map[string]string
+	// GracePeriod is how long a group without clients is kept,
+	// so that its clients can reconnect to the same url
+	GracePeriod time.Duration
+	// RestoreGracePeriod is how long the groups restored from the
+	// store are kept at least, so that their clients get the time to
+	// reconnect after a restart even with a shorter grace period
+	RestoreGracePeriod time.Duration
+	// NoClientStatus is the status written to the webhook sender
+	// when the url has no clients and the request can't be queued
+	NoClientStatus int
+	// QueueSize and QueueMaxAge limit the requests queued for a
+	// group while it has no clients
+	QueueSize   int
+	QueueMaxAge time.Duration
+	// AckWaitTime is how long the server waits for a client to
+	// acknowledge a request before sending it again
+	AckWaitTime time.Duration
+	// AllowedMethods are the http methods forwarded to new groups,
+	// every method is forwarded when empty
+	AllowedMethods []string
+	// Challenges makes new groups answer the verification requests
+	// of the providers
+	Challenges bool
+	// PathMode generates urls of the form <scheme>://<domain>/h/<id>
+	// instead of <scheme>://<id>.<domain>, for deployments without
+	// wildcard DNS
+	PathMode bool
+	// Scheme of the generated urls
+	Scheme string
+	// WriteQueueSize bounds the messages waiting to be written to a
+	// client, WriteQueueOverflow is what happens when the queue is full
+	WriteQueueSize     int
+	WriteQueueOverflow OverflowPolicy
+	// ReconnectURL is the websocket url the clients are told to
+	// reconnect to when the server drains, they reconnect to the same
+	// url when empty
+	ReconnectURL string
+	// IDs generates the ids of the urls of new groups
+	IDs IDGenerator
+	// Blocklist holds the names clients can't request
+	Blocklist []string
+	// RequireToken refuses clients without a valid api token
+	RequireToken bool
+	tokens       *tokenRegistry
+	lockout      *lockout
+	// StoreHistory saves the request history in the store, so that
+	// it survives restarts along with the groups
+	StoreHistory bool
+	store        Store
+	reservations *reservations
+	sessions     map[string]session
+	invites      *invites
+	relays       *waiters[*http.Response]
+	acks         *waiters[ackResult]
+	history      *historyStore
+	stats        *serverStats
+	metrics      *metrics
+	// draining is set once the server shuts down, inflight counts the
+	// webhook requests being handled
+	draining atomic.Bool
+	inflight atomic.Int64
 	sync.RWMutex
 }
 
 func NewManager() *Manager {
 	m := Manager{}
-	m.ClientList = make(map[string]clientGroup)
+	m.ClientList = make(map[string]*clientGroup)
 	m.Passwords = make(map[string]string)
+	m.sessions = make(map[string]session)
+	m.invites = newInvites()
+	m.NoClientStatus = http.StatusServiceUnavailable
+	m.Scheme = "http"
+	m.IDs = RandomIDs{Length: 8}
+	m.Blocklist = slices.Clone(ReservedNames)
+	m.reservations = newReservations()
+	m.store = NewMemoryStore()
+	m.tokens = newTokenRegistry()
+	m.lockout = newLockout()
+	m.QueueSize = 100
+	m.QueueMaxAge = 10 * time.Minute
+	m.RestoreGracePeriod = 2 * time.Minute
+	m.AckWaitTime = AckWaitTime
+	m.relays = newWaiters[*http.Response]()
+	m.acks = newWaiters[ackResult]()
+	m.history = newHistoryStore(HistorySize)
+	m.stats = newServerStats()
+	m.metrics = newMetrics()
+	m.WriteQueueSize = WriteQueueSize
+	m.WriteQueueOverflow = OverflowDisconnect
 	return &m
 }
 
 func (s *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	subdomain := strings.Split(r.Host, ".")[0]
-	clientGroup, ok := s.ClientList[subdomain]
-	for _, client := range clientGroup.clients {
-		if ok {
-			client.handler(w, r)
-		} else {
-			w.Write([]byte("client connection closed"))
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	receivedAt := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() {
+		// nothing written is an empty 200 response
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.metrics.request(r.Method, rec.status)
+	}()
+	key, ok := s.requestGroup(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.RLock()
+	clientGroup, ok := s.ClientList[key]
+	var clients []client
+	var relay, ack bool
+	var settings groupSettings
+	if ok {
+		for _, c := range clientGroup.clients {
+			clients = append(clients, c)
+		}
+		relay = clientGroup.relay()
+		ack = clientGroup.ack()
+		settings = clientGroup.settings
+	}
+	s.RUnlock()
+	if !ok {
+		s.writeNoClient(w)
+		return
+	}
+	// the server answers the providers verifying the url, even when
+	// the local program is not running or the group doesn't take the
+	// method of the verification, the clients still get the request
+	var answer challenge
+	var isChallenge bool
+	if settings.challenges {
+		answer, isChallenge = answerChallenge(r, settings.verifyToken)
+	}
+	if !isChallenge && !settings.allows(r.Method) {
+		writeMethodNotAllowed(w, settings.methods)
+		return
+	}
+	s.stats.requests.Add(1)
+	clientGroup.stats.requests.Add(1)
+
+	// tag the request, so that the response of relay client and
+	// the acknowledgements can be matched with the request
+	id := uuid.New().String()
+	r.Header.Set(serialize.RequestIDHeader, id)
+	msg, err := serialize.EncodeRequest(r)
+	if errors.Is(err, serialize.ErrTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := HistoryEntry{
+		ID:         id,
+		ReceivedAt: receivedAt,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		RemoteAddr: r.RemoteAddr,
+		Size:       len(msg),
+		Request:    msg,
+	}
+	entry = s.history.add(key, entry)
+	if s.StoreHistory && clientGroup != nil {
+		if err := s.store.AddHistory(clientGroup.url, entry); err != nil {
+			fmt.Printf("\nerror saving request %s in the store, %v", id, err)
 		}
 	}
+
+	if isChallenge {
+		fmt.Printf("\nanswered %s challenge for %s", answer.provider, key)
+		s.notify(key, clients, id, msg, receivedAt)
+		answer.write(w)
+		return
+	}
+	// canned responses replace the response of the clients
+	if rule, ok := matchResponse(settings.responses, r); ok {
+		s.notify(key, clients, id, msg, receivedAt)
+		rule.write(r.Context(), w, r, id)
+		return
+	}
+
+	var relayed chan *http.Response
+	var acked chan ackResult
+	if relay {
+		relayed = s.relays.add(id)
+		defer s.relays.remove(id)
+	} else if ack {
+		acked = s.acks.add(id)
+		defer s.acks.remove(id)
+	}
+	// keep the request until a client of the group reconnects
+	if len(clients) == 0 {
+		var queued bool
+		clients, queued = s.enqueue(key, id, msg)
+		if !queued {
+			s.writeNoClient(w)
+			return
+		}
+		if len(clients) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	// clients which don't keep up refuse the request with the reject
+	// overflow policy, the sender retries later. The queues are checked
+	// before delivering to any client, so that the retry isn't sent
+	// twice to the clients which got the request
+	for _, c := range clients {
+		if c.out.rejects() {
+			writeNotKeepingUp(w)
+			return
+		}
+	}
+	// a queue may fill up in the meantime, the request is accepted
+	// once a client got it
+	delivered := 0
+	for _, c := range clients {
+		if err := c.deliver(id, msg, receivedAt); errors.Is(err, errQueueFull) {
+			fmt.Printf("\nclient %s is not keeping up, request %s is not sent to it", c.uid, id)
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		writeNotKeepingUp(w)
+		return
+	}
+
+	switch {
+	case relayed != nil:
+		select {
+		case resp := <-relayed:
+			writeResponse(w, resp)
+		case <-time.After(RelayWaitTime):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case <-r.Context().Done():
+		}
+	case acked != nil:
+		// the request is sent again if it is not acknowledged,
+		// so the sender is told it is accepted on timeout
+		select {
+		case result := <-acked:
+			if result.err != "" {
+				http.Error(w, result.err, http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case <-time.After(s.AckWaitTime):
+			w.WriteHeader(http.StatusAccepted)
+		case <-r.Context().Done():
+		}
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
 }
 
-func (m *Manager) AddNewClient(u string, ws *websocket.Conn) {
+// notify sends the request to the clients without waiting for them,
+// the request is queued if the group has no clients
+func (m *Manager) notify(key string, clients []client, id string, msg []byte, receivedAt time.Time) {
+	if len(clients) == 0 {
+		clients, _ = m.enqueue(key, id, msg)
+	}
+	for _, c := range clients {
+		c.deliver(id, msg, receivedAt)
+	}
+}
+
+// writeNotKeepingUp tells the webhook sender to retry as the clients
+// don't keep up
+func writeNotKeepingUp(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "client is not keeping up", http.StatusServiceUnavailable)
+}
+
+// writeNoClient tells the webhook sender that the url has no clients
+func (m *Manager) writeNoClient(w http.ResponseWriter) {
+	w.WriteHeader(m.NoClientStatus)
+	w.Write([]byte("client connection closed"))
+}
+
+func (m *Manager) AddNewClient(u string, ws *websocket.Conn, opts ClientOptions) {
 	m.Lock()
 	defer m.Unlock()
-	uStruct, _ := url.Parse(u)
 	uid := uuid.New().String()
 	// handle client conn
 	newClient := &client{
-		url: u,
-		ws:  ws,
-		handler: func(w http.ResponseWriter, r *http.Request) {
-			//handle client
-			if r.Method == http.MethodPost {
-				msg := serialize.EncodeRequest(r)
-				ws.WriteMessage(websocket.BinaryMessage, msg)
-				w.WriteHeader(http.StatusAccepted)
-			} else {
-				w.WriteHeader(http.StatusForbidden)
-			}
-		},
-		uid: uid,
+		url:         u,
+		ws:          ws,
+		uid:         uid,
+		relay:       opts.Relay,
+		proto:       opts.Protocol,
+		token:       opts.Token,
+		role:        opts.Role,
+		session:     opts.Session,
+		remoteAddr:  ws.RemoteAddr().String(),
+		connectedAt: time.Now(),
+		stats:       &clientStats{},
+		out:         newOutbox(ws, m.WriteQueueSize, m.WriteQueueOverflow, m.metrics),
+	}
+	if newClient.role == "" {
+		newClient.role = protocol.RoleForwarder
+	}
+	if newClient.role == protocol.RoleObserver {
+		newClient.relay = false
+	} else if opts.Ack {
+		newClient.pending = newPendingRequests()
 	}
-	subdomain := strings.Split(uStruct.Host, ".")[0]
-	group, ok := m.ClientList[subdomain]
+	key := groupKey(u)
+	group, ok := m.ClientList[key]
 	if !ok {
-		newGroup := &clientGroup{
-			clients: make(map[string]client),
-		}
-		m.ClientList[subdomain] = *newGroup
+		newGroup := m.newGroup(u)
+		m.stats.groups.Add(1)
+		m.ClientList[key] = newGroup
 		newGroup.clients[uid] = *newClient
 	} else {
+		// the group is in use again
+		if group.expire != nil {
+			group.expire.Stop()
+			group.expire = nil
+		}
 		group.clients[uid] = *newClient
 	}
+	// the slot of the token was taken by authorize
+	m.stats.clients.Add(1)
 	fmt.Printf("\nnew client: %s", uid)
 	go m.HandleClient(newClient)
 }
 
+// newGroup returns an empty group with the settings of new groups
+func (m *Manager) newGroup(u string) *clientGroup {
+	return &clientGroup{
+		url:       u,
+		clients:   make(map[string]client),
+		settings:  groupSettings{methods: m.AllowedMethods, challenges: m.Challenges},
+		createdAt: time.Now(),
+		stats:     &groupStats{},
+	}
+}
+
 func (m *Manager) RemoveClient(c *client) {
 	m.Lock()
 	defer m.Unlock()
-	clientURL, _ := url.Parse(c.url)
-	clientKey := strings.Split(clientURL.Host, ".")[0]
+	clientKey := groupKey(c.url)
+	c.out.stop()
 	c.ws.Close()
-	// delete client from the group
+	m.tokens.connected(c.token, -1)
+	// delete client from the group, the group is gone if it was
+	// deleted by an admin
 	group, ok := m.ClientList[clientKey]
+	if !ok {
+		return
+	}
 	delete(group.clients, c.uid)
 	fmt.Printf("\nremoved client : %s", c.uid)
 
-	// no client in the group delete the group
-	if ok && len(group.clients) == 0 {
-		delete(m.ClientList, clientKey)
-		// delete the client also from passwords
-		delete(m.Passwords, clientKey)
-		fmt.Printf("\nremove client group: %s", clientKey)
+	// no client in the group, keep it reserved for the
+	// grace period before deleting it
+	if len(group.clients) == 0 {
+		// requests the client didn't acknowledge are sent
+		// again when a client reconnects
+		if c.pending != nil {
+			m.requeue(group, c.pending.drain())
+		}
+		m.reserveGroup(clientKey, group)
 	}
 }
 
 func (m *Manager) HandleClient(c *client) {
 	c.ws.SetReadDeadline(time.Now().Add(PongWaitTime))
 	c.ws.SetPongHandler(func(appData string) error {
+		m.metrics.pong(appData, time.Now())
 		return c.ws.SetReadDeadline(time.Now().Add(PongWaitTime))
 	})
 	defer m.RemoveClient(c)
+	done := make(chan struct{})
+	defer close(done)
+	go c.out.run(done)
 	ticker := time.NewTicker(PingWaitTime)
 	// send pings to client
 	go func() {
+		defer ticker.Stop()
 		for {
-			<-ticker.C
-			c.ws.WriteMessage(websocket.PingMessage, []byte(""))
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// the pong carries the payload back, which times
+				// the round trip. Control messages can be written
+				// along with the writer of the client.
+				now := time.Now()
+				if err := c.ws.WriteControl(websocket.PingMessage, pingPayload(now), now.Add(WriteWaitTime)); err != nil {
+					m.metrics.writeFailures.Add(1)
+				}
+			}
 		}
 	}()
+	if c.pending != nil {
+		go m.redeliver(c, done)
+	}
 	// read message from client to trigger pong handler
 	for {
-		_, _, err := c.ws.ReadMessage()
+		msgType, data, err := c.ws.ReadMessage()
 		// if err != nil connection is closed
 		// remove the client on returning
 		if err != nil {
 			return
 		}
+		if c.proto > 0 {
+			if msgType == websocket.TextMessage && !m.handleMessage(c, data) {
+				return
+			}
+			continue
+		}
+		// binary messages from relay clients are the responses
+		// of their local program
+		if msgType == websocket.BinaryMessage && c.relay {
+			if id, resp, err := serialize.DecodeResponse(data); err == nil {
+				m.relays.deliver(id, resp)
+			}
+		}
+		if msgType == websocket.TextMessage {
+			if id, errMsg, ok := serialize.DecodeAck(data); ok {
+				m.handleAck(c, id, errMsg)
+			}
+		}
 	}
 }
 
@@ -161,16 +607,24 @@ func GenerateRandomURL(scheme string, domain string, subDomainLen int) string {
 }
 
 func GenerateRandomString(strLen int) string {
-	var charSet = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
-	var randStr = make([]rune, strLen)
+	randStr, err := randomString(IDCharset, strLen)
+	if err != nil {
+		log.Fatalf("unable to generate random number, %v", err)
+	}
+	return randStr
+}
+
+// randomString returns strLen characters drawn uniformly from charSet
+func randomString(charSet string, strLen int) (string, error) {
+	var randStr = make([]byte, strLen)
 	for i := 0; i < strLen; i++ {
-		index, err := rand.Int(rand.Reader, big.NewInt(int64(strLen)))
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(charSet))))
 		if err != nil {
-			log.Fatalf("unable to generate random number, %v", err)
+			return "", err
 		}
 		randStr[i] = charSet[index.Int64()]
 	}
-	return string(randStr)
+	return string(randStr), nil
 }
 
 // Check if the given url is valid
@@ -188,48 +642,94 @@ func CheckValidURL(u string) bool {
 func NewWebHookHandler(clientsManager *Manager, domain string) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !clientsManager.acceptClients(w) {
+			return
+		}
+		apiToken, ok := clientsManager.authenticate(w, r)
+		if !ok {
+			return
+		}
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Fatalf("error establishing websocket connection")
-		}
-		u := []byte(GenerateRandomURL("http", domain, 8))
-		// generate random password
-		password := GenerateRandomString(6)
-		clientsManager.Passwords[string(u)] = password
-		clientsManager.AddNewClient(string(u), ws)
-		// send password and unique url to the client
-		u = append(u, []byte(fmt.Sprintf("\npassword: %s", password))...)
-		ws.WriteMessage(websocket.TextMessage, u)
+			log.Printf("error establishing websocket connection, %v", err)
+			return
+		}
+		if ws.Subprotocol() == protocol.Subprotocol {
+			clientsManager.handleHello(ws, domain, apiToken)
+			return
+		}
+		if refused := clientsManager.authorize(apiToken, ScopeCreate); refused != nil {
+			rejectLegacy(ws, refused)
+			return
+		}
+		// clients which lost their connection resume their session
+		u, password, session, err := clientsManager.claimGroup(domain, r.Header.Get("session"), r.Header.Get("key"), apiToken)
+		if err != nil {
+			clientsManager.release(apiToken)
+			log.Printf("error creating group, %v", err)
+			ws.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+			ws.Close()
+			return
+		}
+		// send password, session and unique url to the client, before
+		// its writer takes over the connection
+		ws.WriteMessage(websocket.TextMessage, handshake(u, session, password))
+		opts := clientOptionsFrom(r)
+		opts.Token = tokenName(apiToken)
+		opts.Session = session
+		// a resumed session keeps its role, observers don't become
+		// forwarders by reconnecting
+		opts.Role = clientsManager.sessionRole(session)
+		clientsManager.AddNewClient(u, ws, opts)
+		clientsManager.deliverQueued(u, ws)
+		clientsManager.announceMember(u, ws)
 	})
 
 	mux.HandleFunc("/wsold", func(w http.ResponseWriter, r *http.Request) {
+		if !clientsManager.acceptClients(w) {
+			return
+		}
+		apiToken, ok := clientsManager.authenticate(w, r)
+		if !ok {
+			return
+		}
 		// upgrade connection to websockets
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Fatalf("error establishing websocket connection")
+			log.Printf("error establishing websocket connection, %v", err)
+			return
 		}
-
-		Url := r.Header.Get("url")
-		Key := r.Header.Get("key")
-
-		if err != nil {
-			ws.WriteMessage(websocket.TextMessage, []byte("invalid json data"))
-			ws.Close()
+		if ws.Subprotocol() == protocol.Subprotocol {
+			clientsManager.handleHello(ws, domain, apiToken)
 			return
 		}
-
-		// check if the group exists
-		key, ok := clientsManager.Passwords[Url]
-		if !ok {
-			ws.WriteMessage(websocket.TextMessage, []byte("invalid group, grop does not exisit"))
-			ws.Close()
+		if refused := clientsManager.authorize(apiToken, ScopeJoin); refused != nil {
+			rejectLegacy(ws, refused)
 			return
 		}
 
-		if key == Key {
-			clientsManager.AddNewClient(Url, ws)
+		Url := r.Header.Get("url")
+		Key := r.Header.Get("key")
+		if refused := clientsManager.checkJoin(remoteIP(r.RemoteAddr), Url, Key); refused != nil {
+			clientsManager.release(apiToken)
+			rejectLegacy(ws, refused)
+			return
 		}
+		session := clientsManager.newSession(Url, protocol.RoleForwarder)
+		ws.WriteMessage(websocket.TextMessage, handshake(Url, session, Key))
+		opts := clientOptionsFrom(r)
+		opts.Token = tokenName(apiToken)
+		opts.Session = session
+		clientsManager.AddNewClient(Url, ws, opts)
+		clientsManager.deliverQueued(Url, ws)
+		clientsManager.announceMember(Url, ws)
 	})
+	// the health checks and the api paths are webhook paths like any
+	// other on the subdomain of a group
+	mux.HandleFunc("GET /healthz", clientsManager.serverOnly(domain, clientsManager.handleHealthz))
+	mux.HandleFunc("GET /readyz", clientsManager.serverOnly(domain, clientsManager.handleReadyz))
+	mux.HandleFunc("GET /api/groups/{id}/requests", clientsManager.serverOnly(domain, clientsManager.HandleListRequests))
+	mux.HandleFunc("GET /api/groups/{id}/requests/{reqid}", clientsManager.serverOnly(domain, clientsManager.HandleGetRequest))
 	mux.Handle("/", clientsManager)
 	return mux
 }
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"whtester/serialize"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -177,7 +178,7 @@ func TestForwardingMessage(t *testing.T) {
 		}
 	})
 
-	t.Run("server forwards only post request", func(t *testing.T) {
+	t.Run("server forwards get request", func(t *testing.T) {
 		// create a new client
 		c := NewclientTestFake()
 		defer c.ws.Close()
@@ -192,8 +193,8 @@ func TestForwardingMessage(t *testing.T) {
 			url: c.url,
 		}
 		resp := whTrigger.sentGETRequest()
-		if resp.StatusCode == http.StatusAccepted {
-			t.Errorf("get requets not ignored got statusAccepted, %d", resp.StatusCode)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("get request not forwarded, got status %d", resp.StatusCode)
 		}
 	})
 	t.Run("server sends the post request it receives in binary format to client", func(t *testing.T) {
@@ -469,6 +470,17 @@ func checkClientConnectionOpen(t testing.TB, manager *Manager, c *clientTestFake
 	}
 }
 
+func TestRequestTooLarge(t *testing.T) {
+	defer func(size int64) { serialize.MaxBodySize = size }(serialize.MaxBodySize)
+	serialize.MaxBodySize = 4
+
+	_, srv := newTestServer(t)
+	_, u, _ := dialTestClient(t, srv, nil)
+
+	resp := sendWebhook(t, srv, http.MethodPost, u, "too large")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
 func startServer(t testing.TB) (*Manager, func() error) {
 	t.Helper()
 	clientManager := NewManager()
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"whtester/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// WriteWaitTime is how long a write to a client can take, clients
+	// which don't read for that long are disconnected
+	WriteWaitTime = 10 * time.Second
+	// WriteQueueSize is the number of messages waiting to be written to
+	// a client by default
+	WriteQueueSize = 256
+)
+
+// OverflowPolicy is what happens to a message for a client whose write
+// queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the oldest message of the queue, requests
+	// are sent again to clients which acknowledge them
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDisconnect disconnects the client, requests it didn't
+	// acknowledge are queued for the group until it reconnects
+	OverflowDisconnect OverflowPolicy = "disconnect"
+	// OverflowReject refuses the message, the webhook sender gets 503
+	// and retries later
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// ParseOverflowPolicy returns the policy of the name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case OverflowDropOldest, OverflowDisconnect, OverflowReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, expected %s, %s or %s", name, OverflowDropOldest, OverflowDisconnect, OverflowReject)
+}
+
+var (
+	errQueueFull  = errors.New("client write queue is full")
+	errClientGone = errors.New("client is disconnected")
+)
+
+// outbound is a message waiting to be written to a client
+type outbound struct {
+	msgType int
+	data    []byte
+	// request is set for the webhook requests, receivedAt is when the
+	// server received them, zero when they are sent again
+	request    bool
+	receivedAt time.Time
+	// closeCode is set for the close message, which ends the queue
+	closeCode int
+}
+
+// outbox queues the messages for a client, its writer goroutine is the
+// only one writing messages to the connection
+type outbox struct {
+	ws      *websocket.Conn
+	metrics *metrics
+	size    int
+	policy  OverflowPolicy
+	items   []outbound
+	// wake tells the writer there are messages to write
+	wake chan struct{}
+	// closed is set once the queue takes no more messages
+	closed bool
+	sync.Mutex
+}
+
+func newOutbox(ws *websocket.Conn, size int, policy OverflowPolicy, metrics *metrics) *outbox {
+	if size <= 0 {
+		size = WriteQueueSize
+	}
+	if policy == "" {
+		policy = OverflowDisconnect
+	}
+	return &outbox{ws: ws, metrics: metrics, size: size, policy: policy, wake: make(chan struct{}, 1)}
+}
+
+// push queues the message, the overflow policy applies when the queue
+// is full
+func (o *outbox) push(msg outbound) error {
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return errClientGone
+	}
+	if len(o.items) >= o.size {
+		o.metrics.overflows.Add(1)
+		switch o.policy {
+		case OverflowDropOldest:
+			o.items = o.items[1:]
+		case OverflowReject:
+			return errQueueFull
+		default:
+			// the writer may be stuck on the client, closing the
+			// connection frees it and ends the read loop
+			o.closed = true
+			o.items = nil
+			go closeConn(o.ws, websocket.ClosePolicyViolation, "client is too slow, disconnected")
+			return errClientGone
+		}
+	}
+	o.items = append(o.items, msg)
+	o.notify()
+	return nil
+}
+
+// close queues the close message after the messages already queued,
+// the queue takes no more messages
+func (o *outbox) close(code int, reason string) {
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.items = append(o.items, outbound{closeCode: code, data: []byte(reason)})
+	o.notify()
+}
+
+// stop drops the queued messages, the client is gone
+func (o *outbox) stop() {
+	o.Lock()
+	defer o.Unlock()
+	o.closed = true
+	o.items = nil
+}
+
+// notify wakes the writer up, the caller must hold the lock
+func (o *outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// rejects reports if the queue is full and refuses the next message,
+// which counts as an overflow
+func (o *outbox) rejects() bool {
+	o.Lock()
+	defer o.Unlock()
+	full := o.policy == OverflowReject && !o.closed && len(o.items) >= o.size
+	if full {
+		o.metrics.overflows.Add(1)
+	}
+	return full
+}
+
+// depth returns the number of queued messages
+func (o *outbox) depth() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.items)
+}
+
+// next returns the oldest queued message
+func (o *outbox) next() (outbound, bool) {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.items) == 0 {
+		return outbound{}, false
+	}
+	msg := o.items[0]
+	o.items = o.items[1:]
+	return msg, true
+}
+
+// run writes the queued messages to the connection until done is
+// closed, the connection is closed when a write fails
+func (o *outbox) run(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-o.wake:
+		}
+		for msg, ok := o.next(); ok; msg, ok = o.next() {
+			if msg.closeCode != 0 {
+				closeConn(o.ws, msg.closeCode, string(msg.data))
+				return
+			}
+			o.ws.SetWriteDeadline(time.Now().Add(WriteWaitTime))
+			err := o.ws.WriteMessage(msg.msgType, msg.data)
+			o.metrics.written(msg, err)
+			if err != nil {
+				o.stop()
+				o.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendMessage queues the control message for the client
+func (c client) sendMessage(msg protocol.Message) error {
+	return c.out.push(outbound{msgType: websocket.TextMessage, data: protocol.Encode(msg)})
+}
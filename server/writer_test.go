@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledClient adds a legacy client whose writer doesn't run to the
+// group abc, so that its write queue fills up. It returns the other end
+// of the connection.
+func stalledClient(t *testing.T, manager *Manager) *websocket.Conn {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		conns <- ws
+	}))
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+	ws := <-conns
+	t.Cleanup(func() { ws.Close() })
+
+	u := "http://abc.localhost"
+	c := client{
+		url:   u,
+		ws:    ws,
+		uid:   "stalled",
+		stats: &clientStats{},
+		out:   newOutbox(ws, manager.WriteQueueSize, manager.WriteQueueOverflow, manager.metrics),
+	}
+	group := manager.newGroup(u)
+	group.clients[c.uid] = c
+	manager.ClientList[groupKey(u)] = group
+	return peer
+}
+
+// postWebhook sends a webhook to the group abc and returns the status
+func postWebhook(manager *Manager) int {
+	req := httptest.NewRequest(http.MethodPost, "http://abc.localhost/", strings.NewReader("hello"))
+	rec := httptest.NewRecorder()
+	manager.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	for _, name := range []string{"drop-oldest", "disconnect", "reject"} {
+		policy, err := ParseOverflowPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, OverflowPolicy(name), policy)
+	}
+	_, err := ParseOverflowPolicy("block")
+	assert.ErrorContains(t, err, "unknown overflow policy")
+}
+
+func TestWriteQueue(t *testing.T) {
+	t.Run("concurrent requests are written one at a time", func(t *testing.T) {
+		manager, srv := newTestServer(t)
+		ws, u, _ := dialTestClient(t, srv, nil)
+		waitForClients(t, manager, groupKey(u), 1)
+
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := sendWebhook(t, srv, http.MethodPost, u, "hello")
+				resp.Body.Close()
+			}()
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for range 20 {
+			msgType, _, err := ws.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, websocket.BinaryMessage, msgType)
+		}
+		wg.Wait()
+	})
+
+	t.Run("drop oldest keeps the newest messages", func(t *testing.T) {
+		out := newOutbox(nil, 2, OverflowDropOldest, newMetrics())
+		for _, data := range []string{"1", "2", "3"} {
+			require.NoError(t, out.push(outbound{data: []byte(data)}))
+		}
+		assert.Equal(t, 2, out.depth())
+		first, _ := out.next()
+		assert.Equal(t, "2", string(first.data))
+		assert.Equal(t, int64(1), out.metrics.overflows.Load())
+	})
+
+	t.Run("reject fails the sender with 503", func(t *testing.T) {
+		manager := NewManager()
+		manager.WriteQueueSize = 1
+		manager.WriteQueueOverflow = OverflowReject
+		stalledClient(t, manager)
+
+		assert.Equal(t, http.StatusAccepted, postWebhook(manager))
+		assert.Equal(t, http.StatusServiceUnavailable, postWebhook(manager))
+		assert.Contains(t, scrapeMetrics(t, manager), "whtester_write_queue_messages 1\n")
+		assert.Contains(t, scrapeMetrics(t, manager), "whtester_write_queue_overflows_total 1\n")
+	})
+
+	t.Run("reject doesn't deliver to any client when one is full", func(t *testing.T) {
+		manager := NewManager()
+		manager.WriteQueueSize = 1
+		manager.WriteQueueOverflow = OverflowReject
+		stalledClient(t, manager)
+		// the other client of the group has room
+		other := client{url: "http://abc.localhost", uid: "other", stats: &clientStats{}, out: newOutbox(nil, 10, OverflowReject, manager.metrics)}
+		manager.ClientList[groupKey(other.url)].clients[other.uid] = other
+
+		assert.Equal(t, http.StatusAccepted, postWebhook(manager))
+		assert.Equal(t, http.StatusServiceUnavailable, postWebhook(manager))
+		// the retry of the sender won't be a duplicate
+		assert.Equal(t, 1, other.out.depth())
+	})
+
+	t.Run("disconnect closes slow clients", func(t *testing.T) {
+		manager := NewManager()
+		manager.WriteQueueSize = 1
+		peer := stalledClient(t, manager)
+
+		assert.Equal(t, http.StatusAccepted, postWebhook(manager))
+		assert.Equal(t, http.StatusAccepted, postWebhook(manager))
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := peer.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "%v", err)
+	})
+
+	t.Run("messages after close are refused", func(t *testing.T) {
+		out := newOutbox(nil, 2, OverflowReject, newMetrics())
+		out.close(websocket.CloseGoingAway, "bye")
+		assert.ErrorIs(t, out.push(outbound{}), errClientGone)
+		msg, ok := out.next()
+		require.True(t, ok)
+		assert.Equal(t, websocket.CloseGoingAway, msg.closeCode)
+	})
+}